@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Ardelean-Calin/cellulose/internal/archive"
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+)
+
+// importCmd restores an archive written by export, or runs every regular file
+// of a plain directory through the ingestion pipeline
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: cellulose import <dir>")
+	}
+	dir := fs.Arg(0)
+
+	database, err := db.InitDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx := db.SystemContext()
+
+	pipeline := ingest.New(database, ingest.DefaultDir)
+
+	if archive.IsArchive(dir) {
+		res, err := archive.Import(ctx, database, pipeline, dir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d imported, %d already in library, %d skipped, %d tags created, %d tags merged\n",
+			res.Imported, res.Existing, res.Skipped, res.TagsCreated, res.TagsMerged)
+		return nil
+	}
+
+	var imported, skipped, failed int
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		doc, err := pipeline.IngestFile(ctx, path)
+		switch {
+		case errors.Is(err, ingest.ErrDuplicate):
+			fmt.Printf("skipped  %s: already in library\n", path)
+			skipped++
+		case err != nil:
+			fmt.Printf("failed   %s: %v\n", path, err)
+			failed++
+		default:
+			fmt.Printf("imported %s (ID: %d)\n", path, doc.ID)
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk %s: %w", dir, err)
+	}
+
+	fmt.Printf("%d imported, %d skipped, %d failed\n", imported, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be imported", failed)
+	}
+	return nil
+}
+
+// exportCmd writes the library as an archive into a directory
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: cellulose export <dir>")
+	}
+	dir := fs.Arg(0)
+
+	database, err := db.InitDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx := db.SystemContext()
+
+	res, err := archive.Export(ctx, database, dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d files written, %d unchanged, %d removed\n", res.Written, res.Unchanged, res.Removed)
+	return nil
+}
+
+// reprocessCmd runs the reprocess bulk action on every stored document: the
+// creation date and size are read from the file again and the match rules
+// pick a correspondent and document type where none is assigned
+func reprocessCmd(args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	fs.Parse(args)
+
+	database, err := db.InitDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx := db.SystemContext()
+
+	documents, err := database.GetDocuments(ctx)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, doc := range documents {
+		results, err := database.ApplyBulk(ctx, []int{doc.ID}, db.BulkAction{Action: db.BulkReprocess})
+		if err == nil {
+			err = results[0].Err
+		}
+		if err != nil {
+			fmt.Printf("failed   %d (%s): %v\n", doc.ID, doc.Opts.Path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("reprocessed %d (%s)\n", doc.ID, doc.Opts.Path)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d documents could not be reprocessed", failed)
+	}
+	return nil
+}
+
+// checkCmd verifies that every document file exists and matches its stored
+// hash, and reports files in the documents and trash directories that no
+// document uses.
+func checkCmd(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Parse(args)
+
+	database, err := db.InitDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx := db.SystemContext()
+
+	documents, err := database.GetDocuments(ctx)
+	if err != nil {
+		return err
+	}
+	trashed, err := database.GetTrashedDocuments(ctx)
+	if err != nil {
+		return err
+	}
+	documents = append(documents, trashed...)
+
+	var problems int
+	known := make(map[string]bool)
+	for _, doc := range documents {
+		abs, _ := filepath.Abs(doc.Opts.Path)
+		known[abs] = true
+
+		hash, err := ingest.HashFile(doc.Opts.Path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			fmt.Printf("missing  %d: %s does not exist\n", doc.ID, doc.Opts.Path)
+			problems++
+		case err != nil:
+			fmt.Printf("error    %d: %v\n", doc.ID, err)
+			problems++
+		case hash != doc.Opts.Hash:
+			fmt.Printf("mismatch %d: %s has hash %s, expected %s\n", doc.ID, doc.Opts.Path, hash, doc.Opts.Hash)
+			problems++
+		}
+	}
+
+	versions, err := database.GetAllVersions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		abs, _ := filepath.Abs(v.Path)
+		known[abs] = true
+
+		hash, err := ingest.HashFile(v.Path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			fmt.Printf("missing  %d v%d: %s does not exist\n", v.DocumentID, v.Number, v.Path)
+			problems++
+		case err != nil:
+			fmt.Printf("error    %d v%d: %v\n", v.DocumentID, v.Number, err)
+			problems++
+		case hash != v.Hash:
+			fmt.Printf("mismatch %d v%d: %s has hash %s, expected %s\n", v.DocumentID, v.Number, v.Path, hash, v.Hash)
+			problems++
+		}
+	}
+
+	orphans, err := findOrphans([]string{ingest.DefaultDir, db.DefaultTrashDir},
+		ingest.New(database, ingest.DefaultDir).WorkDirs(), known)
+	if err != nil {
+		return err
+	}
+	for _, path := range orphans {
+		fmt.Printf("orphan   %s\n", path)
+		problems++
+	}
+
+	fmt.Printf("%d documents checked, %d problems found\n", len(documents), problems)
+	if problems > 0 {
+		return fmt.Errorf("check failed")
+	}
+	return nil
+}
+
+// findOrphans lists the files below dirs whose absolute paths aren't known.
+// The directories in skip are left out.
+func findOrphans(dirs, skip []string, known map[string]bool) ([]string, error) {
+	skipped := make(map[string]bool)
+	for _, dir := range skip {
+		abs, _ := filepath.Abs(dir)
+		skipped[abs] = true
+	}
+
+	var orphans []string
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			abs, _ := filepath.Abs(path)
+			if d.IsDir() && skipped[abs] {
+				return filepath.SkipDir
+			}
+			if d.Type().IsRegular() && !known[abs] {
+				orphans = append(orphans, path)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to walk %s: %w", dir, err)
+		}
+	}
+	return orphans, nil
+}
+
+// addUserCmd creates an account. The password is taken from the
+// CELLULOSE_PASSWORD environment variable or read from standard input.
+func addUserCmd(args []string) error {
+	fs := flag.NewFlagSet("adduser", flag.ExitOnError)
+	admin := fs.Bool("admin", false, "grant administrator rights")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: cellulose adduser [-admin] <name>")
+	}
+
+	password := os.Getenv("CELLULOSE_PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters long")
+	}
+
+	database, err := db.InitDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	role := db.RoleUser
+	if *admin {
+		role = db.RoleAdmin
+	}
+	user, err := database.NewUser(fs.Arg(0), password, role)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s %s (ID: %d)\n", user.Role, user.Username, user.ID)
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+)
+
+func TestFindOrphansSkipsWorkDirs(t *testing.T) {
+	dir := t.TempDir()
+	documents := filepath.Join(dir, "documents")
+	pipeline := ingest.New(nil, documents)
+
+	files := []string{"scan.pdf", "stray.pdf", filepath.Join(".tmp", "upload-123"), filepath.Join(".uploads", "abc")}
+	for _, name := range files {
+		path := filepath.Join(documents, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	known, _ := filepath.Abs(filepath.Join(documents, "scan.pdf"))
+
+	orphans, err := findOrphans([]string{documents, filepath.Join(dir, "trash")}, pipeline.WorkDirs(), map[string]bool{known: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(documents, "stray.pdf")}; !reflect.DeepEqual(orphans, want) {
+		t.Errorf("expected orphans %v, got %v", want, orphans)
+	}
+}
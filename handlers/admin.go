@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/Ardelean-Calin/cellulose/internal/backup"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// SetBackupManager enables the on-demand backup endpoint
+func (app *App) SetBackupManager(m *backup.Manager) {
+	app.backups = m
+}
+
+// CreateBackup writes a database and document snapshot right away
+func (app *App) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	if app.backups == nil {
+		problem.Error(w, "Backups are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	snap, err := app.backups.Backup()
+	if err != nil {
+		log.Printf("Backup failed: %v\n", err)
+		problem.Error(w, "Failed to create backup", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Backup written to %s\n", snap.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snap)
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetAuditEvents lists audit events, newest first. The query parameters
+// entity, entity_id, actor, action, since, until, before and limit narrow
+// down the result.
+func (app *App) GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		problem.FromError(w, err, "Invalid filter")
+		return
+	}
+	filter.Entity = r.URL.Query().Get("entity")
+
+	events, err := app.db.GetAuditEvents(filter)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get audit events")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// GetDocumentHistory lists the audit events of a document, newest first
+func (app *App) GetDocumentHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		problem.FromError(w, err, "Invalid filter")
+		return
+	}
+
+	events, err := app.db.GetDocumentHistory(r.Context(), id, filter)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get document history")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// parseAuditFilter reads the audit filters shared by both endpoints
+func parseAuditFilter(q url.Values) (database.AuditFilter, error) {
+	filter := database.AuditFilter{Action: q.Get("action")}
+
+	ints := map[string]*int{
+		"entity_id": &filter.EntityID,
+		"actor":     &filter.ActorID,
+		"before":    &filter.BeforeID,
+		"limit":     &filter.Limit,
+	}
+	for name, dst := range ints {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return filter, &database.Error{Kind: database.ErrValidation, Field: name, Message: "Invalid " + name}
+			}
+			*dst = n
+		}
+	}
+
+	times := map[string]*time.Time{
+		"since": &filter.Since,
+		"until": &filter.Until,
+	}
+	for name, dst := range times {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, &database.Error{Kind: database.ErrValidation, Field: name, Message: "Invalid " + name + ", expected an RFC 3339 timestamp"}
+			}
+			*dst = t
+		}
+	}
+	return filter, nil
+}
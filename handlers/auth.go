@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+	"github.com/Ardelean-Calin/cellulose/middleware"
+)
+
+// minPasswordLength is the shortest password accepted for new accounts
+const minPasswordLength = 8
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Login checks the credentials and starts a session. Besides JSON it
+// accepts the form of the login page.
+func (app *App) Login(w http.ResponseWriter, r *http.Request) {
+	var creds credentials
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		creds.Username, creds.Password = r.PostFormValue("username"), r.PostFormValue("password")
+	} else if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.db.Authenticate(creds.Username, creds.Password)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidCredentials) {
+			log.Printf("Failed login for user %q\n", creds.Username)
+			problem.Write(w, problem.Details{
+				Status: http.StatusUnauthorized,
+				Detail: "Invalid username or password",
+				Code:   "invalid_credentials",
+			})
+		} else {
+			problem.FromError(w, err, "Failed to log in")
+		}
+		return
+	}
+
+	app.startSession(w, r, user)
+}
+
+// Logout ends the current session
+func (app *App) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(middleware.SessionCookie); err == nil {
+		if err := app.db.RemoveSession(cookie.Value); err != nil {
+			problem.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	if isHTMX(r) {
+		w.Header().Set("HX-Redirect", middleware.LoginPage)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCurrentUser returns the user of the current session
+func (app *App) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := database.UserFromContext(r.Context())
+	if !ok {
+		problem.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// GetSetupStatus tells the client whether the initial admin account still
+// has to be created and whether single sign-on is available
+func (app *App) GetSetupStatus(w http.ResponseWriter, r *http.Request) {
+	n, err := app.db.CountUsers()
+	if err != nil {
+		problem.FromError(w, err, "Failed to count users")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"setup_required": n == 0, "oidc": app.oidc != nil})
+}
+
+// Setup creates the initial admin account on a fresh instance and logs it in
+func (app *App) Setup(w http.ResponseWriter, r *http.Request) {
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if creds.Username == "" || len(creds.Password) < minPasswordLength {
+		problem.Error(w, "Username and a password of at least 8 characters are required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.db.BootstrapAdmin(creds.Username, creds.Password)
+	if err != nil {
+		problem.FromError(w, err, "Failed to create admin account")
+		return
+	}
+
+	log.Printf("Created initial admin account %q\n", user.Username)
+	app.startSession(w, r, user)
+}
+
+// GetUsers lists all accounts
+func (app *App) GetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.db.GetUsers()
+	if err != nil {
+		problem.FromError(w, err, "Failed to get users")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// CreateUser adds an account
+func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var userData struct {
+		credentials
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if userData.Role == "" {
+		userData.Role = database.RoleUser
+	}
+	if userData.Username == "" || len(userData.Password) < minPasswordLength {
+		problem.Error(w, "Username and a password of at least 8 characters are required", http.StatusBadRequest)
+		return
+	}
+	if userData.Role != database.RoleUser && userData.Role != database.RoleAdmin {
+		problem.Invalid(w, "role", "Role must be user or admin")
+		return
+	}
+
+	user, err := app.db.NewUser(userData.Username, userData.Password, userData.Role)
+	if err != nil {
+		problem.FromError(w, err, "Failed to create user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// DeleteUserByID removes an account
+func (app *App) DeleteUserByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if current, _ := database.UserFromContext(r.Context()); current.ID == id {
+		problem.Error(w, "You cannot delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RemoveUser(id); err != nil {
+		problem.FromError(w, err, "Failed to delete user")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startSession creates a session for user, sets the session cookie and
+// responds with the user
+func (app *App) startSession(w http.ResponseWriter, r *http.Request, user database.User) {
+	if !app.setSessionCookie(w, r, user) {
+		return
+	}
+
+	if isHTMX(r) {
+		w.Header().Set("HX-Redirect", "/")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// setSessionCookie creates a session for user and sets the session cookie.
+// It reports false after responding with an error.
+func (app *App) setSessionCookie(w http.ResponseWriter, r *http.Request, user database.User) bool {
+	token, expiresAt, err := app.db.NewSession(user.ID)
+	if err != nil {
+		problem.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		MaxAge:   int(time.Until(expiresAt).Seconds()),
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+// isSecure reports whether the client reached us over HTTPS, either directly
+// or through a reverse proxy
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/jobs"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// bulkExport downloads the selected documents as a zip file. Unlike the
+// other bulk actions it changes nothing and is handled here.
+const bulkExport = "export"
+
+// Outcomes of a bulk action for a document
+const (
+	bulkOK         = "ok"
+	bulkFailed     = "failed"
+	bulkRolledBack = "rolled_back" // would have succeeded, but another document failed
+)
+
+// bulkQuery selects documents like the parameters of GetDocuments
+type bulkQuery struct {
+	Search        string   `json:"search"`
+	Tags          []int    `json:"tags"`
+	Correspondent *int     `json:"correspondent"` // 0 selects documents without one
+	DocumentType  *int     `json:"document_type"` // 0 selects documents without one
+	Fields        []string `json:"fields"`
+}
+
+type bulkResult struct {
+	DocumentID int    `json:"document_id"`
+	Status     string `json:"status"`
+	Code       string `json:"code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type bulkSummary struct {
+	Action    string       `json:"action"`
+	Applied   bool         `json:"applied"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []bulkResult `json:"results"`
+}
+
+type jobStatus struct {
+	ID         int          `json:"id"`
+	Action     string       `json:"action"`
+	Status     string       `json:"status"`
+	Total      int          `json:"total"`
+	Done       int          `json:"done"`
+	Succeeded  int          `json:"succeeded"`
+	Failed     int          `json:"failed"`
+	Results    []bulkResult `json:"results"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at"`
+}
+
+// BulkUpdateDocuments applies an action to many documents: add_tags,
+// remove_tags, set_correspondent, set_document_type, trash, reprocess or
+// export. The documents are given as a list of IDs or as a query. By
+// default all documents are changed in one transaction, so that either all
+// or none of them change. With background set the documents are changed
+// one by one in a job whose progress is polled at /api/jobs/{id}.
+func (app *App) BulkUpdateDocuments(w http.ResponseWriter, r *http.Request) {
+	var bulkData struct {
+		Action          string          `json:"action"`
+		IDs             []int           `json:"ids"`
+		Query           *bulkQuery      `json:"query"`
+		TagIDs          []int           `json:"tag_ids"`
+		CorrespondentID json.RawMessage `json:"correspondent_id"`
+		DocumentTypeID  json.RawMessage `json:"document_type_id"`
+		Background      bool            `json:"background"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&bulkData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	action := database.BulkAction{Action: bulkData.Action, TagIDs: bulkData.TagIDs}
+	for _, ref := range []struct {
+		action, field string
+		raw           json.RawMessage
+	}{
+		{database.BulkSetCorrespondent, "correspondent_id", bulkData.CorrespondentID},
+		{database.BulkSetDocumentType, "document_type_id", bulkData.DocumentTypeID},
+	} {
+		if action.Action != ref.action {
+			continue
+		}
+		id, err := optionalID(ref.raw)
+		if err != nil || id == nil {
+			problem.Invalid(w, ref.field, ref.field+" must be an ID or null")
+			return
+		}
+		action.ClassifierID = *id
+	}
+	if action.Action != bulkExport {
+		if err := app.db.ValidateBulk(action); err != nil {
+			problem.FromError(w, err, "Invalid bulk action")
+			return
+		}
+	}
+
+	ids, ok := app.bulkSelection(w, r, bulkData.IDs, bulkData.Query)
+	if !ok {
+		return
+	}
+
+	if action.Action == bulkExport {
+		if bulkData.Background {
+			problem.Invalid(w, "background", "Exports can't run in the background")
+			return
+		}
+		app.exportDocuments(w, r, ids)
+		return
+	}
+
+	if bulkData.Background {
+		job := app.jobs.Start(r.Context(), ids, action)
+		w.Header().Set("Location", "/api/jobs/"+strconv.Itoa(job.ID))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(newJobStatus(job))
+		return
+	}
+
+	results, err := app.db.ApplyBulk(r.Context(), ids, action)
+	if err != nil {
+		problem.FromError(w, err, "Failed to update documents")
+		return
+	}
+
+	summary := bulkSummary{Action: action.Action, Results: make([]bulkResult, 0, len(results))}
+	for _, res := range results {
+		if res.Err != nil {
+			log.Printf("Bulk %s failed for document %d: %v\n", action.Action, res.DocumentID, res.Err)
+		}
+		result := newBulkResult(res)
+		if result.Status == bulkOK {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+	summary.Applied = summary.Failed == 0
+	if !summary.Applied {
+		for i := range summary.Results {
+			if summary.Results[i].Status == bulkOK {
+				summary.Results[i].Status = bulkRolledBack
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// GetJobByID returns the progress of a background bulk action
+func (app *App) GetJobByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	job, ok := app.jobs.Get(id)
+	if user, _ := database.UserFromContext(r.Context()); !ok || job.UserID != user.ID {
+		problem.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newJobStatus(job))
+}
+
+// bulkSelection returns the IDs of the documents selected by ids or query,
+// only one of which may be given
+func (app *App) bulkSelection(w http.ResponseWriter, r *http.Request, ids []int, query *bulkQuery) ([]int, bool) {
+	switch {
+	case len(ids) > 0 && query != nil:
+		problem.Invalid(w, "query", "Give either ids or query, not both")
+		return nil, false
+	case len(ids) > 0:
+		return ids, true
+	case query == nil:
+		problem.Invalid(w, "ids", "ids or query is required")
+		return nil, false
+	}
+
+	q := database.DocumentQuery{
+		Search:          query.Search,
+		TagIDs:          query.Tags,
+		CorrespondentID: query.Correspondent,
+		DocumentTypeID:  query.DocumentType,
+	}
+	for _, expr := range query.Fields {
+		filter, err := database.ParseFieldFilter(expr)
+		if err != nil {
+			problem.FromError(w, err, "Invalid field filter")
+			return nil, false
+		}
+		q.Fields = append(q.Fields, filter)
+	}
+	documents, err := app.db.FindDocuments(r.Context(), q)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get documents")
+		return nil, false
+	}
+	ids = make([]int, 0, len(documents))
+	for _, doc := range documents {
+		ids = append(ids, doc.ID)
+	}
+	return ids, true
+}
+
+// exportDocuments responds with a zip file holding the files of the
+// documents and results.json, listing the outcome for every document
+func (app *App) exportDocuments(w http.ResponseWriter, r *http.Request, ids []int) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="documents.zip"`)
+
+	zw := zip.NewWriter(w)
+	summary := bulkSummary{Action: bulkExport, Applied: true, Results: make([]bulkResult, 0, len(ids))}
+	for _, id := range ids {
+		err := exportDocument(r, app.db, zw, id)
+		if err != nil {
+			log.Printf("Failed to export document %d: %v\n", id, err)
+		}
+		result := newBulkResult(database.BulkResult{DocumentID: id, Err: err})
+		if result.Status == bulkOK {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+
+	f, err := zw.Create("results.json")
+	if err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(summary)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Error writing export: %v\n", err)
+	}
+}
+
+// exportDocument adds the file of a document to zw
+func exportDocument(r *http.Request, db *database.DB, zw *zip.Writer, id int) error {
+	doc, err := db.GetDocumentByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(doc.Opts.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open document: %w", err)
+	}
+	defer f.Close()
+
+	dst, err := zw.Create(fmt.Sprintf("%d-%s", doc.ID, filepath.Base(doc.Opts.Path)))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+func newBulkResult(res database.BulkResult) bulkResult {
+	if res.Err == nil {
+		return bulkResult{DocumentID: res.DocumentID, Status: bulkOK}
+	}
+	result := bulkResult{DocumentID: res.DocumentID, Status: bulkFailed, Code: problem.Code(res.Err), Error: res.Err.Error()}
+	if result.Code == problem.CodeInternal {
+		// Don't leak internals, like paths, to clients
+		result.Error = "internal error"
+	}
+	return result
+}
+
+func newJobStatus(job jobs.Job) jobStatus {
+	status := jobStatus{
+		ID:         job.ID,
+		Action:     job.Action,
+		Status:     job.Status,
+		Total:      job.Total,
+		Done:       len(job.Results),
+		Results:    make([]bulkResult, 0, len(job.Results)),
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: job.FinishedAt,
+	}
+	for _, res := range job.Results {
+		result := newBulkResult(res)
+		if result.Status == bulkOK {
+			status.Succeeded++
+		} else {
+			status.Failed++
+		}
+		status.Results = append(status.Results, result)
+	}
+	return status
+}
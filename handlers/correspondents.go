@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// classifierData is the request body for correspondents and document types
+type classifierData struct {
+	Name  string `json:"name"`
+	Match struct {
+		Algorithm     string `json:"algorithm"`
+		Pattern       string `json:"pattern"`
+		CaseSensitive bool   `json:"case_sensitive"`
+	} `json:"match"`
+}
+
+func decodeClassifier(w http.ResponseWriter, r *http.Request) (string, database.MatchRule, bool) {
+	var data classifierData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return "", database.MatchRule{}, false
+	}
+	if strings.TrimSpace(data.Name) == "" {
+		problem.Invalid(w, "name", "Name is required")
+		return "", database.MatchRule{}, false
+	}
+	return data.Name, database.MatchRule{
+		Algorithm:     data.Match.Algorithm,
+		Pattern:       data.Match.Pattern,
+		CaseSensitive: data.Match.CaseSensitive,
+	}, true
+}
+
+// GetCorrespondents lists all correspondents
+func (app *App) GetCorrespondents(w http.ResponseWriter, r *http.Request) {
+	correspondents, err := app.db.GetCorrespondents()
+	if err != nil {
+		problem.FromError(w, err, "Failed to get correspondents")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(correspondents)
+}
+
+// CreateCorrespondent adds a correspondent with an optional match rule
+func (app *App) CreateCorrespondent(w http.ResponseWriter, r *http.Request) {
+	name, rule, ok := decodeClassifier(w, r)
+	if !ok {
+		return
+	}
+	c, err := app.db.NewCorrespondent(r.Context(), name, rule)
+	if err != nil {
+		problem.FromError(w, err, "Failed to create correspondent")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// GetCorrespondentByID returns a correspondent
+func (app *App) GetCorrespondentByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	c, err := app.db.GetCorrespondentByID(id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get correspondent")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// UpdateCorrespondentByID renames a correspondent and replaces its match rule
+func (app *App) UpdateCorrespondentByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	name, rule, ok := decodeClassifier(w, r)
+	if !ok {
+		return
+	}
+	c, err := app.db.UpdateCorrespondent(r.Context(), id, name, rule)
+	if err != nil {
+		problem.FromError(w, err, "Failed to update correspondent")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// DeleteCorrespondentByID removes a correspondent from the library. Its
+// documents are kept.
+func (app *App) DeleteCorrespondentByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := app.db.RemoveCorrespondent(r.Context(), id); err != nil {
+		problem.FromError(w, err, "Failed to delete correspondent")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDocumentTypes lists all document types
+func (app *App) GetDocumentTypes(w http.ResponseWriter, r *http.Request) {
+	types, err := app.db.GetDocumentTypes()
+	if err != nil {
+		problem.FromError(w, err, "Failed to get document types")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types)
+}
+
+// CreateDocumentType adds a document type with an optional match rule
+func (app *App) CreateDocumentType(w http.ResponseWriter, r *http.Request) {
+	name, rule, ok := decodeClassifier(w, r)
+	if !ok {
+		return
+	}
+	t, err := app.db.NewDocumentType(r.Context(), name, rule)
+	if err != nil {
+		problem.FromError(w, err, "Failed to create document type")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// GetDocumentTypeByID returns a document type
+func (app *App) GetDocumentTypeByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	t, err := app.db.GetDocumentTypeByID(id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get document type")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// UpdateDocumentTypeByID renames a document type and replaces its match rule
+func (app *App) UpdateDocumentTypeByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	name, rule, ok := decodeClassifier(w, r)
+	if !ok {
+		return
+	}
+	t, err := app.db.UpdateDocumentType(r.Context(), id, name, rule)
+	if err != nil {
+		problem.FromError(w, err, "Failed to update document type")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// DeleteDocumentTypeByID removes a document type from the library. Its
+// documents are kept.
+func (app *App) DeleteDocumentTypeByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := app.db.RemoveDocumentType(r.Context(), id); err != nil {
+		problem.FromError(w, err, "Failed to delete document type")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
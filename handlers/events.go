@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/events"
+	"github.com/Ardelean-Calin/cellulose/internal/jobs"
+)
+
+// heartbeatInterval is how often an idle event stream sends a comment, so
+// that proxies don't close the connection
+const heartbeatInterval = 15 * time.Second
+
+// eventReset tells a resuming client that events were lost and it has to
+// reload everything
+const eventReset = "reset"
+
+// GetEvents streams changes as Server-Sent Events. Each event is named
+// after what changed, like "document.create", "tag.create" or "job.done",
+// and carries the audit event or job status as data. Users only receive
+// events about documents they may see and about their own jobs. Clients
+// that reconnect with a Last-Event-ID header get the events they missed.
+func (app *App) GetEvents(w http.ResponseWriter, r *http.Request) {
+	user, _ := database.UserFromContext(r.Context())
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub, missed, complete := app.db.Events().Subscribe(lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	send := func(e events.Event) error {
+		if !app.eventVisible(r, user, e) {
+			return nil
+		}
+		data := e.Data
+		if job, ok := data.(jobs.Job); ok {
+			data = newJobStatus(job)
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if !complete {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", eventReset)
+	}
+	for _, e := range missed {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				// Fell behind, the client reconnects and resumes
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// eventVisible reports whether user may receive e
+func (app *App) eventVisible(r *http.Request, user database.User, e events.Event) bool {
+	if e.UserID != 0 && e.UserID != user.ID {
+		return false
+	}
+	if e.DocumentID != 0 {
+		return app.db.CheckAccess(r.Context(), e.DocumentID, database.PermView) == nil
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetCustomFields lists the custom field definitions
+func (app *App) GetCustomFields(w http.ResponseWriter, r *http.Request) {
+	fields, err := app.db.GetCustomFields()
+	if err != nil {
+		problem.FromError(w, err, "Failed to get fields")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields)
+}
+
+// CreateCustomField defines a custom field documents can have a value for
+func (app *App) CreateCustomField(w http.ResponseWriter, r *http.Request) {
+	var fieldData struct {
+		Name     string   `json:"name"`
+		Type     string   `json:"type"`
+		Currency string   `json:"currency"`
+		Options  []string `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&fieldData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if fieldData.Name == "" || fieldData.Type == "" {
+		problem.Error(w, "Name and type are required", http.StatusBadRequest)
+		return
+	}
+
+	field, err := app.db.NewCustomField(r.Context(), database.CustomField{
+		Name:     fieldData.Name,
+		Type:     fieldData.Type,
+		Currency: fieldData.Currency,
+		Options:  fieldData.Options,
+	})
+	if err != nil {
+		problem.FromError(w, err, "Failed to create field")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(field)
+}
+
+// GetCustomFieldByID returns a custom field definition
+func (app *App) GetCustomFieldByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	field, err := app.db.GetCustomFieldByID(id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get field")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(field)
+}
+
+// DeleteCustomFieldByID removes a custom field and its values. Only admins
+// may do this, as it drops data from every document.
+func (app *App) DeleteCustomFieldByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RemoveCustomField(r.Context(), id); err != nil {
+		problem.FromError(w, err, "Failed to delete field")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
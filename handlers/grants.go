@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetDocumentGrants lists who besides the owner may access a document
+func (app *App) GetDocumentGrants(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	grants, err := app.db.GetGrants(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get grants")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// CreateDocumentGrant gives a user or a group view or edit access to a document
+func (app *App) CreateDocumentGrant(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var grantData struct {
+		UserID     *int   `json:"user_id"`
+		GroupID    *int   `json:"group_id"`
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&grantData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate inputs
+	if (grantData.UserID == nil) == (grantData.GroupID == nil) {
+		problem.Error(w, "Exactly one of user_id and group_id is required", http.StatusBadRequest)
+		return
+	}
+	if grantData.Permission != "view" && grantData.Permission != "edit" {
+		problem.Invalid(w, "permission", "Permission must be view or edit")
+		return
+	}
+
+	grant, err := app.db.SetGrant(r.Context(), id, grantData.UserID, grantData.GroupID, grantData.Permission)
+	if err != nil {
+		problem.FromError(w, err, "Failed to create grant")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(grant)
+}
+
+// DeleteDocumentGrant revokes a grant of a document
+func (app *App) DeleteDocumentGrant(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	grantID, err := strconv.Atoi(r.PathValue("grant"))
+	if err != nil {
+		problem.Error(w, "Invalid grant ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RemoveGrant(r.Context(), id, grantID); err != nil {
+		problem.FromError(w, err, "Failed to delete grant")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetGroups lists all groups with their members
+func (app *App) GetGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := app.db.GetGroups()
+	if err != nil {
+		problem.FromError(w, err, "Failed to get groups")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// CreateGroup adds a group
+func (app *App) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	var groupData struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&groupData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if groupData.Name == "" {
+		problem.Invalid(w, "name", "Name is required")
+		return
+	}
+
+	group, err := app.db.NewGroup(groupData.Name)
+	if err != nil {
+		problem.FromError(w, err, "Failed to create group")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// DeleteGroupByID removes a group together with its grants
+func (app *App) DeleteGroupByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RemoveGroup(id); err != nil {
+		problem.FromError(w, err, "Failed to delete group")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddGroupMember adds a user to a group
+func (app *App) AddGroupMember(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var memberData struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&memberData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.AddGroupMember(id, memberData.UserID); err != nil {
+		problem.FromError(w, err, "Failed to add group member")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveGroupMember removes a user from a group
+func (app *App) RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.PathValue("user"))
+	if err != nil {
+		problem.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RemoveGroupMember(id, userID); err != nil {
+		problem.FromError(w, err, "Failed to remove group member")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,107 +1,184 @@
 package handlers
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"io"
+	"errors"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 
-	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/backup"
 	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+	"github.com/Ardelean-Calin/cellulose/internal/jobs"
+	"github.com/Ardelean-Calin/cellulose/internal/oidc"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+	"github.com/Ardelean-Calin/cellulose/internal/webhooks"
 )
 
 type App struct {
-	db *database.DB
+	db       *database.DB
+	pipeline *ingest.Pipeline
+	backups  *backup.Manager
+	oidc     *oidc.Provider
+	jobs     *jobs.Registry
+	webhooks *webhooks.Dispatcher
 }
 
 func NewApp(db *database.DB) *App {
-	return &App{db}
+	return &App{db: db, pipeline: ingest.New(db, ingest.DefaultDir), jobs: jobs.New(db)}
 }
 
-func (a *App) UploadDocument(w http.ResponseWriter, r *http.Request) {
-	// Parse multipart form with 25MB max size
-	r.ParseMultipartForm(25 << 20)
+// uploadResult is the outcome for one file of an upload. Status is created,
+// duplicate or rejected. DuplicateOf is only set when the user may see the
+// document holding the file.
+type uploadResult struct {
+	Filename    string `json:"filename"`
+	Status      string `json:"status"`
+	DocumentID  int    `json:"document_id,omitempty"`
+	DuplicateOf int    `json:"duplicate_of,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
 
-	file, handler, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Error retrieving PDF file"+err.Error(), http.StatusBadRequest)
+// UploadDocument adds the files sent in the "file" fields of a multipart
+// form. Zip archives are unpacked and every PDF inside them is added. Each
+// file is handled on its own and the response lists what became of it.
+// Title and content only apply when a single PDF is sent. HTMX requests get
+// the list as HTML.
+func (a *App) UploadDocument(w http.ResponseWriter, r *http.Request) {
+	// Parse multipart form, keeping up to 25MB in memory
+	if err := r.ParseMultipartForm(25 << 20); err != nil {
+		problem.Error(w, "Invalid multipart form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
+	defer r.MultipartForm.RemoveAll()
 
-	// Create documents directory if it doesn't exist
-	err = os.MkdirAll("documents", 0755)
-	if err != nil {
-		http.Error(w, "Failed to create documents directory", http.StatusInternalServerError)
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		problem.Invalid(w, "file", "Error retrieving PDF file: no file was sent")
 		return
 	}
 
-	// Save file to disk and compute hash
-	filePath := filepath.Join("documents", handler.Filename)
-	dst, err := os.Create(filePath)
-	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
-		return
+	var results []uploadResult
+	add := func(res ingest.Result) {
+		results = append(results, a.uploadResult(res))
 	}
-	defer dst.Close()
+	for _, header := range headers {
+		file, err := header.Open()
+		if err != nil {
+			add(ingest.Result{Name: header.Filename, Err: err})
+			continue
+		}
 
-	hash := sha256.New()
-	writer := io.MultiWriter(dst, hash)
+		if ingest.IsZip(file) {
+			if err := a.pipeline.IngestZip(r.Context(), file, header.Size, add); err != nil {
+				add(ingest.Result{Name: header.Filename, Err: err})
+			}
+			file.Close()
+			continue
+		}
+
+		opts := ingest.Options{}
+		if len(headers) == 1 {
+			opts.Title = r.FormValue("title")
+			opts.Content = r.FormValue("content")
+		} else {
+			opts.Title = strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
+		}
+		doc, err := a.pipeline.Ingest(r.Context(), header.Filename, file, opts)
+		file.Close()
+		add(ingest.Result{Name: header.Filename, Document: doc, Err: err})
+	}
 
-	if _, err = io.Copy(writer, file); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	for _, res := range results {
+		if res.Status == "created" {
+			w.Header().Set("HX-Trigger", "{\"documentUploaded\":null}")
+			break
+		}
+	}
+	if isHTMX(r) {
+		renderFragment(w, "upload-results", results)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
 
-	hashValue := hex.EncodeToString(hash.Sum(nil))
+// uploadResult describes the outcome of ingesting a file to the client
+func (a *App) uploadResult(res ingest.Result) uploadResult {
+	out := uploadResult{Filename: res.Name}
+	switch {
+	case res.Err == nil:
+		log.Printf("Uploaded document: %s (ID: %d)\n", res.Name, res.Document.ID)
+		out.Status = "created"
+		out.DocumentID = res.Document.ID
+	case errors.Is(res.Err, ingest.ErrDuplicate) || errors.Is(res.Err, ingest.ErrInTrash):
+		out.Status = "duplicate"
+		out.DuplicateOf = res.Document.ID
+		out.Reason = res.Err.Error()
+	default:
+		out.Status = "rejected"
+		out.Reason = res.Err.Error()
+		if problem.Code(res.Err) == problem.CodeInternal {
+			// Don't leak internals to clients
+			log.Printf("Failed to upload %s: %v\n", res.Name, res.Err)
+			out.Reason = "failed to store the file"
+		}
+	}
+	return out
+}
 
-	// Check if the hash already exists
-	exists, err := a.db.DocumentExistsByHash(hashValue)
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+// GetDocuments lists documents. The optional query parameters are search,
+// correspondent and document_type (an ID or "none"), tag (repeatable, also
+// matches descendants of the tag), field (repeatable, e.g. field=amount>100)
+// and sort (e.g. sort=-due). HTMX requests get the document grid.
+func (app *App) GetDocuments(w http.ResponseWriter, r *http.Request) {
+	query := database.DocumentQuery{
+		Search: r.URL.Query().Get("search"),
+		Sort:   r.URL.Query().Get("sort"),
+	}
+	var err error
+	if query.CorrespondentID, err = queryID(r, "correspondent"); err != nil {
+		problem.Invalid(w, "correspondent", "Invalid correspondent")
 		return
 	}
-	if exists {
-		http.Error(w, "File already exists", http.StatusBadRequest)
+	if query.DocumentTypeID, err = queryID(r, "document_type"); err != nil {
+		problem.Invalid(w, "document_type", "Invalid document_type")
 		return
 	}
+	for _, tag := range r.URL.Query()["tag"] {
+		id, err := strconv.Atoi(tag)
+		if err != nil {
+			problem.Invalid(w, "tag", "Invalid tag")
+			return
+		}
+		query.TagIDs = append(query.TagIDs, id)
+	}
+	for _, expr := range r.URL.Query()["field"] {
+		filter, err := database.ParseFieldFilter(expr)
+		if err != nil {
+			problem.FromError(w, err, "Invalid field filter")
+			return
+		}
+		query.Fields = append(query.Fields, filter)
+	}
 
-	// Add document to database
-	log.Printf("Attempting to add document to database: %s (path: %s)\n", handler.Filename, filePath)
-	doc, err := a.db.NewDocument(db.DocumentOptions{
-		Title:   r.FormValue("title"),
-		Path:    filePath,
-		Content: r.FormValue("content"),
-		Hash:    hashValue,
-		Tags:    []string{}, // No tags initially
-	})
+	documents, err := app.db.FindDocuments(r.Context(), query)
 	if err != nil {
-		// Clean up file if database insert fails
-		os.Remove(filePath)
-		log.Printf("Failed to add document to database: %v\n", err)
-		http.Error(w, fmt.Sprintf("Failed to add document to database: %v", err), http.StatusInternalServerError)
+		problem.FromError(w, err, "Failed to get documents")
 		return
 	}
 
-	log.Printf("Uploaded document: %s (ID: %d)\n", handler.Filename, doc.ID)
-	w.Header().Set("HX-Trigger", "{\"documentUploaded\":null}")
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func (app *App) GetDocuments(w http.ResponseWriter, r *http.Request) {
-	searchQuery := r.URL.Query().Get("search")
-
-	documents, err := app.db.GetDocumentsByTitle(searchQuery)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if isHTMX(r) {
+		cards, err := app.documentCards(r.Context(), documents)
+		if err != nil {
+			problem.FromError(w, err, "Failed to get documents")
+			return
+		}
+		renderFragment(w, "documents", cards)
 		return
 	}
 
@@ -109,52 +186,130 @@ func (app *App) GetDocuments(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(documents)
 }
 
+// queryID parses an ID query parameter, where "none" stands for 0
+func queryID(r *http.Request, name string) (*int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	id := 0
+	if value != "none" {
+		var err error
+		if id, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	return &id, nil
+}
+
+// countedTag is a tag listed together with its number of documents
+type countedTag struct {
+	database.Tag
+	DocumentCount int `json:"document_count"`
+}
+
+type countedTagNode struct {
+	countedTag
+	Children []countedTagNode
+}
+
+func countTagTree(nodes []database.TagNode, counts map[int]int) []countedTagNode {
+	counted := make([]countedTagNode, 0, len(nodes))
+	for _, n := range nodes {
+		counted = append(counted, countedTagNode{
+			countedTag: countedTag{Tag: n.Tag, DocumentCount: counts[n.ID]},
+			Children:   countTagTree(n.Children, counts),
+		})
+	}
+	return counted
+}
+
+// GetTags lists all tags, or with tree=1 the top-level tags with their
+// children nested below them. With counts=1 every tag includes the number
+// of documents it is assigned to. HTMX requests get the tag filter menu,
+// with the tags given as tag parameters checked.
 func (app *App) GetTags(w http.ResponseWriter, r *http.Request) {
+	if isHTMX(r) {
+		var selected []int
+		for _, tag := range r.URL.Query()["tag"] {
+			if id, err := strconv.Atoi(tag); err == nil {
+				selected = append(selected, id)
+			}
+		}
+		menu, err := app.tagMenu(r.Context(), selected)
+		if err != nil {
+			problem.FromError(w, err, "Failed to get tags")
+			return
+		}
+		renderFragment(w, "tag-menu", menu)
+		return
+	}
+
 	tags, err := app.db.GetTags()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		problem.FromError(w, err, "Failed to get tags")
 		return
 	}
+	tree := r.URL.Query().Get("tree") == "1"
 
+	if r.URL.Query().Get("counts") != "1" {
+		w.Header().Set("Content-Type", "application/json")
+		if tree {
+			json.NewEncoder(w).Encode(database.BuildTagTree(tags))
+		} else {
+			json.NewEncoder(w).Encode(tags)
+		}
+		return
+	}
+
+	counts, err := app.db.GetTagCounts(r.Context())
+	if err != nil {
+		problem.FromError(w, err, "Failed to get tags")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tags)
+	if tree {
+		json.NewEncoder(w).Encode(countTagTree(database.BuildTagTree(tags), counts))
+		return
+	}
+	counted := make([]countedTag, 0, len(tags))
+	for _, tag := range tags {
+		counted = append(counted, countedTag{Tag: tag, DocumentCount: counts[tag.ID]})
+	}
+	json.NewEncoder(w).Encode(counted)
 }
 
 func (app *App) CreateTag(w http.ResponseWriter, r *http.Request) {
 	var tagData struct {
-		Name  string `json:"name"`
-		Color string `json:"color"`
+		Name     string `json:"name"`
+		Color    string `json:"color"`
+		ParentID int    `json:"parent_id"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&tagData)
 	if err != nil {
 		log.Printf("Error decoding request body: %v\n", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 	log.Printf("Received tag creation request with data: %+v\n", tagData)
 	// Validate inputs
 	if tagData.Name == "" || tagData.Color == "" {
 		log.Printf("Missing required fields: name=%s, color=%s\n", tagData.Name, tagData.Color)
-		http.Error(w, "Name and color are required", http.StatusBadRequest)
+		problem.Error(w, "Name and color are required", http.StatusBadRequest)
 		return
 	}
 
 	// Validate hex color code
 	if !regexp.MustCompile(`^#([A-Fa-f0-9]{6}|[A-Fa-f0-9]{3})$`).MatchString(tagData.Color) {
 		log.Printf("Invalid color code: %s\n", tagData.Color)
-		http.Error(w, "Invalid hex color code", http.StatusBadRequest)
+		problem.Invalid(w, "color", "Invalid hex color code")
 		return
 	}
 
-	tag, err := app.db.NewTag(tagData.Name, tagData.Color)
+	tag, err := app.db.NewChildTag(r.Context(), tagData.ParentID, tagData.Name, tagData.Color)
 	if err != nil {
-		log.Printf("Error creating tag: %v\n", err)
-		if strings.Contains(err.Error(), "already exists") {
-			http.Error(w, "Tag already exists", http.StatusUnprocessableEntity)
-		} else {
-			http.Error(w, "Failed to create tag", http.StatusInternalServerError)
-		}
+		problem.FromError(w, err, "Failed to create tag")
 		return
 	}
 
@@ -172,18 +327,14 @@ func (app *App) GetTagByID(w http.ResponseWriter, r *http.Request) {
 	idStr := r.PathValue("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
 	// Get the tag from the database
 	tag, err := app.db.GetTagByID(id)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, "Tag not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to get tag", http.StatusInternalServerError)
-		}
+		problem.FromError(w, err, "Failed to get tag")
 		return
 	}
 
@@ -192,6 +343,40 @@ func (app *App) GetTagByID(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(tag)
 }
 
+// UpdateTagByID moves a tag below another one, or to the top level when
+// parent_id is null
+func (app *App) UpdateTagByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var tagData struct {
+		ParentID json.RawMessage `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&tagData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	parentID, err := optionalID(tagData.ParentID)
+	if err != nil || parentID == nil {
+		problem.Invalid(w, "parent_id", "Invalid parent_id")
+		return
+	}
+
+	tag, err := app.db.SetTagParent(r.Context(), id, *parentID)
+	if err != nil {
+		problem.FromError(w, err, "Failed to update tag")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag)
+}
+
+// DeleteTagByID removes a tag. With children=cascade its descendants are
+// removed too, by default they move up to the parent of the removed tag.
 func (app *App) DeleteTagByID(w http.ResponseWriter, r *http.Request) {
 	log.Printf("DELETE Tag with ID: %s\n", r.PathValue("id"))
 
@@ -199,18 +384,22 @@ func (app *App) DeleteTagByID(w http.ResponseWriter, r *http.Request) {
 	idStr := r.PathValue("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
 	// Delete the tag from the database
-	err = app.db.RemoveTag(id)
+	switch r.URL.Query().Get("children") {
+	case "", "reparent":
+		err = app.db.RemoveTag(r.Context(), id)
+	case "cascade":
+		err = app.db.RemoveTagCascade(r.Context(), id)
+	default:
+		problem.Invalid(w, "children", "children must be reparent or cascade")
+		return
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, "Tag not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to delete tag", http.StatusInternalServerError)
-		}
+		problem.FromError(w, err, "Failed to delete tag")
 		return
 	}
 
@@ -225,18 +414,24 @@ func (app *App) GetDocumentByID(w http.ResponseWriter, r *http.Request) {
 	idStr := r.PathValue("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
 	// Get the document from the database
-	document, err := app.db.GetDocumentByID(id)
+	document, err := app.db.GetDocumentByID(r.Context(), id)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, "Document not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to get document", http.StatusInternalServerError)
+		problem.FromError(w, err, "Failed to get document")
+		return
+	}
+
+	if isHTMX(r) {
+		detail, err := app.documentDetail(r.Context(), document)
+		if err != nil {
+			problem.FromError(w, err, "Failed to get document")
+			return
 		}
+		renderFragment(w, "document", detail)
 		return
 	}
 
@@ -245,7 +440,63 @@ func (app *App) GetDocumentByID(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(document)
 }
 
-// Delete document by ID
+// UpdateDocumentByID changes the metadata of a document. Attributes and
+// custom fields missing from the request are left alone, null removes them.
+func (app *App) UpdateDocumentByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var documentData struct {
+		CorrespondentID json.RawMessage `json:"correspondent_id"`
+		DocumentTypeID  json.RawMessage `json:"document_type_id"`
+		Fields          map[string]any  `json:"fields"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&documentData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	update := database.DocumentUpdate{Fields: documentData.Fields}
+	if update.CorrespondentID, err = optionalID(documentData.CorrespondentID); err != nil {
+		problem.Invalid(w, "correspondent_id", "Invalid correspondent_id")
+		return
+	}
+	if update.DocumentTypeID, err = optionalID(documentData.DocumentTypeID); err != nil {
+		problem.Invalid(w, "document_type_id", "Invalid document_type_id")
+		return
+	}
+
+	document, err := app.db.UpdateDocument(r.Context(), id, update)
+	if err != nil {
+		problem.FromError(w, err, "Failed to update document")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
+
+// optionalID decodes an ID that may be missing (nil) or null (0)
+func optionalID(raw json.RawMessage) (*int, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var id *int
+	if err := json.Unmarshal(raw, &id); err != nil {
+		return nil, err
+	}
+	if id == nil {
+		id = new(int)
+	}
+	return id, nil
+}
+
+// Delete document by ID. The document is moved to the trash.
 func (app *App) DeleteDocumentByID(w http.ResponseWriter, r *http.Request) {
 	log.Printf("DELETE Document with ID: %s\n", r.PathValue("id"))
 
@@ -253,18 +504,14 @@ func (app *App) DeleteDocumentByID(w http.ResponseWriter, r *http.Request) {
 	idStr := r.PathValue("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
-	// Delete the tag from the database
-	err = app.db.RemoveDocument(id)
+	// Move the document to the trash
+	err = app.db.TrashDocument(r.Context(), id)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, "Document not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to delete document", http.StatusInternalServerError)
-		}
+		problem.FromError(w, err, "Failed to delete document")
 		return
 	}
 
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetDocumentNotes lists the notes of a document, oldest first
+func (app *App) GetDocumentNotes(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	notes, err := app.db.GetNotes(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get notes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notes)
+}
+
+// CreateDocumentNote adds a Markdown note to a document
+func (app *App) CreateDocumentNote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	body, ok := decodeNoteBody(w, r)
+	if !ok {
+		return
+	}
+
+	note, err := app.db.NewNote(r.Context(), id, body, time.Time{})
+	if err != nil {
+		problem.FromError(w, err, "Failed to create note")
+		return
+	}
+
+	w.Header().Set("HX-Trigger", "{\"noteAdded\":null}")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(note)
+}
+
+// GetDocumentNote returns a single note of a document
+func (app *App) GetDocumentNote(w http.ResponseWriter, r *http.Request) {
+	id, noteID, ok := notePath(w, r)
+	if !ok {
+		return
+	}
+
+	note, err := app.db.GetNote(r.Context(), id, noteID)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get note")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// UpdateDocumentNote replaces the body of a note written by the current user
+func (app *App) UpdateDocumentNote(w http.ResponseWriter, r *http.Request) {
+	id, noteID, ok := notePath(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := decodeNoteBody(w, r)
+	if !ok {
+		return
+	}
+
+	note, err := app.db.UpdateNote(r.Context(), id, noteID, body)
+	if err != nil {
+		problem.FromError(w, err, "Failed to update note")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// DeleteDocumentNote removes a note
+func (app *App) DeleteDocumentNote(w http.ResponseWriter, r *http.Request) {
+	id, noteID, ok := notePath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.db.RemoveNote(r.Context(), id, noteID); err != nil {
+		problem.FromError(w, err, "Failed to delete note")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeNoteBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var noteData struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&noteData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+	if strings.TrimSpace(noteData.Body) == "" {
+		problem.Invalid(w, "body", "Body is required")
+		return "", false
+	}
+	return noteData.Body, true
+}
+
+// notePath parses the document ID and note ID of the route
+func notePath(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	noteID, err := strconv.Atoi(r.PathValue("note"))
+	if err != nil {
+		problem.Error(w, "Invalid note ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return id, noteID, true
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/oidc"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// oidcCookie carries state, nonce and PKCE verifier between the login
+// redirect and the callback
+const oidcCookie = "cellulose_oidc"
+
+// SetOIDCProvider enables single sign-on through an OpenID Connect provider
+func (app *App) SetOIDCProvider(p *oidc.Provider) {
+	app.oidc = p
+}
+
+// OIDCLogin redirects the browser to the identity provider
+func (app *App) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		problem.Error(w, "Single sign-on is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomString()
+		if err != nil {
+			problem.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/api/auth/oidc/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, app.oidc.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+// OIDCCallback completes a login at the identity provider, provisions the
+// account on first login and starts a session
+func (app *App) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		problem.Error(w, "Single sign-on is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		problem.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/api/auth/oidc/", MaxAge: -1})
+
+	parts := strings.Split(cookie.Value, ".")
+	q := r.URL.Query()
+	if len(parts) != 3 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(q.Get("state"))) != 1 {
+		problem.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		log.Printf("Identity provider refused login: %s %s\n", e, q.Get("error_description"))
+		problem.Error(w, "Login was refused by the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), q.Get("code"), parts[2], parts[1])
+	if err != nil {
+		log.Printf("Failed single sign-on: %v\n", err)
+		problem.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	role := database.RoleUser
+	if app.oidc.IsAdmin(claims) {
+		role = database.RoleAdmin
+	}
+	user, err := app.db.LoginExternalUser(claims.Issuer, claims.Subject, claims.Username(), role, app.oidc.MapsRoles())
+	if err != nil {
+		if errors.Is(err, database.ErrConflict) {
+			problem.Error(w, "An account named "+claims.Username()+" already exists", http.StatusConflict)
+		} else {
+			log.Printf("Failed to provision account: %v\n", err)
+			problem.Error(w, "Failed to log in", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !app.setSessionCookie(w, r, user) {
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
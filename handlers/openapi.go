@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Ardelean-Calin/cellulose/internal/openapi"
+)
+
+// GetOpenAPISpec serves the OpenAPI description of the API, from which
+// clients can be generated
+func (app *App) GetOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapi.JSON())
+}
+
+// APIDocs shows the API reference rendered from the specification
+func (app *App) APIDocs(w http.ResponseWriter, r *http.Request) {
+	http.ServeFileFS(w, r, templateFS, "templates/api-docs.html")
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/data"
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// The templates directory holds the page layout, one file per page in
+// pages/ and the fragments shared by pages and HTMX responses in partials/
+//
+//go:embed templates
+var templateFS embed.FS
+
+// The static directory holds the scripts the pages load. Their names carry
+// the version, so that browsers can keep them for good.
+//
+//go:embed static
+var staticFS embed.FS
+
+var templateFuncs = template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("2 Jan 2006") },
+	"bytes": func(n int64) string {
+		const unit = 1024
+		if n < unit {
+			return fmt.Sprintf("%d B", n)
+		}
+		div, exp := int64(unit), 0
+		for m := n / unit; m >= unit; m /= unit {
+			div *= unit
+			exp++
+		}
+		return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+	},
+}
+
+var (
+	// fragments holds the layout and the partials
+	fragments = template.Must(template.New("").Funcs(templateFuncs).
+			ParseFS(templateFS, "templates/layout.html", "templates/partials/*.html"))
+	// pages maps page names to the fragments extended by the page
+	pages = parsePages()
+)
+
+func parsePages() map[string]*template.Template {
+	files, err := fs.Glob(templateFS, "templates/pages/*.html")
+	if err != nil {
+		panic(err)
+	}
+	parsed := make(map[string]*template.Template, len(files))
+	for _, file := range files {
+		t := template.Must(template.Must(fragments.Clone()).ParseFS(templateFS, file))
+		parsed[strings.TrimSuffix(path.Base(file), ".html")] = t
+	}
+	return parsed
+}
+
+// pageData is passed to the layout. Data is what the page itself shows.
+type pageData struct {
+	Title string
+	User  database.User
+	Data  any
+}
+
+// isHTMX reports whether the request was sent by HTMX and expects an HTML
+// fragment instead of JSON
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+// renderPage responds with a whole page
+func renderPage(w http.ResponseWriter, r *http.Request, page, title string, pageContent any) {
+	user, _ := database.UserFromContext(r.Context())
+	writeHTML(w, pages[page], "layout", pageData{Title: title, User: user, Data: pageContent})
+}
+
+// renderFragment responds with one of the partials
+func renderFragment(w http.ResponseWriter, name string, fragmentData any) {
+	writeHTML(w, fragments, name, fragmentData)
+}
+
+// writeHTML executes the template into a buffer first so that errors can
+// still be reported with a proper status
+func writeHTML(w http.ResponseWriter, t *template.Template, name string, templateData any) {
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, templateData); err != nil {
+		log.Printf("Error rendering template %s: %v\n", name, err)
+		problem.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// Static serves the scripts the pages load, so that the UI works without
+// access to the internet
+func (app *App) Static(w http.ResponseWriter, r *http.Request) {
+	name := "static/" + r.PathValue("name")
+	if _, err := fs.Stat(staticFS, name); err != nil {
+		problem.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFileFS(w, r, staticFS, name)
+}
+
+// Index shows the document grid with the tag filter menu and upload form
+func (app *App) Index(w http.ResponseWriter, r *http.Request) {
+	docs, err := app.db.FindDocuments(r.Context(), database.DocumentQuery{})
+	if err != nil {
+		problem.Error(w, "Failed to get documents", http.StatusInternalServerError)
+		return
+	}
+	cards, err := app.documentCards(r.Context(), docs)
+	if err != nil {
+		problem.Error(w, "Failed to get documents", http.StatusInternalServerError)
+		return
+	}
+	menu, err := app.tagMenu(r.Context(), nil)
+	if err != nil {
+		problem.Error(w, "Failed to get tags", http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(w, r, "index", "Documents", struct {
+		Tags      []data.TagMenuItem
+		Documents []data.Document
+	}{menu, cards})
+}
+
+// DocumentPage shows a single document
+func (app *App) DocumentPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	doc, err := app.db.GetDocumentByID(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get document")
+		return
+	}
+	detail, err := app.documentDetail(r.Context(), doc)
+	if err != nil {
+		problem.Error(w, "Failed to get document", http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(w, r, "document", detail.Title, detail)
+}
+
+// LoginPage shows the login form
+func (app *App) LoginPage(w http.ResponseWriter, r *http.Request) {
+	renderPage(w, r, "login", "Log in", nil)
+}
+
+// documentCards turns documents into the cards of the document grid
+func (app *App) documentCards(ctx context.Context, docs []database.Document) ([]data.Document, error) {
+	tags, err := app.db.GetTags()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]database.Tag, len(tags))
+	for _, tag := range tags {
+		byID[tag.ID] = tag
+	}
+	assignments, err := app.db.GetTagAssignments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	docTags := make(map[int][]data.Tag)
+	for _, a := range assignments {
+		tag := byID[a.TagID]
+		docTags[a.DocumentID] = append(docTags[a.DocumentID], data.Tag{ID: tag.ID, Name: tag.Name, Color: tag.Color})
+	}
+
+	cards := make([]data.Document, 0, len(docs))
+	for _, doc := range docs {
+		cards = append(cards, data.Document{
+			ID:        doc.ID,
+			Title:     doc.Opts.Title,
+			CreatedAt: doc.Opts.CreatedAt,
+			Tags:      docTags[doc.ID],
+		})
+	}
+	return cards, nil
+}
+
+// tagMenu builds the tag filter menu, marking the selected tag IDs
+func (app *App) tagMenu(ctx context.Context, selected []int) ([]data.TagMenuItem, error) {
+	tags, err := app.db.GetTags()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := app.db.GetTagCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	isSelected := make(map[int]bool, len(selected))
+	for _, id := range selected {
+		isSelected[id] = true
+	}
+
+	var items func(nodes []database.TagNode) []data.TagMenuItem
+	items = func(nodes []database.TagNode) []data.TagMenuItem {
+		menu := make([]data.TagMenuItem, 0, len(nodes))
+		for _, n := range nodes {
+			menu = append(menu, data.TagMenuItem{
+				Tag:       data.Tag{ID: n.ID, Name: n.Name, Color: n.Color},
+				Documents: counts[n.ID],
+				Selected:  isSelected[n.ID],
+				Children:  items(n.Children),
+			})
+		}
+		return menu
+	}
+	return items(database.BuildTagTree(tags)), nil
+}
+
+// documentDetail collects what the page of a document shows
+func (app *App) documentDetail(ctx context.Context, doc database.Document) (data.DocumentDetail, error) {
+	detail := data.DocumentDetail{
+		Document: data.Document{
+			ID:        doc.ID,
+			Title:     doc.Opts.Title,
+			CreatedAt: doc.Opts.CreatedAt,
+		},
+		Size:    doc.Size,
+		Version: doc.Version,
+	}
+
+	tags, err := app.db.GetDocumentTags(ctx, doc.ID)
+	if err != nil {
+		return detail, err
+	}
+	for _, tag := range tags {
+		detail.Tags = append(detail.Tags, data.Tag{ID: tag.ID, Name: tag.Name, Color: tag.Color})
+	}
+
+	if doc.CorrespondentID != 0 {
+		c, err := app.db.GetCorrespondentByID(doc.CorrespondentID)
+		if err != nil {
+			return detail, err
+		}
+		detail.Correspondent = c.Name
+	}
+	if doc.DocumentTypeID != 0 {
+		t, err := app.db.GetDocumentTypeByID(doc.DocumentTypeID)
+		if err != nil {
+			return detail, err
+		}
+		detail.DocumentType = t.Name
+	}
+
+	for _, f := range doc.Fields {
+		detail.Fields = append(detail.Fields, data.Field{Name: f.Name, Value: fmt.Sprint(f.Value)})
+	}
+
+	notes, err := app.db.GetNotes(ctx, doc.ID)
+	if err != nil {
+		return detail, err
+	}
+	for _, n := range notes {
+		detail.Notes = append(detail.Notes, data.Note{Author: n.Author, Body: n.Body, CreatedAt: n.CreatedAt})
+	}
+	return detail, nil
+}
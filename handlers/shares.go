@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// defaultShareDuration is how long a share lives when no expiry is given
+const defaultShareDuration = 7 * 24 * time.Hour
+
+// GetShares lists the active shares of the current user's documents, or of
+// one document when the route has an ID
+func (app *App) GetShares(w http.ResponseWriter, r *http.Request) {
+	var id int
+	if idStr := r.PathValue("id"); idStr != "" {
+		var err error
+		if id, err = strconv.Atoi(idStr); err != nil {
+			problem.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	shares, err := app.db.GetShares(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get shares")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shares)
+}
+
+// CreateShare creates a public link to a document. The token is part of the
+// response and cannot be retrieved again afterwards.
+func (app *App) CreateShare(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var shareData struct {
+		ExpiresAt    *time.Time `json:"expires_at"`
+		Password     string     `json:"password"`
+		MaxDownloads *int       `json:"max_downloads"`
+		Disposition  string     `json:"disposition"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&shareData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate inputs
+	expiresAt := time.Now().Add(defaultShareDuration)
+	if shareData.ExpiresAt != nil {
+		if shareData.ExpiresAt.Before(time.Now()) {
+			problem.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+			return
+		}
+		expiresAt = *shareData.ExpiresAt
+	}
+	if shareData.MaxDownloads != nil && *shareData.MaxDownloads < 1 {
+		problem.Error(w, "Download limit must be at least 1", http.StatusBadRequest)
+		return
+	}
+	switch shareData.Disposition {
+	case "", database.DispositionInline, database.DispositionAttachment:
+	default:
+		problem.Error(w, "Disposition must be inline or attachment", http.StatusBadRequest)
+		return
+	}
+
+	share, token, err := app.db.NewShare(r.Context(), id, database.ShareOptions{
+		ExpiresAt:    expiresAt,
+		Password:     shareData.Password,
+		MaxDownloads: shareData.MaxDownloads,
+		Disposition:  shareData.Disposition,
+	})
+	if err != nil {
+		problem.FromError(w, err, "Failed to create share")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		database.Share
+		Token string
+		URL   string
+	}{share, token, "/s/" + token})
+}
+
+// DeleteShareByID revokes a share
+func (app *App) DeleteShareByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RevokeShare(r.Context(), id); err != nil {
+		problem.FromError(w, err, "Failed to revoke share")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetShareAccesses returns the access log of a share
+func (app *App) GetShareAccesses(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	accesses, err := app.db.GetShareAccesses(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get share accesses")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accesses)
+}
+
+var sharePasswordPage = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Password required</title></head>
+<body>
+<form method="post">
+	{{if .}}<p>Wrong password</p>{{end}}
+	<label>Password <input type="password" name="password" autofocus></label>
+	<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`))
+
+// ServeShare serves the document behind a public share link. Password
+// protected shares show a form which posts the password back to the link.
+// Every request that gets the file counts as a download and is logged.
+func (app *App) ServeShare(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	share, doc, err := app.db.ResolveShare(r.PathValue("token"))
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			log.Printf("Error resolving share: %v\n", err)
+		}
+		problem.Error(w, "This link does not exist", http.StatusNotFound)
+		return
+	}
+
+	logAccess := func(outcome string) {
+		if err := app.db.LogShareAccess(share.ID, r.RemoteAddr, r.UserAgent(), outcome); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+
+	switch {
+	case share.RevokedAt != nil:
+		logAccess(database.ShareRevoked)
+		problem.Error(w, "This link has been revoked", http.StatusGone)
+		return
+	case !time.Now().Before(share.ExpiresAt):
+		logAccess(database.ShareExpired)
+		problem.Error(w, "This link has expired", http.StatusGone)
+		return
+	case share.MaxDownloads != nil && share.DownloadCount >= *share.MaxDownloads:
+		logAccess(database.ShareLimitReached)
+		problem.Error(w, "This link has reached its download limit", http.StatusGone)
+		return
+	}
+
+	if share.HasPassword {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			sharePasswordPage.Execute(w, false)
+			return
+		}
+		if !app.db.CheckSharePassword(share.ID, r.PostFormValue("password")) {
+			logAccess(database.ShareBadPassword)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			sharePasswordPage.Execute(w, true)
+			return
+		}
+	}
+
+	f, err := os.Open(doc.Opts.Path)
+	if err != nil {
+		log.Printf("Error opening shared document %d: %v\n", doc.ID, err)
+		problem.Error(w, "Failed to open document", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		problem.Error(w, "Failed to open document", http.StatusInternalServerError)
+		return
+	}
+
+	// Count the download before any header of the file is set, so that a
+	// refusal is sent as a plain problem response
+	if r.Method != http.MethodHead {
+		if err := app.db.CountShareDownload(share.ID); err != nil {
+			if !errors.Is(err, database.ErrConflict) {
+				log.Printf("Error counting share download: %v\n", err)
+				problem.Error(w, "Failed to open document", http.StatusInternalServerError)
+				return
+			}
+			logAccess(database.ShareLimitReached)
+			problem.Error(w, "This link has reached its download limit", http.StatusGone)
+			return
+		}
+		logAccess(database.ShareServed)
+	}
+
+	name := filepath.Base(doc.Opts.Path)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(share.Disposition, map[string]string{"filename": name}))
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	// Ranges are not supported, so that every request serving the file
+	// counts as a download and the limit can't be avoided by asking for
+	// parts of the file only
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Error serving shared document %d: %v\n", doc.ID, err)
+	}
+}
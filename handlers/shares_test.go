@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+func TestServeShareLimitUnderLoad(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.Open(database.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	app := NewApp(db)
+
+	data, err := os.ReadFile("../internal/pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test1.pdf")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := database.SystemContext()
+	doc, err := db.NewDocument(ctx, database.DocumentOptions{Title: "test", Path: path, Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := 3
+	_, token, err := db.NewShare(ctx, doc.ID, database.ShareOptions{
+		ExpiresAt:    time.Now().Add(time.Hour),
+		MaxDownloads: &limit,
+		Disposition:  database.DispositionAttachment,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the requests together, so that several pass the first check of
+	// the limit and are refused when counting the download
+	const requests = 50
+	responses := make([]*httptest.ResponseRecorder, requests)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			r := httptest.NewRequest("GET", "/s/"+token, nil)
+			r.SetPathValue("token", token)
+			responses[i] = httptest.NewRecorder()
+			app.ServeShare(responses[i], r)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var served int
+	for _, w := range responses {
+		switch w.Code {
+		case http.StatusOK:
+			served++
+			if w.Body.Len() != len(data) {
+				t.Errorf("expected the whole file, got %d of %d bytes", w.Body.Len(), len(data))
+			}
+		case http.StatusGone:
+			if ct := w.Header().Get("Content-Type"); ct != problem.ContentType {
+				t.Errorf("expected a problem response, got %s", ct)
+			}
+			if cd := w.Header().Get("Content-Disposition"); cd != "" {
+				t.Errorf("expected no attachment header on a refusal, got %s", cd)
+			}
+			if cl := w.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("expected the length of the problem, got %s for %d bytes", cl, w.Body.Len())
+			}
+			var p map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Errorf("expected a JSON problem, got %q", w.Body)
+			}
+		default:
+			t.Errorf("unexpected status %d: %s", w.Code, w.Body)
+		}
+	}
+	if served != limit {
+		t.Errorf("expected %d downloads, got %d", limit, served)
+	}
+
+	share, _, err := db.ResolveShare(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accesses, err := db.GetShareAccesses(ctx, share.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accesses) != requests {
+		t.Errorf("expected every request to be logged, got %d", len(accesses))
+	}
+}
+
+func TestServeShareNotFound(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.Open(database.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r := httptest.NewRequest("GET", "/s/unknown", nil)
+	r.SetPathValue("token", "unknown")
+	w := httptest.NewRecorder()
+	NewApp(db).ServeShare(w, r)
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != problem.ContentType {
+		t.Errorf("expected a not found problem, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
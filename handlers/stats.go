@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetStats returns document counts per tag, month, correspondent and type
+// together with the storage used and the uploads still in progress for the
+// current user. The numbers may be up to half a minute old.
+func (app *App) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.db.GetStats(r.Context())
+	if err != nil {
+		problem.FromError(w, err, "Failed to get stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetAPITokens lists the API tokens of the current user
+func (app *App) GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := database.UserFromContext(r.Context())
+
+	tokens, err := app.db.GetAPITokens(user.ID)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get tokens")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateAPIToken creates an API token for the current user. The secret is
+// part of the response and cannot be retrieved again afterwards.
+func (app *App) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := database.UserFromContext(r.Context())
+
+	var tokenData struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&tokenData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate inputs
+	if tokenData.Name == "" || len(tokenData.Scopes) == 0 {
+		problem.Error(w, "Name and scopes are required", http.StatusBadRequest)
+		return
+	}
+	for _, s := range tokenData.Scopes {
+		if !database.ValidScope(s) {
+			problem.Error(w, "Scopes must be read, write or admin", http.StatusBadRequest)
+			return
+		}
+		// A token can't carry more rights than the request creating it
+		if (s == database.ScopeAdmin && !user.IsAdmin()) || !database.HasScope(r.Context(), s) {
+			problem.Error(w, "You cannot grant the "+s+" scope", http.StatusForbidden)
+			return
+		}
+	}
+	if tokenData.ExpiresAt != nil {
+		if tokenData.ExpiresAt.Before(time.Now()) {
+			problem.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+			return
+		}
+		utc := tokenData.ExpiresAt.UTC()
+		tokenData.ExpiresAt = &utc
+	}
+
+	token, secret, err := app.db.NewAPIToken(user.ID, tokenData.Name, tokenData.Scopes, tokenData.ExpiresAt)
+	if err != nil {
+		log.Printf("Error creating token: %v\n", err)
+		problem.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		database.APIToken
+		Token string
+	}{token, secret})
+}
+
+// DeleteAPITokenByID revokes an API token of the current user
+func (app *App) DeleteAPITokenByID(w http.ResponseWriter, r *http.Request) {
+	user, _ := database.UserFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RemoveAPIToken(user.ID, id); err != nil {
+		problem.FromError(w, err, "Failed to revoke token")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
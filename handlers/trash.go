@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetTrash lists the documents in the trash
+func (app *App) GetTrash(w http.ResponseWriter, r *http.Request) {
+	documents, err := app.db.GetTrashedDocuments(r.Context())
+	if err != nil {
+		problem.FromError(w, err, "Failed to get trash")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(documents)
+}
+
+// RestoreDocumentByID takes a document out of the trash
+func (app *App) RestoreDocumentByID(w http.ResponseWriter, r *http.Request) {
+	log.Printf("RESTORE Document with ID: %s\n", r.PathValue("id"))
+
+	// Parse the ID from the URL
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	document, err := app.db.RestoreDocument(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to restore document")
+		return
+	}
+
+	w.Header().Set("HX-Trigger", "{\"documentUploaded\":null}")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
+
+// PurgeDocumentByID permanently deletes a document from the trash
+func (app *App) PurgeDocumentByID(w http.ResponseWriter, r *http.Request) {
+	log.Printf("PURGE Document with ID: %s\n", r.PathValue("id"))
+
+	// Parse the ID from the URL
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	err = app.db.PurgeDocument(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to delete document")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// Resumable uploads follow the tus protocol 1.0 (https://tus.io) with the
+// creation, expiration and termination extensions. A client creates an
+// upload, sends the file in as many PATCH requests as it likes and asks
+// with HEAD where to continue after a connection broke. The document is
+// created by the PATCH that completes the upload.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	// headerDocumentID names the document created by the last PATCH
+	headerDocumentID = "X-Cellulose-Document-ID"
+)
+
+// GetUploadOptions describes the supported protocol version and extensions
+func (app *App) GetUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(ingest.MaxUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload. Upload-Length gives the size of
+// the file and Upload-Metadata its filename, and optionally title and
+// content, each base64 encoded.
+func (app *App) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		problem.Invalid(w, "Upload-Length", "Upload-Length must be a number")
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		problem.Invalid(w, "Upload-Metadata", "Invalid Upload-Metadata")
+		return
+	}
+	if meta["filename"] == "" {
+		problem.Invalid(w, "Upload-Metadata", "filename is required")
+		return
+	}
+
+	upload, err := app.pipeline.CreateUpload(r.Context(), meta["filename"], length, ingest.Options{
+		Title:   meta["title"],
+		Content: meta["content"],
+	})
+	if err != nil {
+		problem.FromError(w, err, "Failed to create upload")
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// GetUploadOffset tells how much of an upload has been received
+func (app *App) GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, err := app.db.GetUpload(r.Context(), r.PathValue("id"))
+	if err != nil {
+		problem.FromError(w, err, "Failed to get upload")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WriteUpload appends the body to an upload, starting at Upload-Offset.
+// Once the upload is complete the document is created and its ID is sent
+// in X-Cellulose-Document-ID. Repeating the last PATCH with an empty body
+// retries creating the document if that failed.
+func (app *App) WriteUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/offset+octet-stream" {
+		problem.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		problem.Invalid(w, "Upload-Offset", "Upload-Offset must be a number")
+		return
+	}
+
+	upload, err := app.pipeline.WriteUpload(r.Context(), r.PathValue("id"), offset, r.Body)
+	if upload.ID != "" {
+		// Also on errors, a client resumes from here
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if err != nil {
+		problem.FromError(w, err, "Failed to write upload")
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		doc, err := app.pipeline.FinishUpload(r.Context(), upload.ID)
+		if err != nil {
+			problem.FromError(w, err, "Failed to add document to database")
+			return
+		}
+		log.Printf("Uploaded document: %s (ID: %d)\n", upload.Filename, doc.ID)
+		w.Header().Set(headerDocumentID, strconv.Itoa(doc.ID))
+		w.Header().Set("HX-Trigger", "{\"documentUploaded\":null}")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload cancels an upload and discards the data received
+func (app *App) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	if err := app.pipeline.RemoveUpload(r.Context(), r.PathValue("id")); err != nil {
+		problem.FromError(w, err, "Failed to remove upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTusVersion sets Tus-Resumable on the response and rejects requests
+// that don't speak the supported version of the protocol
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		problem.Error(w, "Tus-Resumable must be "+tusVersion, http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header, a comma separated
+// list of keys each followed by a space and a base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// GetDocumentVersions lists the earlier files of a document, newest first
+func (app *App) GetDocumentVersions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := app.db.GetVersions(r.Context(), id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get versions")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// CreateDocumentVersion uploads a new file for an existing document. The
+// previous file is kept as a version.
+func (app *App) CreateDocumentVersion(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// Parse multipart form with 25MB max size
+	if err := r.ParseMultipartForm(25 << 20); err != nil {
+		problem.Error(w, "Invalid multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		problem.Invalid(w, "file", "Error retrieving PDF file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	doc, err := app.pipeline.IngestVersion(r.Context(), id, handler.Filename, file, r.FormValue("content"))
+	if err != nil {
+		switch {
+		case errors.Is(err, ingest.ErrDuplicate):
+			problem.Error(w, "File already exists", http.StatusBadRequest)
+		case errors.Is(err, ingest.ErrInTrash):
+			problem.Error(w, "File already exists in the trash", http.StatusBadRequest)
+		default:
+			problem.FromError(w, err, "Failed to add version")
+		}
+		return
+	}
+
+	w.Header().Set("HX-Trigger", "{\"documentUploaded\":null}")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// DownloadDocumentVersion sends the file of an earlier version
+func (app *App) DownloadDocumentVersion(w http.ResponseWriter, r *http.Request) {
+	id, number, ok := versionPath(w, r)
+	if !ok {
+		return
+	}
+
+	v, err := app.db.GetVersion(r.Context(), id, number)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get version")
+		return
+	}
+
+	f, err := os.Open(v.Path)
+	if err != nil {
+		log.Printf("Error opening version %d of document %d: %v\n", number, id, err)
+		problem.Error(w, "Failed to open version", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		problem.Error(w, "Failed to open version", http.StatusInternalServerError)
+		return
+	}
+
+	name := filepath.Base(v.Path)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// RestoreDocumentVersion makes an earlier file of a document current again
+func (app *App) RestoreDocumentVersion(w http.ResponseWriter, r *http.Request) {
+	id, number, ok := versionPath(w, r)
+	if !ok {
+		return
+	}
+
+	doc, err := app.db.RestoreVersion(r.Context(), id, number)
+	if err != nil {
+		problem.FromError(w, err, "Failed to restore version")
+		return
+	}
+
+	w.Header().Set("HX-Trigger", "{\"documentUploaded\":null}")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// versionPath parses the document ID and version number of the route
+func versionPath(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	number, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		problem.Error(w, "Invalid version", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return id, number, true
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	database "github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+	"github.com/Ardelean-Calin/cellulose/internal/webhooks"
+)
+
+// SetWebhookDispatcher lets redeliveries be sent right away instead of on
+// the next poll of the dispatcher
+func (app *App) SetWebhookDispatcher(d *webhooks.Dispatcher) {
+	app.webhooks = d
+}
+
+// GetWebhooks lists all webhooks
+func (app *App) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := app.db.GetWebhooks()
+	if err != nil {
+		problem.FromError(w, err, "Failed to get webhooks")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// CreateWebhook subscribes a URL to events. The secret signing the
+// deliveries is part of the response and cannot be retrieved again
+// afterwards.
+func (app *App) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var hookData struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&hookData); err != nil {
+		problem.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	hook, secret, err := app.db.NewWebhook(r.Context(), hookData.URL, hookData.Events, hookData.Secret)
+	if err != nil {
+		problem.FromError(w, err, "Failed to create webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		database.Webhook
+		Secret string
+	}{hook, secret})
+}
+
+// DeleteWebhookByID removes a webhook together with its delivery log
+func (app *App) DeleteWebhookByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.RemoveWebhook(id); err != nil {
+		problem.FromError(w, err, "Failed to remove webhook")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries lists the latest deliveries of a webhook
+func (app *App) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	deliveries, err := app.db.GetWebhookDeliveries(id)
+	if err != nil {
+		problem.FromError(w, err, "Failed to get deliveries")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// RedeliverWebhook sends the payload of an earlier delivery again
+func (app *App) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		problem.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	deliveryID, err := strconv.Atoi(r.PathValue("delivery"))
+	if err != nil {
+		problem.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := app.db.RedeliverWebhook(id, deliveryID)
+	if err != nil {
+		problem.FromError(w, err, "Failed to redeliver")
+		return
+	}
+	if app.webhooks != nil {
+		app.webhooks.Notify()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
@@ -0,0 +1,591 @@
+// Package archive writes the library to a portable directory and restores it
+// from one. An archive consists of the original files plus a manifest.json
+// describing documents, tags, tag assignments, notes, custom fields,
+// correspondents and document types.
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+)
+
+// ManifestName is the name of the manifest file inside an archive
+const ManifestName = "manifest.json"
+
+// ManifestVersion is incremented whenever the manifest layout changes
+const ManifestVersion = 5
+
+// Manifest describes the content of an archive
+type Manifest struct {
+	Version     int                `json:"version"`
+	ExportedAt  time.Time          `json:"exported_at"`
+	Documents   []ManifestDocument `json:"documents"`
+	Tags        []ManifestTag      `json:"tags"`
+	Assignments []ManifestTagging  `json:"tag_assignments"`
+	Notes       []ManifestNote     `json:"notes"`        // since version 2
+	Fields      []ManifestField    `json:"fields"`       // since version 3
+	FieldValues []ManifestFieldSet `json:"field_values"` // since version 3
+
+	Correspondents []ManifestClassifier `json:"correspondents"` // since version 4
+	DocumentTypes  []ManifestClassifier `json:"document_types"` // since version 4
+}
+
+// ManifestDocument is a document entry of the manifest. ID is the identifier
+// the document has in the exporting instance.
+type ManifestDocument struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	File      string    `json:"file"` // path relative to the archive root
+	Hash      string    `json:"hash"` // hex encoded SHA-256 of File
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Manifest IDs of the correspondent and document type, since version 4
+	CorrespondentID int `json:"correspondent_id,omitempty"`
+	DocumentTypeID  int `json:"document_type_id,omitempty"`
+}
+
+// ManifestTag is a tag entry of the manifest
+type ManifestTag struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+
+	// Manifest ID of the parent tag, since version 5
+	ParentID int `json:"parent_id,omitempty"`
+}
+
+// ManifestTagging assigns a manifest tag to a manifest document
+type ManifestTagging struct {
+	DocumentID int `json:"document_id"`
+	TagID      int `json:"tag_id"`
+}
+
+// ManifestNote is a note on a manifest document. Author is the username of
+// the author in the exporting instance and informational only.
+type ManifestNote struct {
+	DocumentID int       `json:"document_id"`
+	Author     string    `json:"author"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ManifestClassifier is a correspondent or document type of the manifest
+type ManifestClassifier struct {
+	ID    int               `json:"id"`
+	Name  string            `json:"name"`
+	Match ManifestMatchRule `json:"match"`
+}
+
+// ManifestMatchRule is the match rule of a correspondent or document type
+type ManifestMatchRule struct {
+	Algorithm     string `json:"algorithm"`
+	Pattern       string `json:"pattern,omitempty"`
+	CaseSensitive bool   `json:"case_sensitive,omitempty"`
+}
+
+// ManifestField is a custom field definition of the manifest
+type ManifestField struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Currency string   `json:"currency,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// ManifestFieldSet is the value a manifest document has for a manifest field,
+// in the form the documents API uses
+type ManifestFieldSet struct {
+	DocumentID int `json:"document_id"`
+	FieldID    int `json:"field_id"`
+	Value      any `json:"value"`
+}
+
+// ExportResult summarizes an export run
+type ExportResult struct {
+	Written   int // files copied into the archive
+	Unchanged int // files skipped because the archive already had them
+	Removed   int // stale files deleted from the archive
+}
+
+// ImportResult summarizes an import run
+type ImportResult struct {
+	Imported    int         // documents added to the library
+	Existing    int         // documents whose hash was already in the library
+	Skipped     int         // documents whose file is stored elsewhere, see Import
+	TagsCreated int         // tags added to the library
+	TagsMerged  int         // manifest tags mapped onto existing tags of the same name
+	Notes       int         // notes added to the library
+	Fields      int         // custom fields added to the library
+	IDs         map[int]int // manifest document ID -> library document ID
+}
+
+// ReadManifest loads the manifest of the archive in dir
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	f, err := os.Open(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber() // keep large integer field values exact
+	if err := dec.Decode(&m); err != nil {
+		return m, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if m.Version > ManifestVersion {
+		return m, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	return m, nil
+}
+
+// IsArchive reports whether dir contains a manifest
+func IsArchive(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ManifestName))
+	return err == nil
+}
+
+// Export writes the library to dir. Files that an earlier export already
+// wrote with the same hash are left untouched, so repeated exports into the
+// same directory only copy what changed. Only the documents visible to the
+// user in ctx are exported.
+func Export(ctx context.Context, database *db.DB, dir string) (ExportResult, error) {
+	var res ExportResult
+
+	previous, err := ReadManifest(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return res, err
+	}
+	previousFiles := make(map[string]string) // file -> hash
+	for _, d := range previous.Documents {
+		previousFiles[d.File] = d.Hash
+	}
+
+	documents, err := database.GetDocuments(ctx)
+	if err != nil {
+		return res, err
+	}
+	tags, err := database.GetTags()
+	if err != nil {
+		return res, err
+	}
+	assignments, err := database.GetTagAssignments(ctx)
+	if err != nil {
+		return res, err
+	}
+	notes, err := database.GetAllNotes(ctx)
+	if err != nil {
+		return res, err
+	}
+	fields, err := database.GetCustomFields()
+	if err != nil {
+		return res, err
+	}
+	correspondents, err := database.GetCorrespondents()
+	if err != nil {
+		return res, err
+	}
+	documentTypes, err := database.GetDocumentTypes()
+	if err != nil {
+		return res, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0755); err != nil {
+		return res, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	m := Manifest{
+		Version:     ManifestVersion,
+		ExportedAt:  time.Now().UTC(),
+		Documents:   []ManifestDocument{},
+		Tags:        []ManifestTag{},
+		Assignments: []ManifestTagging{},
+		Notes:       []ManifestNote{},
+		Fields:      []ManifestField{},
+		FieldValues: []ManifestFieldSet{},
+
+		Correspondents: []ManifestClassifier{},
+		DocumentTypes:  []ManifestClassifier{},
+	}
+
+	current := make(map[string]bool)
+	documentFiles := make(map[int]string) // document ID -> file
+	for _, doc := range documents {
+		file := filepath.ToSlash(filepath.Join("files", fmt.Sprintf("%d-%s", doc.ID, filepath.Base(doc.Opts.Path))))
+		current[file] = true
+		documentFiles[doc.ID] = file
+
+		dst := filepath.Join(dir, filepath.FromSlash(file))
+		if hash, ok := previousFiles[file]; ok && hash == doc.Opts.Hash && fileExists(dst) {
+			res.Unchanged++
+		} else {
+			if err := copyFile(doc.Opts.Path, dst); err != nil {
+				return res, fmt.Errorf("failed to export document %d: %w", doc.ID, err)
+			}
+			res.Written++
+		}
+
+		m.Documents = append(m.Documents, ManifestDocument{
+			ID:        doc.ID,
+			Title:     doc.Opts.Title,
+			File:      file,
+			Hash:      doc.Opts.Hash,
+			Content:   doc.Opts.Content,
+			CreatedAt: doc.Opts.CreatedAt,
+
+			CorrespondentID: doc.CorrespondentID,
+			DocumentTypeID:  doc.DocumentTypeID,
+		})
+		for _, v := range doc.Fields {
+			m.FieldValues = append(m.FieldValues, ManifestFieldSet{DocumentID: doc.ID, FieldID: v.FieldID, Value: v.Value})
+		}
+	}
+
+	for _, tag := range tags {
+		m.Tags = append(m.Tags, ManifestTag{ID: tag.ID, Name: tag.Name, Color: tag.Color, ParentID: tag.ParentID})
+	}
+	for _, a := range assignments {
+		m.Assignments = append(m.Assignments, ManifestTagging{DocumentID: a.DocumentID, TagID: a.TagID})
+	}
+	for _, c := range correspondents {
+		m.Correspondents = append(m.Correspondents, ManifestClassifier{ID: c.ID, Name: c.Name, Match: ManifestMatchRule(c.Match)})
+	}
+	for _, t := range documentTypes {
+		m.DocumentTypes = append(m.DocumentTypes, ManifestClassifier{ID: t.ID, Name: t.Name, Match: ManifestMatchRule(t.Match)})
+	}
+	for _, f := range fields {
+		m.Fields = append(m.Fields, ManifestField{
+			ID:       f.ID,
+			Name:     f.Name,
+			Type:     f.Type,
+			Currency: f.Currency,
+			Options:  f.Options,
+		})
+	}
+	for _, n := range notes {
+		if !current[documentFiles[n.DocumentID]] {
+			continue // document in the trash
+		}
+		m.Notes = append(m.Notes, ManifestNote{
+			DocumentID: n.DocumentID,
+			Author:     n.Author,
+			Body:       n.Body,
+			CreatedAt:  n.CreatedAt,
+		})
+	}
+
+	// Drop files of documents that no longer exist
+	for file := range previousFiles {
+		if !current[file] {
+			if err := os.Remove(filepath.Join(dir, filepath.FromSlash(file))); err == nil {
+				res.Removed++
+			}
+		}
+	}
+
+	if err := writeManifest(dir, m); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// Import restores the archive in dir into the library. Tags are matched by
+// name, so importing into a library that already has a tag of the same name
+// reuses it, keeping its place in the tag hierarchy. Documents whose hash is
+// already known are not copied again but still receive the tags,
+// correspondent, document type, field values and notes of the manifest,
+// skipping notes they already have. Correspondents and document types are
+// matched by name like tags, and so are custom fields, which must have the
+// same type. Every file is verified against the hash recorded in the
+// manifest before it is imported. Imported documents are owned by the user
+// in ctx. Files the library stores as an earlier version, in the trash or
+// for a document the user can't see are skipped together with their
+// metadata.
+func Import(ctx context.Context, database *db.DB, pipeline *ingest.Pipeline, dir string) (ImportResult, error) {
+	res := ImportResult{IDs: make(map[int]int)}
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return res, err
+	}
+	if err := Verify(dir, m); err != nil {
+		return res, err
+	}
+
+	// Resolve tags first so that documents can reference them by name
+	tagNames := make(map[int]string) // manifest tag ID -> name
+	var created []ManifestTag
+	for _, t := range m.Tags {
+		tagNames[t.ID] = t.Name
+		if _, err := database.GetTagByName(t.Name); err == nil {
+			res.TagsMerged++
+			continue
+		}
+		if _, err := database.NewTag(ctx, t.Name, t.Color); err != nil {
+			return res, fmt.Errorf("failed to create tag %s: %w", t.Name, err)
+		}
+		created = append(created, t)
+		res.TagsCreated++
+	}
+	// Parents are set once all tags exist, as they may come after their
+	// children in the manifest
+	for _, t := range created {
+		parentName, ok := tagNames[t.ParentID]
+		if !ok {
+			continue
+		}
+		tag, err := database.GetTagByName(t.Name)
+		if err != nil {
+			return res, err
+		}
+		parent, err := database.GetTagByName(parentName)
+		if err != nil {
+			return res, err
+		}
+		if _, err := database.SetTagParent(ctx, tag.ID, parent.ID); err != nil {
+			return res, fmt.Errorf("failed to nest tag %s: %w", t.Name, err)
+		}
+	}
+
+	fieldNames := make(map[int]string) // manifest field ID -> name
+	for _, f := range m.Fields {
+		fieldNames[f.ID] = f.Name
+		if existing, err := database.GetCustomFieldByName(f.Name); err == nil {
+			if existing.Type != f.Type {
+				return res, fmt.Errorf("field %s is a %s field in the library but %s in the archive", f.Name, existing.Type, f.Type)
+			}
+			continue
+		}
+		_, err := database.NewCustomField(ctx, db.CustomField{
+			Name:     f.Name,
+			Type:     f.Type,
+			Currency: f.Currency,
+			Options:  f.Options,
+		})
+		if err != nil {
+			return res, fmt.Errorf("failed to create field %s: %w", f.Name, err)
+		}
+		res.Fields++
+	}
+
+	correspondentIDs := make(map[int]int) // manifest ID -> library ID
+	for _, c := range m.Correspondents {
+		existing, err := database.GetCorrespondentByName(c.Name)
+		if err != nil {
+			if existing, err = database.NewCorrespondent(ctx, c.Name, db.MatchRule(c.Match)); err != nil {
+				return res, fmt.Errorf("failed to create correspondent %s: %w", c.Name, err)
+			}
+		}
+		correspondentIDs[c.ID] = existing.ID
+	}
+	documentTypeIDs := make(map[int]int) // manifest ID -> library ID
+	for _, t := range m.DocumentTypes {
+		existing, err := database.GetDocumentTypeByName(t.Name)
+		if err != nil {
+			if existing, err = database.NewDocumentType(ctx, t.Name, db.MatchRule(t.Match)); err != nil {
+				return res, fmt.Errorf("failed to create document type %s: %w", t.Name, err)
+			}
+		}
+		documentTypeIDs[t.ID] = existing.ID
+	}
+
+	docTags := make(map[int][]string) // manifest document ID -> tag names
+	for _, a := range m.Assignments {
+		if name, ok := tagNames[a.TagID]; ok {
+			docTags[a.DocumentID] = append(docTags[a.DocumentID], name)
+		}
+	}
+
+	for _, d := range m.Documents {
+		src := filepath.Join(dir, filepath.FromSlash(d.File))
+		if existing, err := database.GetDocumentByHash(ctx, d.Hash); err == nil {
+			for _, name := range docTags[d.ID] {
+				tag, err := database.GetTagByName(name)
+				if err != nil {
+					return res, err
+				}
+				if err := database.AddDocumentTag(ctx, existing.ID, tag.ID); err != nil {
+					return res, err
+				}
+			}
+			res.IDs[d.ID] = existing.ID
+			res.Existing++
+			continue
+		}
+
+		f, err := os.Open(src)
+		if err != nil {
+			return res, fmt.Errorf("failed to open %s: %w", d.File, err)
+		}
+		doc, err := pipeline.Ingest(ctx, originalName(d.File), f, ingest.Options{
+			Title:     d.Title,
+			Content:   d.Content,
+			Tags:      docTags[d.ID],
+			CreatedAt: d.CreatedAt,
+		})
+		f.Close()
+		if errors.Is(err, ingest.ErrDuplicate) || errors.Is(err, ingest.ErrInTrash) {
+			// The file is an earlier version, in the trash or belongs to a
+			// document the importer can't see
+			res.Skipped++
+			continue
+		}
+		if err != nil {
+			return res, fmt.Errorf("failed to import %s: %w", d.File, err)
+		}
+		res.IDs[d.ID] = doc.ID
+		res.Imported++
+	}
+
+	docFields := make(map[int]map[string]any) // manifest document ID -> values by field name
+	for _, v := range m.FieldValues {
+		name, ok := fieldNames[v.FieldID]
+		if !ok {
+			continue
+		}
+		if docFields[v.DocumentID] == nil {
+			docFields[v.DocumentID] = make(map[string]any)
+		}
+		docFields[v.DocumentID][name] = v.Value
+	}
+	for _, d := range m.Documents {
+		id, ok := res.IDs[d.ID]
+		if !ok {
+			continue
+		}
+		update := db.DocumentUpdate{Fields: docFields[d.ID]}
+		if id, ok := correspondentIDs[d.CorrespondentID]; ok {
+			update.CorrespondentID = &id
+		}
+		if id, ok := documentTypeIDs[d.DocumentTypeID]; ok {
+			update.DocumentTypeID = &id
+		}
+		if update.Fields == nil && update.CorrespondentID == nil && update.DocumentTypeID == nil {
+			continue
+		}
+		if _, err := database.UpdateDocument(ctx, id, update); err != nil {
+			return res, fmt.Errorf("failed to import metadata of %s: %w", d.File, err)
+		}
+	}
+
+	if err := importNotes(ctx, database, m.Notes, &res); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// importNotes adds the notes of the manifest to the imported documents. Notes
+// are attributed to the user in ctx but keep their creation time, which
+// together with the body identifies notes imported by an earlier run.
+func importNotes(ctx context.Context, database *db.DB, notes []ManifestNote, res *ImportResult) error {
+	existing := make(map[int]map[string]bool) // library document ID -> known notes
+	for _, n := range notes {
+		id, ok := res.IDs[n.DocumentID]
+		if !ok {
+			continue
+		}
+		if existing[id] == nil {
+			current, err := database.GetNotes(ctx, id)
+			if err != nil {
+				return err
+			}
+			existing[id] = make(map[string]bool)
+			for _, c := range current {
+				existing[id][noteKey(c.CreatedAt, c.Body)] = true
+			}
+		}
+		key := noteKey(n.CreatedAt, n.Body)
+		if existing[id][key] {
+			continue
+		}
+		if _, err := database.NewNote(ctx, id, n.Body, n.CreatedAt); err != nil {
+			return fmt.Errorf("failed to import note of document %d: %w", n.DocumentID, err)
+		}
+		existing[id][key] = true
+		res.Notes++
+	}
+	return nil
+}
+
+func noteKey(createdAt time.Time, body string) string {
+	return createdAt.UTC().Format(time.RFC3339Nano) + "\x00" + body
+}
+
+// Verify checks every file of the archive against the hash in the manifest
+func Verify(dir string, m Manifest) error {
+	for _, d := range m.Documents {
+		hash, err := ingest.HashFile(filepath.Join(dir, filepath.FromSlash(d.File)))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", d.File, err)
+		}
+		if hash != d.Hash {
+			return fmt.Errorf("hash mismatch for %s: manifest has %s, file has %s", d.File, d.Hash, hash)
+		}
+	}
+	return nil
+}
+
+// originalName strips the "<id>-" prefix Export adds to file names
+func originalName(file string) string {
+	name := filepath.Base(filepath.FromSlash(file))
+	for i, c := range name {
+		if c == '-' {
+			return name[i+1:]
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+	}
+	return name
+}
+
+func writeManifest(dir string, m Manifest) error {
+	tmp := filepath.Join(dir, ManifestName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestName))
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,204 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+)
+
+func newLibrary(t *testing.T) (*db.DB, *ingest.Pipeline) {
+	dir := t.TempDir()
+	database, err := db.Open(db.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	return database, ingest.New(database, filepath.Join(dir, "documents"))
+}
+
+var ctx = db.SystemContext()
+
+func TestExportImport(t *testing.T) {
+	src, srcPipeline := newLibrary(t)
+	if _, err := src.NewTag(ctx, "invoice", "#ff0000"); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := srcPipeline.IngestFile(ctx, "../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srcPipeline.IngestFile(ctx, "../pdf/testdata/test2.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	tag, _ := src.GetTagByName("invoice")
+	if err := src.AddDocumentTag(ctx, doc.ID, tag.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.NewChildTag(ctx, tag.ID, "utilities", "#0000ff"); err != nil {
+		t.Fatal(err)
+	}
+	note, err := src.NewNote(ctx, doc.ID, "Paid in March", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.NewCustomField(ctx, db.CustomField{Name: "amount", Type: db.FieldMonetary, Currency: "EUR"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.SetDocumentFields(ctx, doc.ID, map[string]any{"amount": "42.10"}); err != nil {
+		t.Fatal(err)
+	}
+	acme, err := src.NewCorrespondent(ctx, "ACME", db.MatchRule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.UpdateDocument(ctx, doc.ID, db.DocumentUpdate{CorrespondentID: &acme.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	res, err := Export(ctx, src, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Written != 2 {
+		t.Errorf("expected 2 files written, got %d", res.Written)
+	}
+
+	// A second export must not copy anything again
+	res, err = Export(ctx, src, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Written != 0 || res.Unchanged != 2 {
+		t.Errorf("expected incremental export, got %+v", res)
+	}
+
+	// The destination already has a tag with the same name and one of the documents
+	dst, dstPipeline := newLibrary(t)
+	if _, err := dst.NewTag(ctx, "invoice", "#00ff00"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dstPipeline.IngestFile(ctx, "../pdf/testdata/test1.pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	imp, err := Import(ctx, dst, dstPipeline, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Imported != 1 || imp.Existing != 1 || imp.TagsMerged != 1 || imp.TagsCreated != 1 {
+		t.Errorf("unexpected import result %+v", imp)
+	}
+
+	assignments, err := dst.GetTagAssignments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assignments) != 1 || assignments[0].DocumentID != imp.IDs[doc.ID] {
+		t.Errorf("tag assignment not restored: %+v", assignments)
+	}
+
+	invoice, _ := dst.GetTagByName("invoice")
+	if child, err := dst.GetTagByName("utilities"); err != nil || child.ParentID != invoice.ID {
+		t.Errorf("tag hierarchy not restored: %+v, %v", child, err)
+	}
+
+	imported, err := dst.GetDocumentByID(ctx, imp.IDs[doc.ID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Fields) != 1 || imported.Fields[0].Value != "EUR42.10" {
+		t.Errorf("field values not restored: %+v", imported.Fields)
+	}
+	if c, err := dst.GetCorrespondentByName("ACME"); err != nil || imported.CorrespondentID != c.ID {
+		t.Errorf("correspondent not restored: %+v, %v", imported, err)
+	}
+
+	notes, err := dst.GetNotes(ctx, imp.IDs[doc.ID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Body != note.Body || !notes[0].CreatedAt.Equal(note.CreatedAt) {
+		t.Errorf("note not restored: %+v", notes)
+	}
+
+	// Importing again must not duplicate notes
+	imp, err = Import(ctx, dst, dstPipeline, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Notes != 0 {
+		t.Errorf("expected no notes on second import, got %d", imp.Notes)
+	}
+}
+
+func TestImportRejectsCorruptFile(t *testing.T) {
+	src, srcPipeline := newLibrary(t)
+	if _, err := srcPipeline.IngestFile(ctx, "../pdf/testdata/test3.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if _, err := Export(ctx, src, out); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadManifest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(out, m.Documents[0].File), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, dstPipeline := newLibrary(t)
+	if _, err := Import(ctx, dst, dstPipeline, out); err == nil {
+		t.Fatal("expected hash mismatch error")
+	}
+	if docs, _ := dst.GetDocuments(ctx); len(docs) != 0 {
+		t.Errorf("expected no documents to be imported, got %d", len(docs))
+	}
+}
+
+func TestImportSkipsEarlierVersion(t *testing.T) {
+	src, srcPipeline := newLibrary(t)
+	if _, err := srcPipeline.IngestFile(ctx, "../pdf/testdata/test1.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srcPipeline.IngestFile(ctx, "../pdf/testdata/test2.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if _, err := Export(ctx, src, out); err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination has one of the files as an earlier version
+	dst, dstPipeline := newLibrary(t)
+	doc, err := dstPipeline.IngestFile(ctx, "../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("../pdf/testdata/test3.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := dstPipeline.IngestVersion(ctx, doc.ID, "test3.pdf", f, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	imp, err := Import(ctx, dst, dstPipeline, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Imported != 1 || imp.Skipped != 1 {
+		t.Errorf("expected one document imported and one skipped, got %+v", imp)
+	}
+}
@@ -0,0 +1,342 @@
+// Package backup takes point-in-time snapshots of the library while the
+// server is running. A snapshot is a directory holding a consistent copy of
+// the database together with the documents it references, so restoring one
+// only requires copying its content back in place of cellulose.db and the
+// documents directory.
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+const (
+	prefix = "cellulose-"
+	// Snapshots are named with nanoseconds, so that a scheduled and a manual
+	// backup in the same second don't collide. Names parsed with parseFormat
+	// may leave out the fraction.
+	timeFormat  = "20060102T150405.000000000Z"
+	parseFormat = "20060102T150405Z"
+	partial     = ".partial"
+)
+
+// Config configures where snapshots are written and how many are kept
+type Config struct {
+	Dir        string        // directory receiving the snapshots
+	Interval   time.Duration // time between scheduled snapshots
+	KeepDaily  int           // number of days for which the newest snapshot is kept
+	KeepWeekly int           // number of weeks for which the newest snapshot is kept
+}
+
+// Snapshot is a completed backup
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Manager creates and prunes snapshots. Only one snapshot is written at a time.
+type Manager struct {
+	db  *db.DB
+	cfg Config
+	mu  sync.Mutex
+}
+
+// New creates a backup manager for the given database
+func New(database *db.DB, cfg Config) *Manager {
+	return &Manager{db: database, cfg: cfg}
+}
+
+// Run takes a snapshot every configured interval until ctx is cancelled. A
+// snapshot is taken right away when the newest one is older than the interval.
+func (m *Manager) Run(ctx context.Context) {
+	if m.cfg.Interval <= 0 {
+		return
+	}
+
+	snapshots, err := m.List()
+	if err != nil {
+		log.Printf("Failed to list backups: %v\n", err)
+	}
+	if len(snapshots) == 0 || time.Since(snapshots[0].CreatedAt) >= m.cfg.Interval {
+		m.scheduled()
+	}
+
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.scheduled()
+		}
+	}
+}
+
+func (m *Manager) scheduled() {
+	snap, err := m.Backup()
+	if err != nil {
+		log.Printf("Scheduled backup failed: %v\n", err)
+		return
+	}
+	log.Printf("Backup written to %s\n", snap.Path)
+}
+
+// Backup writes a new snapshot and prunes the ones no longer retained
+func (m *Manager) Backup() (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	name := prefix + now.Format(timeFormat)
+	final := filepath.Join(m.cfg.Dir, name)
+	tmp := final + partial
+
+	if err := os.MkdirAll(m.cfg.Dir, 0755); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	// Never write into the directory of another backup
+	if _, err := os.Stat(final); err == nil {
+		return Snapshot{}, fmt.Errorf("backup %s already exists", name)
+	}
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return Snapshot{}, fmt.Errorf("backup %s already exists", name)
+		}
+		return Snapshot{}, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	if err := m.write(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return Snapshot{}, err
+	}
+
+	if err := os.Rename(tmp, final); err != nil {
+		os.RemoveAll(tmp)
+		return Snapshot{}, fmt.Errorf("failed to finalize backup: %w", err)
+	}
+
+	if _, err := m.prune(); err != nil {
+		log.Printf("Failed to prune backups: %v\n", err)
+	}
+
+	return Snapshot{Name: name, Path: final, CreatedAt: now}, nil
+}
+
+// write stores the database and every document it references inside dir.
+// The backup fails when a referenced file can't be found, as the snapshot
+// would not be complete.
+func (m *Manager) write(dir string) error {
+	dbPath := filepath.Join(dir, filepath.Base(db.DefaultDatabasePath))
+	if err := m.db.BackupTo(dbPath); err != nil {
+		return err
+	}
+
+	// Read the file list from the snapshot itself, so that the files match
+	// the database content exactly. The snapshot is opened read-only without
+	// going through db.Open, which would migrate it.
+	snap, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open backup database: %w", err)
+	}
+	defer snap.Close()
+
+	rows, err := snap.Query(`SELECT id, path, original_path, deleted_at IS NOT NULL FROM documents`)
+	if err != nil {
+		return fmt.Errorf("failed to read documents of backup: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id           int
+			path         string
+			originalPath sql.NullString
+			trashed      bool
+		)
+		if err := rows.Scan(&id, &path, &originalPath, &trashed); err != nil {
+			return fmt.Errorf("failed to read documents of backup: %w", err)
+		}
+
+		// The document may have been trashed or restored since the
+		// database was copied, leaving its file at the other location
+		moved := m.db.TrashPath(id, path)
+		if trashed {
+			moved = originalPath.String
+		}
+		if err := copyFile(dir, path, moved); err != nil {
+			return fmt.Errorf("failed to back up document %d: %w", id, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read documents of backup: %w", err)
+	}
+
+	rows, err = snap.Query(`SELECT document_id, number, path FROM document_versions`)
+	if err != nil {
+		return fmt.Errorf("failed to read versions of backup: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			documentID, number int
+			path               string
+		)
+		if err := rows.Scan(&documentID, &number, &path); err != nil {
+			return fmt.Errorf("failed to read versions of backup: %w", err)
+		}
+		if err := copyFile(dir, path, ""); err != nil {
+			return fmt.Errorf("failed to back up version %d of document %d: %w", number, documentID, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read versions of backup: %w", err)
+	}
+	return nil
+}
+
+// copyFile stores the file at path inside the snapshot in dir. When it
+// doesn't exist the file is taken from moved instead, unless that's empty.
+func copyFile(dir, path, moved string) error {
+	dst := filepath.Join(dir, snapshotPath(path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	err := linkOrCopy(path, dst)
+	if errors.Is(err, os.ErrNotExist) && moved != "" {
+		err = linkOrCopy(moved, dst)
+	}
+	return err
+}
+
+// snapshotPath maps a document path to its location inside a snapshot.
+// Relative paths are kept as they are so the snapshot mirrors the working
+// directory of the server, including the trash.
+func snapshotPath(path string) string {
+	if filepath.IsAbs(path) || strings.HasPrefix(filepath.Clean(path), "..") {
+		return filepath.Join("documents", filepath.Base(path))
+	}
+	return filepath.Clean(path)
+}
+
+// linkOrCopy hard links src to dst, falling back to a copy when linking is
+// not possible. Stored documents are never modified in place, so sharing the
+// inode with the live file is safe.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// List returns the completed snapshots, newest first
+func (m *Manager) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.cfg.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var snapshots []Snapshot
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), prefix) || strings.HasSuffix(e.Name(), partial) {
+			continue
+		}
+		t, err := time.Parse(parseFormat, strings.TrimPrefix(e.Name(), prefix))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{
+			Name:      e.Name(),
+			Path:      filepath.Join(m.cfg.Dir, e.Name()),
+			CreatedAt: t,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// prune deletes the snapshots that fall outside the retention policy
+func (m *Manager) prune() ([]Snapshot, error) {
+	snapshots, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := retain(snapshots, m.cfg.KeepDaily, m.cfg.KeepWeekly)
+	var removed []Snapshot
+	for _, s := range snapshots {
+		if keep[s.Name] {
+			continue
+		}
+		if err := os.RemoveAll(s.Path); err != nil {
+			return removed, fmt.Errorf("failed to remove backup %s: %w", s.Name, err)
+		}
+		removed = append(removed, s)
+	}
+	return removed, nil
+}
+
+// retain selects the snapshots to keep: the newest snapshot of each of the
+// last daily days and of each of the last weekly ISO weeks that have one.
+// snapshots must be sorted newest first. When both limits are zero every
+// snapshot is kept.
+func retain(snapshots []Snapshot, daily, weekly int) map[string]bool {
+	keep := make(map[string]bool)
+	if daily <= 0 && weekly <= 0 {
+		for _, s := range snapshots {
+			keep[s.Name] = true
+		}
+		return keep
+	}
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for _, s := range snapshots {
+		day := s.CreatedAt.Format("2006-01-02")
+		if !days[day] && len(days) < daily {
+			days[day] = true
+			keep[s.Name] = true
+		}
+
+		year, w := s.CreatedAt.ISOWeek()
+		week := fmt.Sprintf("%d-%02d", year, w)
+		if !weeks[week] && len(weeks) < weekly {
+			weeks[week] = true
+			keep[s.Name] = true
+		}
+	}
+	return keep
+}
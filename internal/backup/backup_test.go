@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+func TestRetain(t *testing.T) {
+	// One snapshot every 12 hours over four weeks, newest first
+	start := time.Date(2025, 2, 28, 12, 0, 0, 0, time.UTC)
+	var snapshots []Snapshot
+	for i := 0; i < 56; i++ {
+		created := start.Add(-time.Duration(i) * 12 * time.Hour)
+		snapshots = append(snapshots, Snapshot{Name: fmt.Sprint(i), CreatedAt: created})
+	}
+
+	keep := retain(snapshots, 3, 2)
+
+	// Newest snapshot of the last three days: 28th 12:00, 27th 12:00, 26th 12:00
+	for _, name := range []string{"0", "2", "4"} {
+		if !keep[name] {
+			t.Errorf("expected daily snapshot %s to be kept", name)
+		}
+	}
+	// The previous ISO week ends on Sunday the 23rd
+	if !keep["10"] {
+		t.Errorf("expected weekly snapshot 10 to be kept")
+	}
+	if len(keep) != 4 {
+		t.Errorf("expected 4 snapshots to be kept, got %d: %v", len(keep), keep)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(db.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if _, err := database.NewTag(db.SystemContext(), "invoice", "#fff"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(database, Config{Dir: filepath.Join(dir, "backups"), KeepDaily: 1})
+	snap, err := m.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := db.Open(db.Config{DatabasePath: filepath.Join(snap.Path, "cellulose.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if _, err := restored.GetTagByName("invoice"); err != nil {
+		t.Errorf("snapshot is missing data: %v", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "backups"))
+	if len(entries) != 1 {
+		t.Errorf("expected exactly one snapshot, got %d", len(entries))
+	}
+}
+
+func TestBackupFindsMovedFiles(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(db.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	data, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "scan.pdf")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.NewDocument(db.SystemContext(), db.DocumentOptions{Title: "scan", Path: path, Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file went to the trash while the database was being copied
+	trashPath := database.TrashPath(doc.ID, path)
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, trashPath); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(database, Config{Dir: filepath.Join(dir, "backups")})
+	snap, err := m.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backed, err := os.ReadFile(filepath.Join(snap.Path, snapshotPath(path))); err != nil || !bytes.Equal(backed, data) {
+		t.Errorf("expected the moved file in the snapshot, got %v", err)
+	}
+
+	// A file that is gone makes the backup fail instead of leaving it out
+	if err := os.Remove(trashPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Backup(); err == nil {
+		t.Error("expected the backup to fail for a missing file")
+	}
+}
+
+func TestBackupsInSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.Open(db.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// Snapshots named to the second are listed as well
+	backups := filepath.Join(dir, "backups")
+	if err := os.MkdirAll(filepath.Join(backups, "cellulose-20250101T120000Z"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(database, Config{Dir: backups})
+	for i := 0; i < 2; i++ {
+		if _, err := m.Backup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshots, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 3 || snapshots[2].Name != "cellulose-20250101T120000Z" {
+		t.Errorf("expected both new snapshots and the old one, got %+v", snapshots)
+	}
+}
@@ -5,6 +5,7 @@ import (
 )
 
 type Document struct {
+	ID          int
 	Title       string
 	Description string
 	CreatedAt   time.Time
@@ -17,3 +18,35 @@ type Tag struct {
 	Name  string
 	Color string
 }
+
+// TagMenuItem is an entry of the tag filter menu
+type TagMenuItem struct {
+	Tag
+	Documents int  // number of documents with the tag
+	Selected  bool // whether the tag is part of the current filter
+	Children  []TagMenuItem
+}
+
+// DocumentDetail is everything shown on the page of a single document
+type DocumentDetail struct {
+	Document
+	Correspondent string
+	DocumentType  string
+	Size          int64
+	Version       int
+	Fields        []Field
+	Notes         []Note
+}
+
+// Field is the value of a custom field of a document
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Note is a note on a document
+type Note struct {
+	Author    string
+	Body      string
+	CreatedAt time.Time
+}
@@ -0,0 +1,408 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Permissions on a document. Each permission includes the ones before it.
+// Owners (and administrators) may additionally delete a document and manage
+// its grants.
+const (
+	PermView  = "view"
+	PermEdit  = "edit"
+	PermOwner = "owner"
+)
+
+// SystemUser acts on behalf of the application itself, for example in
+// command line tools and background jobs. It may access every document.
+var SystemUser = User{ID: 0, Username: "system", Role: RoleAdmin}
+
+// SystemContext returns a context that acts as SystemUser
+func SystemContext() context.Context {
+	return WithUser(context.Background(), SystemUser)
+}
+
+// Grant gives a user or every member of a group access to a document.
+// Exactly one of UserID and GroupID is set.
+type Grant struct {
+	ID         int
+	DocumentID int
+	UserID     *int
+	GroupID    *int
+	Permission string
+	CreatedAt  time.Time
+}
+
+// Group is a named set of users that can receive grants together
+type Group struct {
+	ID      int
+	Name    string
+	Members []User
+}
+
+func (db *DB) initAccess() {
+	// Documents uploaded before accounts existed have no owner; only
+	// administrators can see them until they are granted to someone.
+	db.db.Exec(`ALTER TABLE documents ADD COLUMN owner_id INTEGER REFERENCES users (id) ON DELETE SET NULL`)
+
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS groups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE
+		)
+	`)
+
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS group_members (
+			group_id INTEGER NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			PRIMARY KEY (group_id, user_id)
+		)
+	`)
+
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS document_grants (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document_id INTEGER NOT NULL REFERENCES documents (id) ON DELETE CASCADE,
+			user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+			group_id INTEGER REFERENCES groups (id) ON DELETE CASCADE,
+			permission TEXT NOT NULL, -- view or edit
+			created_at DATETIME NOT NULL,
+			CHECK ((user_id IS NULL) <> (group_id IS NULL))
+		)
+	`)
+	db.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS document_grants_user ON document_grants (document_id, user_id) WHERE user_id IS NOT NULL`)
+	db.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS document_grants_group ON document_grants (document_id, group_id) WHERE group_id IS NOT NULL`)
+}
+
+// accessFilter returns an SQL condition on the documents table that matches
+// the documents the user in ctx holds perm on, together with its arguments.
+// Administrators reach every document only with the admin scope, so an API
+// token without it is limited to what the administrator owns or was granted.
+func accessFilter(ctx context.Context, perm string) (string, []any) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return "0", nil
+	}
+	if user.IsAdmin() && HasScope(ctx, ScopeAdmin) {
+		return "1", nil
+	}
+
+	if perm == PermOwner {
+		return "documents.owner_id = ?", []any{user.ID}
+	}
+
+	permissions := `'view', 'edit'`
+	if perm == PermEdit {
+		permissions = `'edit'`
+	}
+	return `(documents.owner_id = ? OR EXISTS (
+		SELECT 1 FROM document_grants g
+		WHERE g.document_id = documents.id
+		AND g.permission IN (` + permissions + `)
+		AND (g.user_id = ? OR g.group_id IN (SELECT group_id FROM group_members WHERE user_id = ?))
+	))`, []any{user.ID, user.ID, user.ID}
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// checkAccess returns an error unless the user in ctx holds perm on the
+// document: ErrForbidden when the user can see it but lacks perm, and
+// ErrNotFound otherwise. Documents the user cannot even see are reported
+// the same way as documents that don't exist.
+func checkAccess(ctx context.Context, q querier, id int, perm string) error {
+	filter, args := accessFilter(ctx, PermView)
+	var visible bool
+	err := q.QueryRow(`
+		SELECT `+filter+` FROM documents WHERE id = ?
+	`, append(args, id)...).Scan(&visible)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundf("document with id %d not found", id)
+		}
+		return fmt.Errorf("failed to check document access: %w", err)
+	}
+	if !visible {
+		return notFoundf("document with id %d not found", id)
+	}
+	if perm == PermView {
+		return nil
+	}
+
+	filter, args = accessFilter(ctx, perm)
+	var allowed bool
+	err = q.QueryRow(`
+		SELECT `+filter+` FROM documents WHERE id = ?
+	`, append(args, id)...).Scan(&allowed)
+	if err != nil {
+		return fmt.Errorf("failed to check document access: %w", err)
+	}
+	if !allowed {
+		return forbiddenf("permission denied: %s access to document %d required", perm, id)
+	}
+	return nil
+}
+
+// CheckAccess returns an error unless the user in ctx holds perm on the
+// document, like the methods of DB do before touching it
+func (db *DB) CheckAccess(ctx context.Context, documentID int, perm string) error {
+	return checkAccess(ctx, db.db, documentID, perm)
+}
+
+// ownerID returns the value stored as owner for documents created in ctx
+func ownerID(ctx context.Context) sql.NullInt64 {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.ID == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(user.ID), Valid: true}
+}
+
+// GetGrants returns the grants of a document. Only its owner may list them.
+func (db *DB) GetGrants(ctx context.Context, documentID int) ([]Grant, error) {
+	if err := checkAccess(ctx, db.db, documentID, PermOwner); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.Query(`
+		SELECT id, document_id, user_id, group_id, permission, created_at
+		FROM document_grants WHERE document_id = ? ORDER BY id
+	`, documentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get grants: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []Grant{}
+	for rows.Next() {
+		var (
+			g               Grant
+			userID, groupID sql.NullInt64
+		)
+		if err := rows.Scan(&g.ID, &g.DocumentID, &userID, &groupID, &g.Permission, &g.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan grant row: %w", err)
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			g.UserID = &id
+		}
+		if groupID.Valid {
+			id := int(groupID.Int64)
+			g.GroupID = &id
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// SetGrant gives a user or a group a permission on a document, replacing any
+// permission they had before. Exactly one of userID and groupID must be set.
+func (db *DB) SetGrant(ctx context.Context, documentID int, userID, groupID *int, permission string) (Grant, error) {
+	if permission != PermView && permission != PermEdit {
+		return Grant{}, invalidf("permission", "invalid permission %s", permission)
+	}
+	if (userID == nil) == (groupID == nil) {
+		return Grant{}, invalidf("", "grant needs either a user or a group")
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Grant{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, documentID, PermOwner); err != nil {
+		return Grant{}, err
+	}
+
+	if userID != nil {
+		if _, err := tx.Exec(`DELETE FROM document_grants WHERE document_id = ? AND user_id = ?`, documentID, *userID); err != nil {
+			return Grant{}, fmt.Errorf("failed to replace grant: %w", err)
+		}
+	} else {
+		if _, err := tx.Exec(`DELETE FROM document_grants WHERE document_id = ? AND group_id = ?`, documentID, *groupID); err != nil {
+			return Grant{}, fmt.Errorf("failed to replace grant: %w", err)
+		}
+	}
+
+	g := Grant{DocumentID: documentID, UserID: userID, GroupID: groupID, Permission: permission, CreatedAt: time.Now().UTC()}
+	result, err := tx.Exec(`
+		INSERT INTO document_grants (document_id, user_id, group_id, permission, created_at) VALUES (?, ?, ?, ?, ?)
+	`, documentID, userID, groupID, permission, g.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			if userID != nil {
+				return Grant{}, invalidf("user_id", "user %d not found", *userID)
+			}
+			return Grant{}, invalidf("group_id", "group %d not found", *groupID)
+		}
+		return Grant{}, fmt.Errorf("failed to add grant: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Grant{}, fmt.Errorf("failed to get grant ID: %w", err)
+	}
+	g.ID = int(id)
+
+	if err := recordEvent(ctx, tx, EntityDocument, documentID, ActionGrant, Diff{"grant": {New: g}}); err != nil {
+		return Grant{}, err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return Grant{}, fmt.Errorf("failed to commit grant: %w", err)
+	}
+	return g, nil
+}
+
+// RemoveGrant revokes a grant of a document
+func (db *DB) RemoveGrant(ctx context.Context, documentID, grantID int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, documentID, PermOwner); err != nil {
+		return err
+	}
+
+	var (
+		userID, groupID sql.NullInt64
+		permission      string
+	)
+	err = tx.QueryRow(`
+		SELECT user_id, group_id, permission FROM document_grants WHERE id = ? AND document_id = ?
+	`, grantID, documentID).Scan(&userID, &groupID, &permission)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundf("grant with id %d not found", grantID)
+		}
+		return fmt.Errorf("failed to get grant: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM document_grants WHERE id = ?`, grantID); err != nil {
+		return fmt.Errorf("failed to remove grant: %w", err)
+	}
+
+	old := map[string]any{"ID": grantID, "Permission": permission}
+	if userID.Valid {
+		old["UserID"] = userID.Int64
+	}
+	if groupID.Valid {
+		old["GroupID"] = groupID.Int64
+	}
+	if err := recordEvent(ctx, tx, EntityDocument, documentID, ActionRevoke, Diff{"grant": {Old: old}}); err != nil {
+		return err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit grant removal: %w", err)
+	}
+	return nil
+}
+
+// NewGroup creates a group
+func (db *DB) NewGroup(name string) (Group, error) {
+	result, err := db.db.Exec(`INSERT INTO groups (name) VALUES (?)`, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return Group{}, conflictf("group with name %s already exists", name)
+		}
+		return Group{}, fmt.Errorf("failed to add group: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Group{}, fmt.Errorf("failed to get group ID: %w", err)
+	}
+	return Group{ID: int(id), Name: name, Members: []User{}}, nil
+}
+
+// GetGroups returns all groups with their members
+func (db *DB) GetGroups() ([]Group, error) {
+	rows, err := db.db.Query(`
+		SELECT groups.id, groups.name, users.id, users.username, users.role, users.created_at
+		FROM groups
+		LEFT JOIN group_members ON group_members.group_id = groups.id
+		LEFT JOIN users ON users.id = group_members.user_id
+		ORDER BY groups.name, users.username
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var (
+			g         Group
+			userID    sql.NullInt64
+			username  sql.NullString
+			role      sql.NullString
+			createdAt sql.NullTime
+		)
+		if err := rows.Scan(&g.ID, &g.Name, &userID, &username, &role, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan group row: %w", err)
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ID != g.ID {
+			g.Members = []User{}
+			groups = append(groups, g)
+		}
+		if userID.Valid {
+			last := &groups[len(groups)-1]
+			last.Members = append(last.Members, User{
+				ID:        int(userID.Int64),
+				Username:  username.String,
+				Role:      role.String,
+				CreatedAt: createdAt.Time,
+			})
+		}
+	}
+	return groups, rows.Err()
+}
+
+// RemoveGroup removes a group together with its memberships and grants
+func (db *DB) RemoveGroup(id int) error {
+	result, err := db.db.Exec(`DELETE FROM groups WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove group: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundf("group with id %d not found", id)
+	}
+	return nil
+}
+
+// AddGroupMember adds a user to a group
+func (db *DB) AddGroupMember(groupID, userID int) error {
+	_, err := db.db.Exec(`
+		INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)
+	`, groupID, userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			return notFoundf("user or group not found")
+		}
+		return fmt.Errorf("failed to add group member: %w", err)
+	}
+	return nil
+}
+
+// RemoveGroupMember removes a user from a group
+func (db *DB) RemoveGroupMember(groupID, userID int) error {
+	result, err := db.db.Exec(`
+		DELETE FROM group_members WHERE group_id = ? AND user_id = ?
+	`, groupID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove group member: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundf("group member not found")
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestDB(t *testing.T) *DB {
+	dir := t.TempDir()
+	database, err := Open(Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	return database
+}
+
+func newTestUser(t *testing.T, database *DB, name string) User {
+	u, err := database.NewUser(name, "password", RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestDocumentAccess(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	bob := newTestUser(t, database, "bob")
+	carol := newTestUser(t, database, "carol")
+	asAlice := WithUser(context.Background(), alice)
+	asBob := WithUser(context.Background(), bob)
+	asCarol := WithUser(context.Background(), carol)
+
+	doc, err := database.NewDocument(asAlice, DocumentOptions{
+		Title: "payslip",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if docs, _ := database.GetDocumentsByTitle(asBob, ""); len(docs) != 0 {
+		t.Errorf("bob can see alice's document")
+	}
+	if _, err := database.GetDocumentByID(asBob, doc.ID); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found for bob, got %v", err)
+	}
+	if _, err := database.SetGrant(asBob, doc.ID, &bob.ID, nil, PermEdit); err == nil {
+		t.Errorf("bob granted himself access")
+	}
+
+	// Alice shares the document with a group bob belongs to
+	group, err := database.NewGroup("family")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AddGroupMember(group.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SetGrant(asAlice, doc.ID, nil, &group.ID, PermView); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.GetDocumentByID(asBob, doc.ID); err != nil {
+		t.Errorf("bob cannot see the shared document: %v", err)
+	}
+	if _, err := database.GetDocumentByID(asCarol, doc.ID); err == nil {
+		t.Errorf("carol can see the document without a grant")
+	}
+	if err := database.UpdateDocumentCreatedAt(asBob, doc.ID, doc.Opts.CreatedAt); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected permission denied for view-only edit, got %v", err)
+	}
+	if err := database.TrashDocument(asBob, doc.ID); err == nil {
+		t.Errorf("bob could trash a document he does not own")
+	}
+
+	// An edit grant for bob himself lets him modify but not delete
+	if _, err := database.SetGrant(asAlice, doc.ID, &bob.ID, nil, PermEdit); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.UpdateDocumentCreatedAt(asBob, doc.ID, doc.Opts.CreatedAt); err != nil {
+		t.Errorf("bob cannot edit with an edit grant: %v", err)
+	}
+	if err := database.RemoveDocument(asBob, doc.ID); err == nil {
+		t.Errorf("bob could remove a document he does not own")
+	}
+
+	// Administrators see everything
+	if docs, _ := database.GetDocuments(SystemContext()); len(docs) != 1 {
+		t.Errorf("expected the system user to see 1 document, got %d", len(docs))
+	}
+}
+
+func TestAdminTokenScope(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	admin, err := database.NewUser("admin", "password", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asAlice := WithUser(context.Background(), alice)
+	asAdmin := WithUser(context.Background(), admin)
+
+	doc, err := database.NewDocument(asAlice, DocumentOptions{
+		Title: "payslip",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.GetDocumentByID(asAdmin, doc.ID); err != nil {
+		t.Errorf("expected the admin session to see every document, got %v", err)
+	}
+	if _, err := database.GetDocumentByID(WithScopes(asAdmin, []string{ScopeAdmin}), doc.ID); err != nil {
+		t.Errorf("expected an admin token to see every document, got %v", err)
+	}
+	for _, scope := range []string{ScopeRead, ScopeWrite} {
+		if _, err := database.GetDocumentByID(WithScopes(asAdmin, []string{scope}), doc.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected a %s token of an admin to be limited to their documents, got %v", scope, err)
+		}
+	}
+}
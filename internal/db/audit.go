@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Entities recorded in the audit log
+const (
+	EntityDocument = "document"
+	EntityTag      = "tag"
+	EntityField    = "field"
+
+	EntityCorrespondent = "correspondent"
+	EntityDocumentType  = "document_type"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionTrash   = "trash"
+	ActionRestore = "restore"
+	ActionTag     = "tag"
+	ActionGrant   = "grant"
+	ActionRevoke  = "revoke"
+	ActionShare   = "share"
+	ActionUnshare = "unshare"
+
+	ActionVersion        = "version"
+	ActionRestoreVersion = "restore_version"
+
+	ActionAddNote    = "add_note"
+	ActionEditNote   = "edit_note"
+	ActionDeleteNote = "delete_note"
+)
+
+// Change is the value of a field before and after a mutation. Old is nil
+// for created and New for deleted fields.
+type Change struct {
+	Old any
+	New any
+}
+
+// Diff maps field names to their changes
+type Diff map[string]Change
+
+// AuditEvent is an entry of the append-only audit log
+type AuditEvent struct {
+	ID        int
+	ActorID   *int   // nil for the system user
+	Actor     string // username at the time of the event
+	CreatedAt time.Time
+	Entity    string
+	EntityID  int
+	Action    string
+	Diff      json.RawMessage
+}
+
+// AuditFilter narrows down GetAuditEvents. Zero values don't filter.
+type AuditFilter struct {
+	Entity   string
+	EntityID int
+	ActorID  int
+	Action   string
+	Since    time.Time
+	Until    time.Time
+	BeforeID int // for paging: only events older than this one
+	Limit    int
+}
+
+// maxAuditEvents is the page size used when the filter has no limit
+const maxAuditEvents = 100
+
+func (db *DB) initAudit() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor_id INTEGER,
+			actor TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			entity TEXT NOT NULL,
+			entity_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			diff TEXT NOT NULL
+		)
+	`)
+	db.db.Exec(`CREATE INDEX IF NOT EXISTS audit_events_entity ON audit_events (entity, entity_id)`)
+
+	// The log is append-only: events outlive the rows they describe and
+	// can't be rewritten afterwards.
+	db.db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END
+	`)
+	db.db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END
+	`)
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// recordEvent appends an event to the audit log. Call it with the
+// transaction of the mutation so that both are committed together.
+func recordEvent(ctx context.Context, tx execer, entity string, entityID int, action string, diff Diff) error {
+	if diff == nil {
+		diff = Diff{}
+	}
+	b, err := json.Marshal(diff)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit diff: %w", err)
+	}
+
+	actor := SystemUser.Username
+	if user, ok := UserFromContext(ctx); ok {
+		actor = user.Username
+	}
+	_, err = tx.Exec(`
+		INSERT INTO audit_events (actor_id, actor, created_at, entity, entity_id, action, diff)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, ownerID(ctx), actor, time.Now().UTC(), entity, entityID, action, string(b))
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// documentDiff describes a document that is created (New) or deleted (Old)
+func documentDiff(doc Document, created bool) Diff {
+	fields := map[string]any{
+		"title":      doc.Opts.Title,
+		"path":       doc.Opts.Path,
+		"hash":       doc.Opts.Hash,
+		"created_at": doc.Opts.CreatedAt,
+	}
+	if doc.OwnerID != 0 {
+		fields["owner_id"] = doc.OwnerID
+	}
+	if doc.CorrespondentID != 0 {
+		fields["correspondent_id"] = doc.CorrespondentID
+	}
+	if doc.DocumentTypeID != 0 {
+		fields["document_type_id"] = doc.DocumentTypeID
+	}
+	if len(doc.Opts.Tags) > 0 {
+		fields["tags"] = doc.Opts.Tags
+	}
+
+	d := Diff{}
+	for k, v := range fields {
+		if created {
+			d[k] = Change{New: v}
+		} else {
+			d[k] = Change{Old: v}
+		}
+	}
+	return d
+}
+
+// GetAuditEvents returns audit events matching the filter, newest first
+func (db *DB) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	var (
+		conds []string
+		args  []any
+	)
+	if filter.Entity != "" {
+		conds = append(conds, "entity = ?")
+		args = append(args, filter.Entity)
+	}
+	if filter.EntityID != 0 {
+		conds = append(conds, "entity_id = ?")
+		args = append(args, filter.EntityID)
+	}
+	if filter.ActorID != 0 {
+		conds = append(conds, "actor_id = ?")
+		args = append(args, filter.ActorID)
+	}
+	if filter.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	if filter.BeforeID != 0 {
+		conds = append(conds, "id < ?")
+		args = append(args, filter.BeforeID)
+	}
+	if filter.Limit <= 0 || filter.Limit > maxAuditEvents {
+		filter.Limit = maxAuditEvents
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM audit_events`
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, " AND ")
+	}
+	rows, err := db.db.Query(query+` ORDER BY id DESC LIMIT ?`, append(args, filter.Limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit events: %w", err)
+	}
+	defer rows.Close()
+	return scanAuditEvents(rows)
+}
+
+const auditColumns = `id, actor_id, actor, created_at, entity, entity_id, action, diff`
+
+func scanAuditEvents(rows *sql.Rows) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	for rows.Next() {
+		var (
+			e       AuditEvent
+			actorID sql.NullInt64
+			diff    string
+		)
+		if err := rows.Scan(&e.ID, &actorID, &e.Actor, &e.CreatedAt, &e.Entity, &e.EntityID, &e.Action, &diff); err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			e.ActorID = &id
+		}
+		e.Diff = json.RawMessage(diff)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// GetDocumentHistory returns the audit events of a document the user in ctx
+// may see, newest first
+func (db *DB) GetDocumentHistory(ctx context.Context, id int, filter AuditFilter) ([]AuditEvent, error) {
+	if err := checkAccess(ctx, db.db, id, PermView); err != nil {
+		return nil, err
+	}
+	filter.Entity = EntityDocument
+	filter.EntityID = id
+	return db.GetAuditEvents(filter)
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	asAlice := WithUser(context.Background(), alice)
+
+	tag, err := database.NewTag(asAlice, "invoice", "#fff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.NewDocument(asAlice, DocumentOptions{
+		Title: "payslip",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AddDocumentTag(asAlice, doc.ID, tag.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Assigning the same tag again changes nothing and is not recorded
+	if err := database.AddDocumentTag(asAlice, doc.ID, tag.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.RemoveTag(SystemContext(), tag.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := database.GetDocumentHistory(asAlice, doc.ID, AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Action != ActionTag || history[1].Action != ActionCreate {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if history[1].Actor != "alice" || history[1].ActorID == nil || *history[1].ActorID != alice.ID {
+		t.Errorf("wrong actor on %+v", history[1])
+	}
+	var diff map[string]Change
+	if err := json.Unmarshal(history[1].Diff, &diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff["title"].New != "payslip" || diff["title"].Old != nil {
+		t.Errorf("unexpected diff %s", history[1].Diff)
+	}
+
+	events, err := database.GetAuditEvents(AuditFilter{Entity: EntityTag, Action: ActionDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].EntityID != tag.ID || events[0].Actor != "system" || events[0].ActorID != nil {
+		t.Errorf("unexpected tag events %+v", events)
+	}
+
+	// Other users can't read the history of documents they can't see
+	bob := newTestUser(t, database, "bob")
+	if _, err := database.GetDocumentHistory(WithUser(context.Background(), bob), doc.ID, AuditFilter{}); err == nil {
+		t.Errorf("bob read the history of alice's document")
+	}
+
+	// The log is append-only
+	if _, err := database.db.Exec(`DELETE FROM audit_events`); err == nil {
+		t.Errorf("audit events could be deleted")
+	}
+}
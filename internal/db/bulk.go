@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Ardelean-Calin/cellulose/internal/pdf"
+)
+
+// Bulk actions
+const (
+	BulkAddTags          = "add_tags"
+	BulkRemoveTags       = "remove_tags"
+	BulkSetCorrespondent = "set_correspondent"
+	BulkSetDocumentType  = "set_document_type"
+	BulkTrash            = "trash"
+	BulkReprocess        = "reprocess"
+)
+
+// BulkAction is a change made to many documents at once
+type BulkAction struct {
+	Action string
+	TagIDs []int // tags to add or remove
+	// Correspondent or document type to set, 0 removes it
+	ClassifierID int
+}
+
+// BulkResult is the outcome of a bulk action for one document
+type BulkResult struct {
+	DocumentID int
+	Err        error // nil when the document was changed
+}
+
+// ValidateBulk checks that action is known and refers to existing tags,
+// correspondents and document types
+func (db *DB) ValidateBulk(action BulkAction) error {
+	switch action.Action {
+	case BulkAddTags, BulkRemoveTags:
+		if len(action.TagIDs) == 0 {
+			return invalidf("tag_ids", "tag_ids is required")
+		}
+		for _, id := range action.TagIDs {
+			if _, err := getTag(db.db, id); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					return invalidf("tag_ids", "unknown tag %d", id)
+				}
+				return err
+			}
+		}
+	case BulkSetCorrespondent, BulkSetDocumentType:
+		c := correspondents
+		if action.Action == BulkSetDocumentType {
+			c = documentTypes
+		}
+		if action.ClassifierID != 0 {
+			if _, err := c.get(db.db, action.ClassifierID); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					return invalidf(c.column, "unknown %s %d", c.noun, action.ClassifierID)
+				}
+				return err
+			}
+		}
+	case BulkTrash, BulkReprocess:
+	default:
+		return invalidf("action", "unknown action %q", action.Action)
+	}
+	return nil
+}
+
+// ApplyBulk applies action to the documents in a single transaction. Every
+// document gets a result. If any of them fails the transaction is rolled
+// back, so either all documents are changed or none.
+func (db *DB) ApplyBulk(ctx context.Context, ids []int, action BulkAction) ([]BulkResult, error) {
+	if err := db.ValidateBulk(action); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Files moved to the trash have to be moved back on rollback
+	var undos []func()
+	undo := func() {
+		for _, u := range undos {
+			u()
+		}
+	}
+
+	results := make([]BulkResult, len(ids))
+	failed := false
+	for i, id := range ids {
+		results[i].DocumentID = id
+		if action.Action == BulkTrash {
+			u, err := db.trashDocument(ctx, tx, id)
+			if err == nil {
+				undos = append(undos, u)
+			}
+			results[i].Err = err
+		} else {
+			results[i].Err = applyBulk(ctx, tx, id, action)
+		}
+		failed = failed || results[i].Err != nil
+	}
+
+	if failed {
+		undo()
+		return results, nil
+	}
+	if err := db.commit(tx); err != nil {
+		undo()
+		return nil, fmt.Errorf("failed to commit bulk %s: %w", action.Action, err)
+	}
+	return results, nil
+}
+
+// applyBulk applies action to one document, except for BulkTrash
+func applyBulk(ctx context.Context, tx *sql.Tx, id int, action BulkAction) error {
+	if err := checkAccess(ctx, tx, id, PermView); err != nil {
+		return err
+	}
+	var deleted bool
+	if err := tx.QueryRow(`SELECT deleted_at IS NOT NULL FROM documents WHERE id = ?`, id).Scan(&deleted); err != nil {
+		return fmt.Errorf("failed to get document: %w", err)
+	}
+	if deleted {
+		return conflictf("document %d is in the trash", id)
+	}
+
+	switch action.Action {
+	case BulkAddTags:
+		for _, tagID := range action.TagIDs {
+			if err := addDocumentTag(ctx, tx, id, tagID); err != nil {
+				return err
+			}
+		}
+	case BulkRemoveTags:
+		for _, tagID := range action.TagIDs {
+			if err := removeDocumentTag(ctx, tx, id, tagID); err != nil {
+				return err
+			}
+		}
+	case BulkSetCorrespondent:
+		return updateDocument(ctx, tx, id, DocumentUpdate{CorrespondentID: &action.ClassifierID})
+	case BulkSetDocumentType:
+		return updateDocument(ctx, tx, id, DocumentUpdate{DocumentTypeID: &action.ClassifierID})
+	case BulkReprocess:
+		return reprocessDocument(ctx, tx, id)
+	}
+	return nil
+}
+
+func removeDocumentTag(ctx context.Context, tx *sql.Tx, documentID, tagID int) error {
+	if err := checkAccess(ctx, tx, documentID, PermEdit); err != nil {
+		return err
+	}
+
+	var name string
+	if err := tx.QueryRow(`SELECT name FROM tags WHERE id = ?`, tagID).Scan(&name); err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundf("tag with id %d not found", tagID)
+		}
+		return fmt.Errorf("failed to get tag: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		DELETE FROM document_tags WHERE document_id = ? AND tag_id = ?
+	`, documentID, tagID)
+	if err != nil {
+		return fmt.Errorf("failed to remove tag: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	return recordEvent(ctx, tx, EntityDocument, documentID, ActionTag, Diff{"tags": {Old: name}})
+}
+
+// reprocessDocument reads the creation date and size of the file again and
+// lets the match rules pick a correspondent and type where none is assigned
+func reprocessDocument(ctx context.Context, tx *sql.Tx, id int) error {
+	if err := checkAccess(ctx, tx, id, PermEdit); err != nil {
+		return err
+	}
+	doc, err := scanDocument(tx.QueryRow(`SELECT `+documentColumns+` FROM documents WHERE id = ?`, id))
+	if err != nil {
+		return fmt.Errorf("failed to get document: %w", err)
+	}
+
+	createdAt, err := pdf.GetCreationDate(doc.Opts.Path)
+	if err != nil {
+		return fmt.Errorf("failed to get creation date: %w", err)
+	}
+	info, err := os.Stat(doc.Opts.Path)
+	if err != nil {
+		return fmt.Errorf("failed to get file size: %w", err)
+	}
+
+	diff := Diff{}
+	if !createdAt.Equal(doc.Opts.CreatedAt) {
+		diff["created_at"] = Change{Old: doc.Opts.CreatedAt, New: createdAt}
+	}
+	if info.Size() != doc.Size {
+		diff["size"] = Change{Old: doc.Size, New: info.Size()}
+	}
+
+	text := doc.Opts.Title + "\n" + doc.Opts.Content
+	correspondentID, documentTypeID := doc.CorrespondentID, doc.DocumentTypeID
+	for _, ref := range []struct {
+		c  classifier
+		id *int
+	}{
+		{correspondents, &correspondentID},
+		{documentTypes, &documentTypeID},
+	} {
+		if *ref.id != 0 {
+			continue
+		}
+		if *ref.id, err = ref.c.match(tx, text); err != nil {
+			return err
+		}
+		if *ref.id != 0 {
+			diff[ref.c.column] = Change{New: *ref.id}
+		}
+	}
+
+	if len(diff) == 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+		UPDATE documents SET created_at = ?, size = ?, correspondent_id = ?, document_type_id = ? WHERE id = ?
+	`, createdAt, info.Size(), nullID(correspondentID), nullID(documentTypeID), id)
+	if err != nil {
+		return fmt.Errorf("failed to update document: %w", err)
+	}
+	return recordEvent(ctx, tx, EntityDocument, id, ActionUpdate, diff)
+}
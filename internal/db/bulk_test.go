@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyBulk(t *testing.T) {
+	database := newTestDB(t)
+	alice := WithUser(context.Background(), newTestUser(t, database, "alice"))
+
+	tag, err := database.NewTag(alice, "invoice", "#ff0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := database.NewCorrespondent(alice, "ACME", MatchRule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, hash := range []string{"1", "2"} {
+		doc, err := database.NewDocument(alice, DocumentOptions{Title: hash, Path: "../pdf/testdata/test1.pdf", Hash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+	tags := func(id int) []int {
+		t.Helper()
+		assignments, err := database.GetTagAssignments(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tagIDs []int
+		for _, a := range assignments {
+			if a.DocumentID == id {
+				tagIDs = append(tagIDs, a.TagID)
+			}
+		}
+		return tagIDs
+	}
+
+	if err := database.ValidateBulk(BulkAction{Action: BulkAddTags}); !errors.Is(err, ErrValidation) {
+		t.Errorf("expected validation error without tags, got %v", err)
+	}
+	if err := database.ValidateBulk(BulkAction{Action: BulkSetCorrespondent, ClassifierID: 999}); !errors.Is(err, ErrValidation) {
+		t.Errorf("expected validation error for unknown correspondent, got %v", err)
+	}
+	if err := database.ValidateBulk(BulkAction{Action: "explode"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("expected validation error for unknown action, got %v", err)
+	}
+
+	// One missing document rolls back the whole action
+	addTag := BulkAction{Action: BulkAddTags, TagIDs: []int{tag.ID}}
+	results, err := database.ApplyBulk(alice, append(ids, 999), addTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Err != nil || !errors.Is(results[2].Err, ErrNotFound) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if got := tags(ids[0]); len(got) != 0 {
+		t.Errorf("expected rollback, got tags %v", got)
+	}
+
+	results, err = database.ApplyBulk(alice, ids, addTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			t.Fatalf("unexpected error for document %d: %v", res.DocumentID, res.Err)
+		}
+		if got := tags(res.DocumentID); !reflect.DeepEqual(got, []int{tag.ID}) {
+			t.Errorf("expected document %d to be tagged, got %v", res.DocumentID, got)
+		}
+	}
+
+	if _, err := database.ApplyBulk(alice, ids[:1], BulkAction{Action: BulkRemoveTags, TagIDs: []int{tag.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tags(ids[0]); len(got) != 0 {
+		t.Errorf("expected tag to be removed, got %v", got)
+	}
+	if got := tags(ids[1]); len(got) != 1 {
+		t.Errorf("expected other document to keep its tag, got %v", got)
+	}
+
+	if _, err := database.ApplyBulk(alice, ids, BulkAction{Action: BulkSetCorrespondent, ClassifierID: acme.ID}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if doc, _ := database.GetDocumentByID(alice, id); doc.CorrespondentID != acme.ID {
+			t.Errorf("expected correspondent %d, got %d", acme.ID, doc.CorrespondentID)
+		}
+	}
+
+	// Other users can't change the documents
+	bob := WithUser(context.Background(), newTestUser(t, database, "bob"))
+	results, err = database.ApplyBulk(bob, ids, addTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results[0].Err, ErrNotFound) {
+		t.Errorf("expected not found for other user, got %v", results[0].Err)
+	}
+}
+
+func TestApplyBulkTrashRollback(t *testing.T) {
+	database := newTestDB(t)
+	alice := WithUser(context.Background(), newTestUser(t, database, "alice"))
+
+	data, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test1.pdf")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.NewDocument(alice, DocumentOptions{Title: "test", Path: path, Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := database.ApplyBulk(alice, []int{doc.ID, 999}, BulkAction{Action: BulkTrash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[1].Err == nil {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected file to be moved back: %v", err)
+	}
+	if _, err := database.GetDocumentByID(alice, doc.ID); err != nil {
+		t.Errorf("expected document to stay out of the trash: %v", err)
+	}
+
+	results, err = database.ApplyBulk(alice, []int{doc.ID}, BulkAction{Action: BulkTrash})
+	if err != nil || results[0].Err != nil {
+		t.Fatal(err, results)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected file to be in the trash, got %v", err)
+	}
+}
@@ -0,0 +1,438 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matching algorithms of a MatchRule
+const (
+	MatchNone  = "none"  // never matches, assign by hand
+	MatchAny   = "any"   // any of the words of the pattern
+	MatchAll   = "all"   // all of the words of the pattern
+	MatchExact = "exact" // the pattern as a phrase
+	MatchRegex = "regex" // the pattern as a regular expression
+)
+
+// MatchRule decides whether a correspondent or document type is assigned
+// automatically to a new document, based on its title and content. Words
+// match whole words only; matching ignores case unless CaseSensitive is set.
+type MatchRule struct {
+	Algorithm     string
+	Pattern       string
+	CaseSensitive bool
+}
+
+// Correspondent is the person or organization a document comes from
+type Correspondent struct {
+	ID    int
+	Name  string
+	Match MatchRule
+}
+
+// DocumentType is the kind of a document, like invoice or contract
+type DocumentType struct {
+	ID    int
+	Name  string
+	Match MatchRule
+}
+
+// classifier holds what correspondents and document types have in common:
+// a table of named entries with match rules, referenced by a column of
+// documents
+type classifier struct {
+	table  string // name of the table
+	column string // column of documents referencing the table
+	entity string // entity in the audit log
+	noun   string // used in error messages
+}
+
+var (
+	correspondents = classifier{table: "correspondents", column: "correspondent_id", entity: EntityCorrespondent, noun: "correspondent"}
+	documentTypes  = classifier{table: "document_types", column: "document_type_id", entity: EntityDocumentType, noun: "document type"}
+)
+
+// classified is the row of a classifier table
+type classified struct {
+	ID    int
+	Name  string
+	Match MatchRule
+}
+
+func (db *DB) initClassifiers() {
+	for _, c := range []classifier{correspondents, documentTypes} {
+		db.db.Exec(`
+			CREATE TABLE IF NOT EXISTS ` + c.table + ` (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE,
+				match_algorithm TEXT NOT NULL DEFAULT 'none',
+				match_pattern TEXT NOT NULL DEFAULT '',
+				match_case_sensitive BOOLEAN NOT NULL DEFAULT FALSE
+			)
+		`)
+		db.db.Exec(`ALTER TABLE documents ADD COLUMN ` + c.column + ` INTEGER REFERENCES ` + c.table + ` (id) ON DELETE SET NULL`)
+		db.db.Exec(`CREATE INDEX IF NOT EXISTS documents_` + c.column + ` ON documents (` + c.column + `)`)
+	}
+}
+
+// validate checks the rule and fills in the default algorithm
+func (r *MatchRule) validate() error {
+	if r.Algorithm == "" {
+		r.Algorithm = MatchNone
+	}
+	switch r.Algorithm {
+	case MatchNone:
+		r.Pattern = ""
+		return nil
+	case MatchAny, MatchAll, MatchExact:
+	case MatchRegex:
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return invalidf("match.pattern", "invalid match pattern: %v", err)
+		}
+	default:
+		return invalidf("match.algorithm", "invalid match algorithm %q", r.Algorithm)
+	}
+	if strings.TrimSpace(r.Pattern) == "" {
+		return invalidf("match.pattern", "invalid match pattern: required for algorithm %s", r.Algorithm)
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to the given text
+func (r MatchRule) Matches(text string) bool {
+	flags := "(?i)"
+	if r.CaseSensitive {
+		flags = ""
+	}
+	word := func(w string) bool {
+		return regexp.MustCompile(flags + `\b` + regexp.QuoteMeta(w) + `\b`).MatchString(text)
+	}
+
+	switch r.Algorithm {
+	case MatchAny:
+		for _, w := range strings.Fields(r.Pattern) {
+			if word(w) {
+				return true
+			}
+		}
+	case MatchAll:
+		words := strings.Fields(r.Pattern)
+		for _, w := range words {
+			if !word(w) {
+				return false
+			}
+		}
+		return len(words) > 0
+	case MatchExact:
+		if r.CaseSensitive {
+			return strings.Contains(text, r.Pattern)
+		}
+		return strings.Contains(strings.ToLower(text), strings.ToLower(r.Pattern))
+	case MatchRegex:
+		re, err := regexp.Compile(flags + r.Pattern)
+		return err == nil && re.MatchString(text)
+	}
+	return false
+}
+
+func (c classifier) create(ctx context.Context, db *DB, name string, rule MatchRule) (classified, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return classified{}, invalidf("name", "invalid %s: name is required", c.noun)
+	}
+	if err := rule.validate(); err != nil {
+		return classified{}, err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return classified{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+c.table+` WHERE name = ?)`, name).Scan(&exists); err != nil {
+		return classified{}, fmt.Errorf("failed to check for existing %s: %w", c.noun, err)
+	}
+	if exists {
+		return classified{}, conflictf("%s with name %s already exists", c.noun, name)
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO `+c.table+` (name, match_algorithm, match_pattern, match_case_sensitive) VALUES (?, ?, ?, ?)
+	`, name, rule.Algorithm, rule.Pattern, rule.CaseSensitive)
+	if err != nil {
+		return classified{}, fmt.Errorf("failed to create %s: %w", c.noun, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return classified{}, fmt.Errorf("failed to get %s ID: %w", c.noun, err)
+	}
+
+	entry := classified{ID: int(id), Name: name, Match: rule}
+	if err := recordEvent(ctx, tx, c.entity, entry.ID, ActionCreate, entry.diff(classified{})); err != nil {
+		return classified{}, err
+	}
+	if err := db.commit(tx); err != nil {
+		return classified{}, fmt.Errorf("failed to commit %s: %w", c.noun, err)
+	}
+	return entry, nil
+}
+
+func (c classifier) update(ctx context.Context, db *DB, id int, name string, rule MatchRule) (classified, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return classified{}, invalidf("name", "invalid %s: name is required", c.noun)
+	}
+	if err := rule.validate(); err != nil {
+		return classified{}, err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return classified{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	old, err := c.get(tx, id)
+	if err != nil {
+		return classified{}, err
+	}
+	var taken bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+c.table+` WHERE name = ? AND id != ?)`, name, id).Scan(&taken); err != nil {
+		return classified{}, fmt.Errorf("failed to check for existing %s: %w", c.noun, err)
+	}
+	if taken {
+		return classified{}, conflictf("%s with name %s already exists", c.noun, name)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE `+c.table+` SET name = ?, match_algorithm = ?, match_pattern = ?, match_case_sensitive = ? WHERE id = ?
+	`, name, rule.Algorithm, rule.Pattern, rule.CaseSensitive, id)
+	if err != nil {
+		return classified{}, fmt.Errorf("failed to update %s: %w", c.noun, err)
+	}
+
+	entry := classified{ID: id, Name: name, Match: rule}
+	if diff := entry.diff(old); len(diff) > 0 {
+		if err := recordEvent(ctx, tx, c.entity, id, ActionUpdate, diff); err != nil {
+			return classified{}, err
+		}
+	}
+	if err := db.commit(tx); err != nil {
+		return classified{}, fmt.Errorf("failed to commit %s: %w", c.noun, err)
+	}
+	return entry, nil
+}
+
+// remove deletes an entry. Documents referencing it lose the reference.
+func (c classifier) remove(ctx context.Context, db *DB, id int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	old, err := c.get(tx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM `+c.table+` WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", c.noun, err)
+	}
+	if err := recordEvent(ctx, tx, c.entity, id, ActionDelete, classified{}.diff(old)); err != nil {
+		return err
+	}
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit %s removal: %w", c.noun, err)
+	}
+	return nil
+}
+
+// diff describes the change from old to e
+func (e classified) diff(old classified) Diff {
+	d := Diff{}
+	if e.Name != old.Name {
+		d["name"] = Change{Old: nilIfZero(old.Name), New: nilIfZero(e.Name)}
+	}
+	if e.Match != old.Match {
+		var o, n any
+		if old.ID != 0 {
+			o = old.Match
+		}
+		if e.ID != 0 {
+			n = e.Match
+		}
+		d["match"] = Change{Old: o, New: n}
+	}
+	return d
+}
+
+func nilIfZero[T comparable](v T) any {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return v
+}
+
+const classifiedColumns = `id, name, match_algorithm, match_pattern, match_case_sensitive`
+
+func scanClassified(row rowScanner) (classified, error) {
+	var e classified
+	err := row.Scan(&e.ID, &e.Name, &e.Match.Algorithm, &e.Match.Pattern, &e.Match.CaseSensitive)
+	return e, err
+}
+
+func (c classifier) get(q querier, id int) (classified, error) {
+	e, err := scanClassified(q.QueryRow(`SELECT `+classifiedColumns+` FROM `+c.table+` WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return classified{}, notFoundf("%s with id %d not found", c.noun, id)
+		}
+		return classified{}, fmt.Errorf("failed to get %s: %w", c.noun, err)
+	}
+	return e, nil
+}
+
+func (c classifier) getByName(q querier, name string) (classified, error) {
+	e, err := scanClassified(q.QueryRow(`SELECT `+classifiedColumns+` FROM `+c.table+` WHERE name = ?`, name))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return classified{}, notFoundf("%s with name %s not found", c.noun, name)
+		}
+		return classified{}, fmt.Errorf("failed to get %s: %w", c.noun, err)
+	}
+	return e, nil
+}
+
+// list returns all entries ordered by name
+func (c classifier) list(q querier) ([]classified, error) {
+	rows, err := q.Query(`SELECT ` + classifiedColumns + ` FROM ` + c.table + ` ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s entries: %w", c.noun, err)
+	}
+	defer rows.Close()
+
+	entries := []classified{}
+	for rows.Next() {
+		e, err := scanClassified(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s row: %w", c.noun, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// match returns the ID of the first entry, in order of creation, whose rule
+// matches the text, or 0
+func (c classifier) match(q querier, text string) (int, error) {
+	rows, err := q.Query(`
+		SELECT ` + classifiedColumns + ` FROM ` + c.table + ` WHERE match_algorithm != 'none' ORDER BY id
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get %s rules: %w", c.noun, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanClassified(rows)
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan %s row: %w", c.noun, err)
+		}
+		if e.Match.Matches(text) {
+			return e.ID, nil
+		}
+	}
+	return 0, rows.Err()
+}
+
+// NewCorrespondent adds a correspondent
+func (db *DB) NewCorrespondent(ctx context.Context, name string, rule MatchRule) (Correspondent, error) {
+	e, err := correspondents.create(ctx, db, name, rule)
+	return Correspondent(e), err
+}
+
+// GetCorrespondents returns all correspondents ordered by name
+func (db *DB) GetCorrespondents() ([]Correspondent, error) {
+	entries, err := correspondents.list(db.db)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Correspondent, len(entries))
+	for i, e := range entries {
+		result[i] = Correspondent(e)
+	}
+	return result, nil
+}
+
+// GetCorrespondentByID returns a correspondent
+func (db *DB) GetCorrespondentByID(id int) (Correspondent, error) {
+	e, err := correspondents.get(db.db, id)
+	return Correspondent(e), err
+}
+
+// GetCorrespondentByName returns a correspondent
+func (db *DB) GetCorrespondentByName(name string) (Correspondent, error) {
+	e, err := correspondents.getByName(db.db, name)
+	return Correspondent(e), err
+}
+
+// UpdateCorrespondent renames a correspondent and replaces its match rule
+func (db *DB) UpdateCorrespondent(ctx context.Context, id int, name string, rule MatchRule) (Correspondent, error) {
+	e, err := correspondents.update(ctx, db, id, name, rule)
+	return Correspondent(e), err
+}
+
+// RemoveCorrespondent deletes a correspondent. Its documents keep existing
+// without a correspondent.
+func (db *DB) RemoveCorrespondent(ctx context.Context, id int) error {
+	return correspondents.remove(ctx, db, id)
+}
+
+// NewDocumentType adds a document type
+func (db *DB) NewDocumentType(ctx context.Context, name string, rule MatchRule) (DocumentType, error) {
+	e, err := documentTypes.create(ctx, db, name, rule)
+	return DocumentType(e), err
+}
+
+// GetDocumentTypes returns all document types ordered by name
+func (db *DB) GetDocumentTypes() ([]DocumentType, error) {
+	entries, err := documentTypes.list(db.db)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DocumentType, len(entries))
+	for i, e := range entries {
+		result[i] = DocumentType(e)
+	}
+	return result, nil
+}
+
+// GetDocumentTypeByID returns a document type
+func (db *DB) GetDocumentTypeByID(id int) (DocumentType, error) {
+	e, err := documentTypes.get(db.db, id)
+	return DocumentType(e), err
+}
+
+// GetDocumentTypeByName returns a document type
+func (db *DB) GetDocumentTypeByName(name string) (DocumentType, error) {
+	e, err := documentTypes.getByName(db.db, name)
+	return DocumentType(e), err
+}
+
+// UpdateDocumentType renames a document type and replaces its match rule
+func (db *DB) UpdateDocumentType(ctx context.Context, id int, name string, rule MatchRule) (DocumentType, error) {
+	e, err := documentTypes.update(ctx, db, id, name, rule)
+	return DocumentType(e), err
+}
+
+// RemoveDocumentType deletes a document type. Its documents keep existing
+// without a type.
+func (db *DB) RemoveDocumentType(ctx context.Context, id int) error {
+	return documentTypes.remove(ctx, db, id)
+}
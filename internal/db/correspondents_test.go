@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	const text = "Invoice 2025-117 from ACME Power GmbH"
+	tests := []struct {
+		rule MatchRule
+		want bool
+	}{
+		{MatchRule{Algorithm: MatchNone}, false},
+		{MatchRule{Algorithm: MatchAny, Pattern: "water acme"}, true},
+		{MatchRule{Algorithm: MatchAny, Pattern: "pow"}, false}, // whole words only
+		{MatchRule{Algorithm: MatchAll, Pattern: "acme invoice"}, true},
+		{MatchRule{Algorithm: MatchAll, Pattern: "acme water"}, false},
+		{MatchRule{Algorithm: MatchExact, Pattern: "acme power"}, true},
+		{MatchRule{Algorithm: MatchExact, Pattern: "acme power", CaseSensitive: true}, false},
+		{MatchRule{Algorithm: MatchRegex, Pattern: `invoice \d{4}-\d+`}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Matches(text); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestCorrespondentsAndDocumentTypes(t *testing.T) {
+	database := newTestDB(t)
+	ctx := WithUser(context.Background(), newTestUser(t, database, "alice"))
+
+	acme, err := database.NewCorrespondent(ctx, "ACME", MatchRule{Algorithm: MatchAny, Pattern: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.NewCorrespondent(ctx, "ACME", MatchRule{}); err == nil {
+		t.Errorf("expected duplicate name to fail")
+	}
+	if _, err := database.NewCorrespondent(ctx, "Bad", MatchRule{Algorithm: MatchRegex, Pattern: "("}); err == nil {
+		t.Errorf("expected invalid regex to fail")
+	}
+	invoice, err := database.NewDocumentType(ctx, "Invoice", MatchRule{Algorithm: MatchExact, Pattern: "invoice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := database.NewDocumentType(ctx, "Contract", MatchRule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Match rules assign both on creation
+	matched, err := database.NewDocument(ctx, DocumentOptions{
+		Title:   "Invoice March",
+		Content: "ACME Power GmbH",
+		Path:    "../pdf/testdata/test1.pdf",
+		Hash:    "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched.CorrespondentID != acme.ID || matched.DocumentTypeID != invoice.ID {
+		t.Errorf("match rules not applied: %+v", matched)
+	}
+	other, err := database.NewDocument(ctx, DocumentOptions{
+		Title: "Lease",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.CorrespondentID != 0 || other.DocumentTypeID != 0 {
+		t.Errorf("unexpected assignment: %+v", other)
+	}
+
+	other, err = database.UpdateDocument(ctx, other.ID, DocumentUpdate{DocumentTypeID: &contract.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.DocumentTypeID != contract.ID {
+		t.Errorf("document type not set: %+v", other)
+	}
+	missing := 999
+	if _, err := database.UpdateDocument(ctx, other.ID, DocumentUpdate{CorrespondentID: &missing}); err == nil {
+		t.Errorf("expected unknown correspondent to fail")
+	}
+
+	none := 0
+	for _, tt := range []struct {
+		query DocumentQuery
+		want  int
+	}{
+		{DocumentQuery{CorrespondentID: &acme.ID}, matched.ID},
+		{DocumentQuery{CorrespondentID: &none}, other.ID},
+		{DocumentQuery{DocumentTypeID: &contract.ID}, other.ID},
+	} {
+		docs, err := database.FindDocuments(ctx, tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) != 1 || docs[0].ID != tt.want {
+			t.Errorf("%+v: expected document %d, got %+v", tt.query, tt.want, docs)
+		}
+	}
+
+	// Removing a correspondent keeps its documents
+	if err := database.RemoveCorrespondent(ctx, acme.ID); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.GetDocumentByID(ctx, matched.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.CorrespondentID != 0 {
+		t.Errorf("expected correspondent to be cleared, got %d", doc.CorrespondentID)
+	}
+}
@@ -1,41 +1,75 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
 
+	"github.com/Ardelean-Calin/cellulose/internal/events"
 	"github.com/Ardelean-Calin/cellulose/internal/pdf"
 )
 
 type DB struct {
-	db *sql.DB
+	db       *sql.DB
+	trashDir string
+	stats    statsCache
+
+	events    *events.Bus
+	publishMu sync.Mutex
+	published int // ID of the last audit event published
 }
 
 type Config struct {
 	// DatabasePath is the path to the database file
 	DatabasePath string
+	// TrashDir is the directory receiving the files of deleted documents
+	TrashDir string
 }
 
-// InitDB creates a new DB instance
+// DefaultDatabasePath is the database file used when no other path is configured
+const DefaultDatabasePath = "cellulose.db"
+
+// DefaultTrashDir is the trash directory used when no other path is configured
+const DefaultTrashDir = "trash"
+
+// InitDB creates a new DB instance using the default database path
 func InitDB() (*DB, error) {
-	db, err := sql.Open("sqlite", "cellulose.db")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+	return Open(Config{DatabasePath: DefaultDatabasePath})
+}
+
+// Open creates a new DB instance for the given configuration
+func Open(cfg Config) (*DB, error) {
+	if cfg.DatabasePath == "" {
+		cfg.DatabasePath = DefaultDatabasePath
+	}
+	if cfg.TrashDir == "" {
+		cfg.TrashDir = DefaultTrashDir
 	}
 
 	// Create database directory if it doesn't exist
-	err = os.MkdirAll(filepath.Dir("cellulose.db"), 0755)
+	err := os.MkdirAll(filepath.Dir(cfg.DatabasePath), 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	d := &DB{db}
+	// Wait for concurrent writers instead of failing, take the write lock
+	// when a transaction begins so that check-then-insert sequences are
+	// atomic, and enforce foreign keys.
+	db, err := sql.Open("sqlite", cfg.DatabasePath+"?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	d := &DB{db: db, trashDir: cfg.TrashDir}
 	d.init()
 
 	return d, nil
@@ -45,6 +79,16 @@ func (db *DB) Close() {
 	db.db.Close()
 }
 
+// BackupTo writes a consistent copy of the database to path. It is safe to
+// call while the database is in use.
+func (db *DB) BackupTo(path string) error {
+	_, err := db.db.Exec(`VACUUM INTO ?`, path)
+	if err != nil {
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+	return nil
+}
+
 func (db *DB) init() {
 	// Create documents table
 	db.db.Exec(`
@@ -67,37 +111,175 @@ func (db *DB) init() {
 			color TEXT NOT NULL -- hex color code
 		)
 	`)
+
+	// Create document_tags table holding the tags assigned to each document
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS document_tags (
+			document_id INTEGER NOT NULL,
+			tag_id INTEGER NOT NULL,
+			PRIMARY KEY (document_id, tag_id)
+		)
+	`)
+
+	// Columns added after the first release. ALTER TABLE fails when the
+	// column already exists, which is fine.
+	db.db.Exec(`ALTER TABLE documents ADD COLUMN deleted_at DATETIME`)
+	db.db.Exec(`ALTER TABLE documents ADD COLUMN original_path TEXT`)
+
+	db.db.Exec(`CREATE INDEX IF NOT EXISTS documents_hash ON documents (hash)`)
+
+	db.initUsers()
+	db.initAccess()
+	db.initShares()
+	db.initAudit()
+	db.initVersions()
+	db.initNotes()
+	db.initFields()
+	db.initClassifiers()
+	db.initTagTree()
+	db.initStats()
+	db.initWebhooks()
+	db.initUploads()
+	db.initEvents()
+}
+
+var (
+	// ErrDuplicate is returned when a document with the same hash is already stored
+	ErrDuplicate error = &Error{Kind: ErrConflict, Code: "duplicate_file", Message: "file already exists"}
+	// ErrInTrash is returned when a document with the same hash is in the trash
+	ErrInTrash error = &Error{Kind: ErrConflict, Code: "file_in_trash", Message: "file already exists in the trash"}
+)
+
+// NewDocument adds a document whose file is already in place to the database.
+// The user in ctx becomes its owner.
+func (db *DB) NewDocument(ctx context.Context, opts DocumentOptions) (Document, error) {
+	// Get file info for creation time, unless the caller already knows it
+	if opts.CreatedAt.IsZero() {
+		creationDate, err := pdf.GetCreationDate(opts.Path)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to get creation date: %w", err)
+		}
+		opts.CreatedAt = creationDate
+	}
+	info, err := os.Stat(opts.Path)
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to get file size: %w", err)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	doc, err := insertDocument(ctx, tx, opts, info.Size())
+	if err != nil {
+		return Document{}, err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return Document{}, fmt.Errorf("failed to commit document: %w", err)
+	}
+
+	return doc, nil
 }
 
-// NewDocument adds a document to the database
-func (db *DB) NewDocument(opts DocumentOptions) (Document, error) {
+// StoreDocument adds the file at tmpPath to the library under the given name
+// inside dir. Within one transaction it rejects files whose hash is already
+// known, picks a file name that is not taken, inserts the document and moves
+// the file into place. On error the database is unchanged and the file is
+// still at tmpPath. The user in ctx becomes the owner of the document.
+//
+// Files are stored only once, so duplicates are detected across the whole
+// library and not only among the documents visible to the user.
+func (db *DB) StoreDocument(ctx context.Context, tmpPath, dir, name string, opts DocumentOptions) (Document, error) {
+	// Get file info for creation time, unless the caller already knows it
+	if opts.CreatedAt.IsZero() {
+		creationDate, err := pdf.GetCreationDate(tmpPath)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to get creation date: %w", err)
+		}
+		opts.CreatedAt = creationDate
+	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to get file size: %w", err)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Check if the hash already exists, as a document or an earlier version
+	if err := checkHash(tx, opts.Hash); err != nil {
+		return Document{}, err
+	}
+
+	// The transaction holds the write lock, so no other writer can claim the
+	// same name before the file is renamed.
+	opts.Path = freePath(filepath.Join(dir, filepath.Base(name)))
+
+	doc, err := insertDocument(ctx, tx, opts, info.Size())
+	if err != nil {
+		return Document{}, err
+	}
+
+	if err := os.Rename(tmpPath, opts.Path); err != nil {
+		return Document{}, fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	if err := db.commit(tx); err != nil {
+		os.Rename(opts.Path, tmpPath)
+		return Document{}, fmt.Errorf("failed to commit document: %w", err)
+	}
+
+	return doc, nil
+}
+
+// insertDocument writes the document row and its tag assignments. size is
+// the size of the file in bytes.
+func insertDocument(ctx context.Context, tx *sql.Tx, opts DocumentOptions, size int64) (Document, error) {
 	// Verify that the tags exist
+	tagIDs := make([]int, 0, len(opts.Tags))
 	for _, tag := range opts.Tags {
 		var tagID int
-		err := db.db.QueryRow(`
+		err := tx.QueryRow(`
 			SELECT id FROM tags WHERE name = ?
 		`, tag).Scan(&tagID)
 		if err != nil {
 			return Document{}, fmt.Errorf("failed to verify tag: %w", err)
 		}
+		tagIDs = append(tagIDs, tagID)
 	}
 
 	// Convert tags slice to comma-separated string
 	tagsStr := "{" + strings.Join(opts.Tags, ",") + "}"
 
-	fmt.Printf("Executing SQL insert with values: title=%s, path=%s, content=%s, hash=%s, tags=%s\n",
-		opts.Title, opts.Path, opts.Content, opts.Hash, tagsStr)
-
-	// Get file info for creation time
-	creationDate, err := pdf.GetCreationDate(opts.Path)
-	if err != nil {
-		return Document{}, fmt.Errorf("failed to get creation date: %w", err)
+	// Let the match rules pick a correspondent and type
+	text := opts.Title + "\n" + opts.Content
+	if opts.CorrespondentID == 0 {
+		id, err := correspondents.match(tx, text)
+		if err != nil {
+			return Document{}, err
+		}
+		opts.CorrespondentID = id
+	}
+	if opts.DocumentTypeID == 0 {
+		id, err := documentTypes.match(tx, text)
+		if err != nil {
+			return Document{}, err
+		}
+		opts.DocumentTypeID = id
 	}
-	opts.CreatedAt = creationDate
 
-	result, err := db.db.Exec(`
-		INSERT INTO documents (title, path, content, hash, created_at, tags) VALUES (?, ?, ?, ?, ?, ?)
-	`, opts.Title, opts.Path, opts.Content, opts.Hash, opts.CreatedAt, tagsStr)
+	owner := ownerID(ctx)
+	result, err := tx.Exec(`
+		INSERT INTO documents (title, path, content, hash, created_at, tags, owner_id, correspondent_id, document_type_id, size)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, opts.Title, opts.Path, opts.Content, opts.Hash, opts.CreatedAt, tagsStr, owner,
+		nullID(opts.CorrespondentID), nullID(opts.DocumentTypeID), size)
 	if err != nil {
 		return Document{}, fmt.Errorf("failed to add document: %w", err)
 	}
@@ -107,42 +289,166 @@ func (db *DB) NewDocument(opts DocumentOptions) (Document, error) {
 		return Document{}, fmt.Errorf("failed to get last insert id: %w", err)
 	}
 
-	return Document{ID: int(id), Opts: opts}, nil
+	for _, tagID := range tagIDs {
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO document_tags (document_id, tag_id) VALUES (?, ?)
+		`, id, tagID)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to assign tag: %w", err)
+		}
+	}
+
+	doc := Document{
+		ID:              int(id),
+		OwnerID:         int(owner.Int64),
+		Version:         1,
+		CorrespondentID: opts.CorrespondentID,
+		DocumentTypeID:  opts.DocumentTypeID,
+		Size:            size,
+		Opts:            opts,
+	}
+	if err := recordEvent(ctx, tx, EntityDocument, doc.ID, ActionCreate, documentDiff(doc, true)); err != nil {
+		return Document{}, err
+	}
+	return doc, nil
 }
 
-// RemoveDocument removes a document from the database
-func (db *DB) RemoveDocument(id int) error {
-	var path string
+// RemoveDocument permanently removes a document from the database and deletes
+// its file. The file is only deleted once the rows are gone. Only the owner
+// of a document may remove it.
+func (db *DB) RemoveDocument(ctx context.Context, id int) error {
+	return db.removeDocument(ctx, id, nil)
+}
+
+// removeDocument is RemoveDocument. With trashedBefore set, only a document
+// moved to the trash before then is removed, checked in the same
+// transaction so that a document restored meanwhile is left alone.
+func (db *DB) removeDocument(ctx context.Context, id int, trashedBefore *time.Time) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, id, PermOwner); err != nil {
+		return err
+	}
 
-	// Get document path
-	err := db.db.QueryRow(`
-		SELECT path FROM documents WHERE id = ?
-	`, id).Scan(&path)
+	// Get the document for its path and the audit log
+	doc, err := scanDocument(tx.QueryRow(`
+		SELECT `+documentColumns+` FROM documents WHERE id = ?
+	`, id))
 	if err != nil {
-		return fmt.Errorf("failed to get document path: %w", err)
+		if err == sql.ErrNoRows {
+			return notFoundf("document with id %d not found", id)
+		}
+		return fmt.Errorf("failed to get document: %w", err)
+	}
+	if trashedBefore != nil && (doc.DeletedAt == nil || doc.DeletedAt.After(*trashedBefore)) {
+		return notFoundf("document with id %d not found in trash", id)
+	}
+
+	// Versions go first, the foreign key would drop their rows silently
+	paths, err := removeVersions(tx, id)
+	if err != nil {
+		return err
 	}
 
 	// Remove document from database
-	_, err = db.db.Exec(`
+	_, err = tx.Exec(`
 		DELETE FROM documents WHERE id = ?
 	`, id)
 	if err != nil {
 		return fmt.Errorf("failed to remove document from database: %w", err)
 	}
 
-	// Remove document from filesystem
-	err = os.Remove(path)
+	_, err = tx.Exec(`
+		DELETE FROM document_tags WHERE document_id = ?
+	`, id)
 	if err != nil {
-		return fmt.Errorf("failed to remove document from filesystem: %w", err)
+		return fmt.Errorf("failed to remove document tags: %w", err)
+	}
+
+	if err := recordEvent(ctx, tx, EntityDocument, id, ActionDelete, documentDiff(doc, false)); err != nil {
+		return err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit removal: %w", err)
 	}
 
+	// Remove the files only once the rows are gone for good. A file that
+	// can't be removed is left as an orphan for the check command to report.
+	for _, path := range append(paths, doc.Opts.Path) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove file of document %d: %v\n", id, err)
+		}
+	}
 	return nil
 }
 
 // Document represents a document in the database
 type Document struct {
-	ID   int // id of the document
-	Opts DocumentOptions
+	ID              int        // id of the document
+	OwnerID         int        // id of the owning user, 0 when nobody owns it
+	DeletedAt       *time.Time // set while the document is in the trash
+	Version         int        // number of the current file, see Version
+	CorrespondentID int        // 0 when not assigned
+	DocumentTypeID  int        // 0 when not assigned
+	Size            int64      // size of the current file in bytes
+	Opts            DocumentOptions
+	Fields          []FieldValue // custom field values, ordered by field name
+}
+
+// documentColumns lists the columns read by scanDocument, in order
+const documentColumns = `documents.id, documents.title, documents.path, documents.content, documents.hash,
+	documents.created_at, documents.deleted_at, documents.owner_id, documents.version,
+	documents.correspondent_id, documents.document_type_id, COALESCE(documents.size, 0)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanDocument reads a row selected with documentColumns
+func scanDocument(row rowScanner) (Document, error) {
+	var (
+		doc           Document
+		deletedAt     sql.NullTime
+		owner         sql.NullInt64
+		correspondent sql.NullInt64
+		documentType  sql.NullInt64
+	)
+	err := row.Scan(&doc.ID, &doc.Opts.Title, &doc.Opts.Path, &doc.Opts.Content, &doc.Opts.Hash, &doc.Opts.CreatedAt, &deletedAt, &owner, &doc.Version,
+		&correspondent, &documentType, &doc.Size)
+	if err != nil {
+		return Document{}, err
+	}
+	doc.OwnerID = int(owner.Int64)
+	doc.CorrespondentID = int(correspondent.Int64)
+	doc.DocumentTypeID = int(documentType.Int64)
+	if deletedAt.Valid {
+		doc.DeletedAt = &deletedAt.Time
+	}
+	return doc, nil
+}
+
+// scanDocuments reads all rows selected with documentColumns
+func scanDocuments(rows *sql.Rows) ([]Document, error) {
+	defer rows.Close()
+
+	var documents []Document
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan document: %w", err)
+		}
+		documents = append(documents, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate through document rows: %w", err)
+	}
+
+	return documents, nil
 }
 
 type DocumentOptions struct {
@@ -152,33 +458,58 @@ type DocumentOptions struct {
 	Hash      string
 	Tags      []string
 	CreatedAt time.Time
+	// Assigned by the match rules when zero
+	CorrespondentID int
+	DocumentTypeID  int
 }
 
 // Tag represents a tag in the database
 type Tag struct {
-	ID    int    // id of the tag
-	Name  string // name of the tag
-	Color string // hex color code
+	ID       int    // id of the tag
+	Name     string // name of the tag
+	Color    string // hex color code
+	ParentID int    // id of the parent tag, 0 for top-level tags
 }
 
-// NewTag creates a new tag inside the database
-func (db *DB) NewTag(name string, color string) (Tag, error) {
+// NewTag creates a new top-level tag inside the database
+func (db *DB) NewTag(ctx context.Context, name string, color string) (Tag, error) {
+	return db.newTag(ctx, name, color, 0)
+}
+
+// NewChildTag creates a new tag below an existing one
+func (db *DB) NewChildTag(ctx context.Context, parentID int, name string, color string) (Tag, error) {
+	return db.newTag(ctx, name, color, parentID)
+}
+
+func (db *DB) newTag(ctx context.Context, name string, color string, parentID int) (Tag, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Tag{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	// Check if tag already exists
 	var existingTag Tag
-	err := db.db.QueryRow(`
+	err = tx.QueryRow(`
         SELECT id, name, color FROM tags WHERE name = ?
     `, name).Scan(&existingTag.ID, &existingTag.Name, &existingTag.Color)
 
 	if err == nil {
-		return Tag{}, fmt.Errorf("tag with name %s already exists", name)
+		return Tag{}, conflictf("tag with name %s already exists", name)
 	} else if err != nil && err != sql.ErrNoRows {
 		return Tag{}, fmt.Errorf("failed to check for existing tag: %w", err)
 	}
 
+	if parentID != 0 {
+		if err := checkParentTag(tx, parentID); err != nil {
+			return Tag{}, err
+		}
+	}
+
 	// If we get here, the tag doesn't exist - proceed with insertion
-	result, err := db.db.Exec(`
-        INSERT INTO tags (name, color) VALUES (?, ?)
-    `, name, color)
+	result, err := tx.Exec(`
+        INSERT INTO tags (name, color, parent_id) VALUES (?, ?, ?)
+    `, name, color, nullID(parentID))
 	if err != nil {
 		return Tag{}, fmt.Errorf("failed to add tag: %w", err)
 	}
@@ -188,23 +519,49 @@ func (db *DB) NewTag(name string, color string) (Tag, error) {
 		return Tag{}, fmt.Errorf("failed to get tag ID: %w", err)
 	}
 
+	diff := Diff{
+		"name":  {New: name},
+		"color": {New: color},
+	}
+	if parentID != 0 {
+		diff["parent_id"] = Change{New: parentID}
+	}
+	if err := recordEvent(ctx, tx, EntityTag, int(id), ActionCreate, diff); err != nil {
+		return Tag{}, err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return Tag{}, fmt.Errorf("failed to commit tag: %w", err)
+	}
+
 	return Tag{
-		ID:    int(id),
-		Name:  name,
-		Color: color,
+		ID:       int(id),
+		Name:     name,
+		Color:    color,
+		ParentID: parentID,
 	}, nil
 }
 
 // GetTagByID retrieves a tag from the database by its ID.
 func (db *DB) GetTagByID(id int) (Tag, error) {
-	var tag Tag
-	err := db.db.QueryRow(`
-        SELECT id, name, color FROM tags WHERE id = ?
-    `, id).Scan(&tag.ID, &tag.Name, &tag.Color)
+	return getTag(db.db, id)
+}
+
+// RemoveTag removes a tag from the database. Its children move up to the
+// parent of the removed tag.
+func (db *DB) RemoveTag(ctx context.Context, id int) error {
+	return db.removeTag(ctx, id, false)
+}
+
+// GetTagByName retrieves a tag from the database by its name.
+func (db *DB) GetTagByName(name string) (Tag, error) {
+	tag, err := scanTag(db.db.QueryRow(`
+        SELECT `+tagColumns+` FROM tags WHERE name = ?
+    `, name))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return Tag{}, fmt.Errorf("tag with id %d not found", id)
+			return Tag{}, notFoundf("tag with name %s not found", name)
 		}
 		return Tag{}, fmt.Errorf("failed to get tag: %w", err)
 	}
@@ -212,45 +569,100 @@ func (db *DB) GetTagByID(id int) (Tag, error) {
 	return tag, nil
 }
 
-// RemoveTag removes a tag from the database
-func (db *DB) RemoveTag(id int) error {
-	_, err := db.db.Exec(`
-		DELETE FROM tags WHERE id = ?
-	`, id)
+// TagAssignment links a tag to a document
+type TagAssignment struct {
+	DocumentID int
+	TagID      int
+}
+
+// AddDocumentTag assigns a tag to a document. Assigning a tag twice is a no-op.
+func (db *DB) AddDocumentTag(ctx context.Context, documentID, tagID int) error {
+	tx, err := db.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to remove tag from database: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
+	if err := addDocumentTag(ctx, tx, documentID, tagID); err != nil {
+		return err
+	}
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit tag assignment: %w", err)
+	}
 	return nil
 }
 
-// GetDocuments returns all documents in the database
-func (db *DB) GetDocuments() ([]Document, error) {
+func addDocumentTag(ctx context.Context, tx *sql.Tx, documentID, tagID int) error {
+	if err := checkAccess(ctx, tx, documentID, PermEdit); err != nil {
+		return err
+	}
+
+	var name string
+	if err := tx.QueryRow(`SELECT name FROM tags WHERE id = ?`, tagID).Scan(&name); err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundf("tag with id %d not found", tagID)
+		}
+		return fmt.Errorf("failed to get tag: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		INSERT OR IGNORE INTO document_tags (document_id, tag_id) VALUES (?, ?)
+	`, documentID, tagID)
+	if err != nil {
+		return fmt.Errorf("failed to assign tag: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	return recordEvent(ctx, tx, EntityDocument, documentID, ActionTag, Diff{"tags": {New: name}})
+}
+
+// GetTagAssignments returns the tag assignments of all documents visible to
+// the user in ctx
+func (db *DB) GetTagAssignments(ctx context.Context) ([]TagAssignment, error) {
+	filter, args := accessFilter(ctx, PermView)
 	rows, err := db.db.Query(`
-		SELECT id, title, path, content, hash, created_at FROM documents
-	`)
+		SELECT document_tags.document_id, document_tags.tag_id
+		FROM document_tags JOIN documents ON documents.id = document_tags.document_id
+		WHERE `+filter+`
+		ORDER BY document_tags.document_id, document_tags.tag_id
+	`, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get documents: %w", err)
+		return nil, fmt.Errorf("failed to get tag assignments: %w", err)
 	}
 	defer rows.Close()
 
-	var documents []Document
+	assignments := []TagAssignment{}
 	for rows.Next() {
-		var doc Document
-		err = rows.Scan(&doc.ID, &doc.Opts.Title, &doc.Opts.Path, &doc.Opts.Content, &doc.Opts.Hash, &doc.Opts.CreatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan document: %w", err)
+		var a TagAssignment
+		if err := rows.Scan(&a.DocumentID, &a.TagID); err != nil {
+			return nil, fmt.Errorf("failed to scan tag assignment: %w", err)
 		}
-		documents = append(documents, doc)
+		assignments = append(assignments, a)
 	}
+	return assignments, rows.Err()
+}
 
-	return documents, nil
+// GetDocuments returns all documents visible to the user in ctx that are not
+// in the trash
+func (db *DB) GetDocuments(ctx context.Context) ([]Document, error) {
+	filter, args := accessFilter(ctx, PermView)
+	rows, err := db.db.Query(`
+		SELECT `+documentColumns+` FROM documents WHERE deleted_at IS NULL AND `+filter, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get documents: %w", err)
+	}
+	docs, err := scanDocuments(rows)
+	if err != nil {
+		return nil, err
+	}
+	return db.withFields(docs)
 }
 
 // GetTags returns all tags in the database
 func (db *DB) GetTags() ([]Tag, error) {
 	rows, err := db.db.Query(`
-		SELECT id, name, color FROM tags
+		SELECT ` + tagColumns + ` FROM tags
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tags: %w", err)
@@ -259,8 +671,8 @@ func (db *DB) GetTags() ([]Tag, error) {
 
 	tags := []Tag{}
 	for rows.Next() {
-		var tag Tag
-		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color); err != nil {
+		tag, err := scanTag(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan tag row: %w", err)
 		}
 		tags = append(tags, tag)
@@ -271,63 +683,182 @@ func (db *DB) GetTags() ([]Tag, error) {
 	return tags, nil
 }
 
-// GetDocumentByID retrieves a document from the database by its ID
-func (db *DB) GetDocumentByID(id int) (Document, error) {
-	var doc Document
-	err := db.db.QueryRow(`
-		SELECT id, title, path, content, hash, created_at 
-		FROM documents 
-		WHERE id = ?
-	`, id).Scan(&doc.ID, &doc.Opts.Title, &doc.Opts.Path, &doc.Opts.Content, &doc.Opts.Hash, &doc.Opts.CreatedAt)
+// GetDocumentByID retrieves a document from the database by its ID. Documents
+// in the trash and documents the user in ctx may not see are not returned.
+func (db *DB) GetDocumentByID(ctx context.Context, id int) (Document, error) {
+	filter, args := accessFilter(ctx, PermView)
+	doc, err := scanDocument(db.db.QueryRow(`
+		SELECT `+documentColumns+`
+		FROM documents
+		WHERE id = ? AND deleted_at IS NULL AND `+filter, append([]any{id}, args...)...))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return Document{}, fmt.Errorf("document with id %d not found", id)
+			return Document{}, notFoundf("document with id %d not found", id)
 		}
 		return Document{}, fmt.Errorf("failed to get document: %w", err)
 	}
-	return doc, nil
+	docs, err := db.withFields([]Document{doc})
+	if err != nil {
+		return Document{}, err
+	}
+	return docs[0], nil
 }
 
-// DocumentExistsByHash checks if a document with the given hash exists in the database
-func (db *DB) DocumentExistsByHash(hash string) (bool, error) {
-	var exists bool
-	err := db.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM documents WHERE hash = ?)`, hash).Scan(&exists)
+// UpdateDocumentCreatedAt overwrites the creation date stored for a document
+func (db *DB) UpdateDocumentCreatedAt(ctx context.Context, id int, createdAt time.Time) error {
+	tx, err := db.db.Begin()
 	if err != nil {
-		return false, fmt.Errorf("failed to check document existence: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, id, PermEdit); err != nil {
+		return err
+	}
+
+	var old time.Time
+	if err := tx.QueryRow(`SELECT created_at FROM documents WHERE id = ?`, id).Scan(&old); err != nil {
+		return fmt.Errorf("failed to get document: %w", err)
+	}
+	if old.Equal(createdAt) {
+		return nil
 	}
-	return exists, nil
+
+	_, err = tx.Exec(`
+		UPDATE documents SET created_at = ? WHERE id = ?
+	`, createdAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update document: %w", err)
+	}
+
+	if err := recordEvent(ctx, tx, EntityDocument, id, ActionUpdate, Diff{"created_at": {Old: old, New: createdAt}}); err != nil {
+		return err
+	}
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit update: %w", err)
+	}
+	return nil
 }
 
-// GetDocumentsByTitle returns documents filtered by title
-func (db *DB) GetDocumentsByTitle(title string) ([]Document, error) {
-	var (
-		rows *sql.Rows
-		err  error
-	)
-	if title != "" {
-		rows, err = db.db.Query(`
-			SELECT id, title, path, content, hash, created_at FROM documents
-			WHERE title LIKE ?
-		`, "%"+title+"%")
-	} else {
-		rows, err = db.db.Query(`
-			SELECT id, title, path, content, hash, created_at FROM documents
-		`)
+// DocumentUpdate lists changes to the metadata of a document. Nil fields are
+// left alone; a correspondent or document type ID of 0 removes it.
+type DocumentUpdate struct {
+	CorrespondentID *int
+	DocumentTypeID  *int
+	Fields          map[string]any // see SetDocumentFields
+}
+
+// UpdateDocument applies changes to the metadata of a document in one
+// transaction
+func (db *DB) UpdateDocument(ctx context.Context, id int, update DocumentUpdate) (Document, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := updateDocument(ctx, tx, id, update); err != nil {
+		return Document{}, err
 	}
+	if err := db.commit(tx); err != nil {
+		return Document{}, fmt.Errorf("failed to commit update: %w", err)
+	}
+	return db.GetDocumentByID(ctx, id)
+}
+
+func updateDocument(ctx context.Context, tx *sql.Tx, id int, update DocumentUpdate) error {
+	if err := checkAccess(ctx, tx, id, PermEdit); err != nil {
+		return err
+	}
+	doc, err := scanDocument(tx.QueryRow(`SELECT `+documentColumns+` FROM documents WHERE id = ?`, id))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get documents: %w", err)
+		return fmt.Errorf("failed to get document: %w", err)
 	}
-	defer rows.Close()
 
-	var documents []Document
-	for rows.Next() {
-		var doc Document
-		err = rows.Scan(&doc.ID, &doc.Opts.Title, &doc.Opts.Path, &doc.Opts.Content, &doc.Opts.Hash, &doc.Opts.CreatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan document: %w", err)
+	diff := Diff{}
+	refs := []struct {
+		c       classifier
+		current int
+		value   *int
+	}{
+		{correspondents, doc.CorrespondentID, update.CorrespondentID},
+		{documentTypes, doc.DocumentTypeID, update.DocumentTypeID},
+	}
+	for _, ref := range refs {
+		if ref.value == nil || *ref.value == ref.current {
+			continue
 		}
-		documents = append(documents, doc)
+		if *ref.value != 0 {
+			if _, err := ref.c.get(tx, *ref.value); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					return invalidf(ref.c.column, "unknown %s %d", ref.c.noun, *ref.value)
+				}
+				return err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE documents SET `+ref.c.column+` = ? WHERE id = ?`, nullID(*ref.value), id); err != nil {
+			return fmt.Errorf("failed to update document: %w", err)
+		}
+		diff[ref.c.column] = Change{Old: nilIfZero(ref.current), New: nilIfZero(*ref.value)}
 	}
 
-	return documents, nil
+	if err := setFields(tx, id, update.Fields, diff); err != nil {
+		return err
+	}
+
+	if len(diff) > 0 {
+		return recordEvent(ctx, tx, EntityDocument, id, ActionUpdate, diff)
+	}
+	return nil
+}
+
+// nullID stores the ID 0 as NULL
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// GetDocumentByHash retrieves a document visible to the user in ctx by its
+// file hash. Documents in the trash are included; check DeletedAt to tell
+// them apart.
+func (db *DB) GetDocumentByHash(ctx context.Context, hash string) (Document, error) {
+	filter, args := accessFilter(ctx, PermView)
+	doc, err := scanDocument(db.db.QueryRow(`
+		SELECT `+documentColumns+`
+		FROM documents
+		WHERE hash = ? AND `+filter+`
+		ORDER BY deleted_at IS NOT NULL
+		LIMIT 1
+	`, append([]any{hash}, args...)...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Document{}, notFoundf("document with hash %s not found", hash)
+		}
+		return Document{}, fmt.Errorf("failed to get document: %w", err)
+	}
+	return doc, nil
+}
+
+// DocumentExistsByHash checks if a document or an earlier version of one
+// with the given hash exists in the database. trashed reports whether the
+// only copy is in the trash. Files are stored once, so the check covers the
+// whole library regardless of owner.
+func (db *DB) DocumentExistsByHash(hash string) (exists bool, trashed bool, err error) {
+	var active, deleted int
+	err = db.db.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE deleted_at IS NULL),
+			COUNT(*) FILTER (WHERE deleted_at IS NOT NULL)
+		FROM documents
+		WHERE hash = ? OR id IN (SELECT document_id FROM document_versions WHERE hash = ?)
+	`, hash, hash).Scan(&active, &deleted)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to check document existence: %w", err)
+	}
+	return active+deleted > 0, active == 0 && deleted > 0, nil
+}
+
+// GetDocumentsByTitle returns the documents visible to the user in ctx
+// whose title contains the query or whose notes match it
+func (db *DB) GetDocumentsByTitle(ctx context.Context, title string) ([]Document, error) {
+	return db.FindDocuments(ctx, DocumentQuery{Search: title})
 }
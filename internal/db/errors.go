@@ -0,0 +1,45 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors callers can act on, to be checked with errors.Is
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("validation failed")
+	ErrForbidden  = errors.New("permission denied")
+)
+
+// Error is an error of one of the kinds above. Its message is meant for
+// the client and names what was not found, conflicted or is invalid.
+type Error struct {
+	Kind    error  // ErrNotFound, ErrConflict, ErrValidation or ErrForbidden
+	Code    string // machine readable code, empty for the default of Kind
+	Field   string // input the error is about, for validation errors
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Unwrap() error { return e.Kind }
+
+func notFoundf(format string, args ...any) error {
+	return &Error{Kind: ErrNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func conflictf(format string, args ...any) error {
+	return &Error{Kind: ErrConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func forbiddenf(format string, args ...any) error {
+	return &Error{Kind: ErrForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+// invalidf reports invalid input. field names the input at fault and may
+// be empty when no single input is to blame.
+func invalidf(field, format string, args ...any) error {
+	return &Error{Kind: ErrValidation, Field: field, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorKinds(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	bob := newTestUser(t, database, "bob")
+	asAlice := WithUser(context.Background(), alice)
+	asBob := WithUser(context.Background(), bob)
+
+	tag, err := database.NewTag(asAlice, "bills", "#000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.NewTag(asAlice, "bills", "#000000"); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate tag: expected conflict, got %v", err)
+	}
+	if _, err := database.GetTagByID(999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing tag: expected not found, got %v", err)
+	}
+
+	child, err := database.NewChildTag(asAlice, tag.ID, "power", "#000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.SetTagParent(asAlice, tag.ID, child.ID)
+	var dbErr *Error
+	if !errors.Is(err, ErrValidation) || !errors.As(err, &dbErr) || dbErr.Field != "parent_id" {
+		t.Errorf("tag cycle: expected invalid parent_id, got %v", err)
+	}
+
+	_, err = database.NewCustomField(asAlice, CustomField{Name: "amount", Type: "weight"})
+	if !errors.Is(err, ErrValidation) || !errors.As(err, &dbErr) || dbErr.Field != "type" {
+		t.Errorf("field type: expected invalid type, got %v", err)
+	}
+
+	doc, err := database.NewDocument(asAlice, DocumentOptions{Title: "March", Path: "../pdf/testdata/test1.pdf", Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.GetDocumentByID(asBob, doc.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("hidden document: expected not found, got %v", err)
+	}
+	if _, err := database.SetGrant(asAlice, doc.ID, &bob.ID, nil, PermView); err != nil {
+		t.Fatal(err)
+	}
+	note, err := database.NewNote(asAlice, doc.ID, "paid", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.UpdateNote(asBob, doc.ID, note.ID, "unpaid"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("foreign note: expected forbidden, got %v", err)
+	}
+
+	if !errors.Is(ErrDuplicate, ErrConflict) || !errors.Is(ErrInTrash, ErrConflict) {
+		t.Errorf("expected duplicate files to be conflicts")
+	}
+}
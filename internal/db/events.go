@@ -0,0 +1,74 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/Ardelean-Calin/cellulose/internal/events"
+)
+
+// eventHistory is how many events the bus keeps for clients that reconnect
+const eventHistory = 1000
+
+// Events returns the bus on which committed changes are published. Every
+// audit event becomes an event of type "<entity>.<action>" carrying the
+// AuditEvent.
+func (db *DB) Events() *events.Bus {
+	return db.events
+}
+
+func (db *DB) initEvents() {
+	db.events = events.New(eventHistory)
+	db.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM audit_events`).Scan(&db.published)
+}
+
+// commit commits tx and publishes the audit events it recorded
+func (db *DB) commit(tx *sql.Tx) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := db.publish(); err != nil {
+		// The change itself went through, only listeners miss it
+		log.Printf("Failed to publish events: %v\n", err)
+	}
+	return nil
+}
+
+// publish sends the audit events recorded since the last call to the bus.
+// Writers are serialized by SQLite, so IDs follow the order of commits.
+func (db *DB) publish() error {
+	db.publishMu.Lock()
+	defer db.publishMu.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT `+auditColumns+` FROM audit_events WHERE id > ? ORDER BY id
+	`, db.published)
+	if err != nil {
+		return fmt.Errorf("failed to get audit events: %w", err)
+	}
+	defer rows.Close()
+	audit, err := scanAuditEvents(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range audit {
+		db.published = a.ID
+		e := events.Event{Type: a.Entity + "." + a.Action, Data: a}
+		switch {
+		case a.Entity != EntityDocument:
+		case a.Action == ActionDelete:
+			// The document is gone and nobody can be checked for access
+			// anymore, so only whoever deleted it is told
+			if a.ActorID == nil {
+				continue
+			}
+			e.UserID = *a.ActorID
+		default:
+			e.DocumentID = a.EntityID
+		}
+		db.events.Publish(e)
+	}
+	return nil
+}
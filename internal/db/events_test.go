@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublishEvents(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	ctx := WithUser(context.Background(), alice)
+	sub, _, _ := database.Events().Subscribe(0)
+	defer sub.Close()
+
+	tag, err := database.NewTag(ctx, "invoice", "#ff0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RemoveDocument deletes the file, so work on a copy
+	data, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test1.pdf")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.NewDocument(ctx, DocumentOptions{Title: "March", Path: path, Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := <-sub.C
+	if e.Type != "tag.create" || e.DocumentID != 0 || e.Data.(AuditEvent).EntityID != tag.ID {
+		t.Errorf("unexpected tag event %+v", e)
+	}
+	e = <-sub.C
+	if e.Type != "document.create" || e.DocumentID != doc.ID {
+		t.Errorf("unexpected document event %+v", e)
+	}
+
+	// Rolled back changes are not published
+	if _, err := database.ApplyBulk(ctx, []int{doc.ID, 999}, BulkAction{Action: BulkAddTags, TagIDs: []int{tag.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.RemoveDocument(ctx, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	e = <-sub.C
+	if e.Type != "document.delete" || e.UserID != alice.ID || e.DocumentID != 0 {
+		t.Errorf("unexpected delete event %+v", e)
+	}
+}
@@ -0,0 +1,494 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of custom fields
+const (
+	FieldString   = "string"
+	FieldInteger  = "integer"
+	FieldMonetary = "monetary"
+	FieldDate     = "date"
+	FieldBoolean  = "boolean"
+	FieldURL      = "url"
+	FieldSelect   = "select"
+)
+
+// CustomField is a user-defined metadata field documents can have a value for
+type CustomField struct {
+	ID       int
+	Name     string
+	Type     string
+	Currency string   // default currency of monetary fields
+	Options  []string // allowed values of select fields
+}
+
+// FieldValue is the value a document has for a custom field. Value is a
+// string, except for integer (int64) and boolean (bool) fields. Monetary
+// values are formatted as "EUR12.50" and dates as "2006-01-02".
+type FieldValue struct {
+	FieldID int
+	Name    string
+	Type    string
+	Value   any
+}
+
+// fieldNamePattern keeps field names usable in filter expressions
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_ .-]*$`)
+
+var (
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	monetaryPattern = regexp.MustCompile(`^([A-Z]{3})?(-?)(\d+)(?:\.(\d{1,2}))?$`)
+)
+
+func (db *DB) initFields() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS custom_fields (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			type TEXT NOT NULL,
+			currency TEXT NOT NULL DEFAULT '',
+			options TEXT NOT NULL DEFAULT '[]' -- JSON array of select options
+		)
+	`)
+
+	// value has no declared type and thus no affinity: it holds an INTEGER
+	// for integer, boolean and monetary (minor units) fields and TEXT
+	// otherwise, so that comparisons and sorting work in SQL
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS document_fields (
+			document_id INTEGER NOT NULL REFERENCES documents (id) ON DELETE CASCADE,
+			field_id INTEGER NOT NULL REFERENCES custom_fields (id) ON DELETE CASCADE,
+			value NOT NULL,
+			currency TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (document_id, field_id)
+		)
+	`)
+	db.db.Exec(`CREATE INDEX IF NOT EXISTS document_fields_value ON document_fields (field_id, value)`)
+}
+
+// NewCustomField defines a custom field
+func (db *DB) NewCustomField(ctx context.Context, field CustomField) (CustomField, error) {
+	field.Name = strings.TrimSpace(field.Name)
+	if !fieldNamePattern.MatchString(field.Name) {
+		return CustomField{}, invalidf("name", "invalid field name %q: use letters, digits, spaces and _ . -", field.Name)
+	}
+	switch field.Type {
+	case FieldString, FieldInteger, FieldDate, FieldBoolean, FieldURL:
+	case FieldMonetary:
+		if field.Currency != "" && !currencyPattern.MatchString(field.Currency) {
+			return CustomField{}, invalidf("currency", "invalid currency %q: use an ISO 4217 code", field.Currency)
+		}
+	case FieldSelect:
+		if len(field.Options) == 0 {
+			return CustomField{}, invalidf("options", "select fields need at least one option")
+		}
+	default:
+		return CustomField{}, invalidf("type", "invalid field type %q", field.Type)
+	}
+	if field.Type != FieldMonetary {
+		field.Currency = ""
+	}
+	if field.Type != FieldSelect || field.Options == nil {
+		field.Options = []string{}
+	}
+	options, err := json.Marshal(field.Options)
+	if err != nil {
+		return CustomField{}, fmt.Errorf("failed to encode options: %w", err)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return CustomField{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM custom_fields WHERE name = ?)`, field.Name).Scan(&exists); err != nil {
+		return CustomField{}, fmt.Errorf("failed to check for existing field: %w", err)
+	}
+	if exists {
+		return CustomField{}, conflictf("field with name %s already exists", field.Name)
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO custom_fields (name, type, currency, options) VALUES (?, ?, ?, ?)
+	`, field.Name, field.Type, field.Currency, string(options))
+	if err != nil {
+		return CustomField{}, fmt.Errorf("failed to create field: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return CustomField{}, fmt.Errorf("failed to get field ID: %w", err)
+	}
+	field.ID = int(id)
+
+	err = recordEvent(ctx, tx, EntityField, field.ID, ActionCreate, Diff{
+		"name": {New: field.Name},
+		"type": {New: field.Type},
+	})
+	if err != nil {
+		return CustomField{}, err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return CustomField{}, fmt.Errorf("failed to commit field: %w", err)
+	}
+	return field, nil
+}
+
+const fieldColumns = `custom_fields.id, custom_fields.name, custom_fields.type, custom_fields.currency, custom_fields.options`
+
+func scanField(row rowScanner) (CustomField, error) {
+	var (
+		f       CustomField
+		options string
+	)
+	if err := row.Scan(&f.ID, &f.Name, &f.Type, &f.Currency, &options); err != nil {
+		return CustomField{}, err
+	}
+	if err := json.Unmarshal([]byte(options), &f.Options); err != nil {
+		return CustomField{}, fmt.Errorf("failed to decode options of field %d: %w", f.ID, err)
+	}
+	return f, nil
+}
+
+// GetCustomFields returns all custom field definitions ordered by name
+func (db *DB) GetCustomFields() ([]CustomField, error) {
+	rows, err := db.db.Query(`SELECT ` + fieldColumns + ` FROM custom_fields ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fields: %w", err)
+	}
+	defer rows.Close()
+
+	fields := []CustomField{}
+	for rows.Next() {
+		f, err := scanField(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan field row: %w", err)
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// GetCustomFieldByID returns the definition of a custom field
+func (db *DB) GetCustomFieldByID(id int) (CustomField, error) {
+	return getField(db.db, `custom_fields.id = ?`, id)
+}
+
+// GetCustomFieldByName returns the definition of a custom field
+func (db *DB) GetCustomFieldByName(name string) (CustomField, error) {
+	return getField(db.db, `custom_fields.name = ?`, name)
+}
+
+func getField(q querier, cond string, key any) (CustomField, error) {
+	f, err := scanField(q.QueryRow(`SELECT `+fieldColumns+` FROM custom_fields WHERE `+cond, key))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return CustomField{}, notFoundf("field %v not found", key)
+		}
+		return CustomField{}, fmt.Errorf("failed to get field: %w", err)
+	}
+	return f, nil
+}
+
+// RemoveCustomField deletes a custom field together with the values
+// documents have for it
+func (db *DB) RemoveCustomField(ctx context.Context, id int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	field, err := getField(tx, `custom_fields.id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM document_fields WHERE field_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove field values: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM custom_fields WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove field: %w", err)
+	}
+
+	err = recordEvent(ctx, tx, EntityField, id, ActionDelete, Diff{
+		"name": {Old: field.Name},
+		"type": {Old: field.Type},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit field removal: %w", err)
+	}
+	return nil
+}
+
+// SetDocumentFields sets the custom field values of a document, keyed by
+// field name. A nil value removes the field from the document. Values are
+// given in the form FieldValue uses, numbers and booleans may also be
+// strings.
+func (db *DB) SetDocumentFields(ctx context.Context, id int, values map[string]any) (Document, error) {
+	return db.UpdateDocument(ctx, id, DocumentUpdate{Fields: values})
+}
+
+// setFields applies custom field values as described for SetDocumentFields
+// and adds the changes to diff
+func setFields(tx *sql.Tx, id int, values map[string]any, diff Diff) error {
+	current, err := documentFields(tx, []int{id})
+	if err != nil {
+		return err
+	}
+	old := make(map[string]any)
+	for _, v := range current[id] {
+		old[v.Name] = v.Value
+	}
+
+	// Apply in a stable order so errors are deterministic
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field, err := getField(tx, `custom_fields.name = ?`, name)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return invalidf(name, "unknown field %s", name)
+			}
+			return err
+		}
+
+		if values[name] == nil {
+			if _, ok := old[name]; !ok {
+				continue
+			}
+			if _, err := tx.Exec(`DELETE FROM document_fields WHERE document_id = ? AND field_id = ?`, id, field.ID); err != nil {
+				return fmt.Errorf("failed to remove field value: %w", err)
+			}
+			diff["fields."+name] = Change{Old: old[name]}
+			continue
+		}
+
+		value, currency, err := field.parse(values[name])
+		if err != nil {
+			return err
+		}
+		formatted := field.format(value, currency)
+		if prev, ok := old[name]; ok && prev == formatted {
+			continue
+		}
+		_, err = tx.Exec(`
+			INSERT INTO document_fields (document_id, field_id, value, currency) VALUES (?, ?, ?, ?)
+			ON CONFLICT (document_id, field_id) DO UPDATE SET value = excluded.value, currency = excluded.currency
+		`, id, field.ID, value, currency)
+		if err != nil {
+			return fmt.Errorf("failed to set field value: %w", err)
+		}
+		diff["fields."+name] = Change{Old: old[name], New: formatted}
+	}
+	return nil
+}
+
+// parse validates a value for the field and converts it to its stored form
+func (f CustomField) parse(v any) (value any, currency string, err error) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = strings.TrimSpace(v)
+	case bool:
+		s = strconv.FormatBool(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		s = strconv.Itoa(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case json.Number:
+		s = v.String()
+	default:
+		return nil, "", invalidf(f.Name, "invalid value for field %s: unsupported type %T", f.Name, v)
+	}
+	invalid := func(format string) error {
+		return invalidf(f.Name, "invalid value for field %s: %q is not %s", f.Name, s, format)
+	}
+
+	switch f.Type {
+	case FieldString:
+		return s, "", nil
+	case FieldInteger:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, "", invalid("an integer")
+		}
+		return n, "", nil
+	case FieldMonetary:
+		m := monetaryPattern.FindStringSubmatch(s)
+		if m == nil {
+			return nil, "", invalid("an amount like EUR12.50")
+		}
+		units, err := strconv.ParseInt(m[3], 10, 64)
+		if err != nil {
+			return nil, "", invalid("an amount like EUR12.50")
+		}
+		cents, _ := strconv.ParseInt((m[4] + "00")[:2], 10, 64)
+		amount := units*100 + cents
+		if m[2] == "-" {
+			amount = -amount
+		}
+		currency = m[1]
+		if currency == "" {
+			currency = f.Currency
+		}
+		return amount, currency, nil
+	case FieldDate:
+		if _, err := time.Parse(time.DateOnly, s); err != nil {
+			return nil, "", invalid("a date like 2006-01-02")
+		}
+		return s, "", nil
+	case FieldBoolean:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, "", invalid("true or false")
+		}
+		if b {
+			return int64(1), "", nil
+		}
+		return int64(0), "", nil
+	case FieldURL:
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, "", invalid("an http or https URL")
+		}
+		return s, "", nil
+	case FieldSelect:
+		for _, option := range f.Options {
+			if s == option {
+				return s, "", nil
+			}
+		}
+		return nil, "", invalid("one of " + strings.Join(f.Options, ", "))
+	}
+	return nil, "", fmt.Errorf("field %s has unknown type %s", f.Name, f.Type)
+}
+
+// format turns a stored value into the form used by FieldValue
+func (f CustomField) format(value any, currency string) any {
+	switch f.Type {
+	case FieldInteger:
+		return toInt64(value)
+	case FieldBoolean:
+		return toInt64(value) != 0
+	case FieldMonetary:
+		amount := toInt64(value)
+		sign := ""
+		if amount < 0 {
+			sign, amount = "-", -amount
+		}
+		return fmt.Sprintf("%s%s%d.%02d", currency, sign, amount/100, amount%100)
+	}
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+func toInt64(v any) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// documentFields returns the field values of the given documents, ordered by
+// field name
+func documentFields(q querier, ids []int) (map[int][]FieldValue, error) {
+	values := make(map[int][]FieldValue)
+	// Stay well below SQLite's limit on host parameters
+	for start := 0; start < len(ids); start += 500 {
+		chunk := ids[start:min(start+500, len(ids))]
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		rows, err := q.Query(`
+			SELECT document_fields.document_id, document_fields.value, document_fields.currency, `+fieldColumns+`
+			FROM document_fields JOIN custom_fields ON custom_fields.id = document_fields.field_id
+			WHERE document_fields.document_id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)
+			ORDER BY custom_fields.name
+		`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get field values: %w", err)
+		}
+		for rows.Next() {
+			var (
+				docID    int
+				value    any
+				currency string
+				f        CustomField
+				options  string
+			)
+			if err := rows.Scan(&docID, &value, &currency, &f.ID, &f.Name, &f.Type, &f.Currency, &options); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan field value: %w", err)
+			}
+			values[docID] = append(values[docID], FieldValue{
+				FieldID: f.ID,
+				Name:    f.Name,
+				Type:    f.Type,
+				Value:   f.format(value, currency),
+			})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to get field values: %w", err)
+		}
+	}
+	return values, nil
+}
+
+// withFields fills in the custom field values of documents
+func (db *DB) withFields(docs []Document) ([]Document, error) {
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	values, err := documentFields(db.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range docs {
+		docs[i].Fields = values[docs[i].ID]
+		if docs[i].Fields == nil {
+			docs[i].Fields = []FieldValue{}
+		}
+	}
+	return docs, nil
+}
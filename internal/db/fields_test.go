@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseFieldFilter(t *testing.T) {
+	tests := map[string]FieldFilter{
+		"amount>100":    {Field: "amount", Op: ">", Value: "100"},
+		"amount >= 100": {Field: "amount", Op: ">=", Value: "100"},
+		"paid!=true":    {Field: "paid", Op: "!=", Value: "true"},
+		"iban~DE":       {Field: "iban", Op: "~", Value: "DE"},
+		"due date":      {Field: "due date"},
+	}
+	for expr, want := range tests {
+		got, err := ParseFieldFilter(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+		} else if got != want {
+			t.Errorf("%s: got %+v, want %+v", expr, got, want)
+		}
+	}
+	if _, err := ParseFieldFilter("amount!100"); err == nil {
+		t.Errorf("expected an error for an unknown operator")
+	}
+}
+
+func TestCustomFields(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	ctx := WithUser(context.Background(), alice)
+
+	for _, f := range []CustomField{
+		{Name: "amount", Type: FieldMonetary, Currency: "EUR"},
+		{Name: "due", Type: FieldDate},
+		{Name: "paid", Type: FieldBoolean},
+		{Name: "kind", Type: FieldSelect, Options: []string{"rent", "power"}},
+	} {
+		if _, err := database.NewCustomField(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.NewCustomField(ctx, CustomField{Name: "amount", Type: FieldInteger}); err == nil {
+		t.Errorf("expected duplicate field name to fail")
+	}
+	if _, err := database.NewCustomField(ctx, CustomField{Name: "a>b", Type: FieldString}); err == nil {
+		t.Errorf("expected field name with an operator to fail")
+	}
+
+	values := []map[string]any{
+		{"amount": "12.5", "due": "2025-03-01", "paid": true, "kind": "rent"},
+		{"amount": "USD250", "due": "2025-01-15", "paid": "false"},
+		{"amount": 99.99, "kind": "power"},
+	}
+	var ids []int
+	for i, v := range values {
+		doc, err := database.NewDocument(ctx, DocumentOptions{
+			Title: fmt.Sprintf("doc%d", i),
+			Path:  "../pdf/testdata/test1.pdf",
+			Hash:  fmt.Sprint(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err = database.SetDocumentFields(ctx, doc.ID, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+
+	doc, err := database.GetDocumentByID(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]any)
+	for _, v := range doc.Fields {
+		got[v.Name] = v.Value
+	}
+	if got["amount"] != "EUR12.50" || got["due"] != "2025-03-01" || got["paid"] != true || got["kind"] != "rent" {
+		t.Errorf("unexpected field values %v", got)
+	}
+
+	for _, v := range []map[string]any{
+		{"amount": "12,50"},
+		{"due": "March"},
+		{"kind": "water"},
+		{"missing": "x"},
+	} {
+		if _, err := database.SetDocumentFields(ctx, ids[0], v); err == nil {
+			t.Errorf("expected %v to be rejected", v)
+		}
+	}
+
+	find := func(q DocumentQuery) []int {
+		t.Helper()
+		docs, err := database.FindDocuments(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []int
+		for _, d := range docs {
+			found = append(found, d.ID)
+		}
+		return found
+	}
+	filter := func(exprs ...string) DocumentQuery {
+		var q DocumentQuery
+		for _, e := range exprs {
+			f, err := ParseFieldFilter(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Fields = append(q.Fields, f)
+		}
+		return q
+	}
+
+	tests := []struct {
+		query DocumentQuery
+		want  []int
+	}{
+		{filter("amount>100"), []int{ids[1]}},
+		{filter("amount>EUR10"), []int{ids[0], ids[2]}},
+		{filter("paid=false"), []int{ids[1]}},
+		{filter("due<2025-02-01"), []int{ids[1]}},
+		{filter("kind"), []int{ids[0], ids[2]}},
+		{filter("kind", "amount<50"), []int{ids[0]}},
+		{DocumentQuery{Sort: "-amount"}, []int{ids[1], ids[2], ids[0]}},
+		{DocumentQuery{Sort: "due"}, []int{ids[1], ids[0], ids[2]}},
+	}
+	for _, tt := range tests {
+		if got := find(tt.query); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	if _, err := database.FindDocuments(ctx, filter("paid>true")); err == nil || !strings.HasPrefix(err.Error(), "invalid") {
+		t.Errorf("expected ordering on a boolean to be rejected, got %v", err)
+	}
+
+	// A null value removes the field
+	doc, err = database.SetDocumentFields(ctx, ids[2], map[string]any{"kind": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Fields) != 1 {
+		t.Errorf("expected one field left, got %+v", doc.Fields)
+	}
+}
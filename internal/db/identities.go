@@ -0,0 +1,90 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (db *DB) initIdentities() {
+	// Accounts provisioned through single sign-on are linked to the subject
+	// of the identity provider, never to a username, so a provider can't
+	// take over a local account with the same name.
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (issuer, subject)
+		)
+	`)
+}
+
+// LoginExternalUser returns the account linked to an identity of an external
+// provider, creating it on first login. The account has no password, so it
+// can only log in through the provider. When syncRole is set the role of an
+// existing account is updated to role.
+func (db *DB) LoginExternalUser(issuer, subject, username, role string, syncRole bool) (User, error) {
+	if role != RoleAdmin && role != RoleUser {
+		return User{}, invalidf("role", "invalid role %s", role)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return User{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var u User
+	err = tx.QueryRow(`
+		SELECT users.id, users.username, users.role, users.created_at
+		FROM user_identities JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = ? AND user_identities.subject = ?
+	`, issuer, subject).Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt)
+	switch {
+	case err == nil:
+		if syncRole && u.Role != role {
+			if _, err := tx.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, u.ID); err != nil {
+				return User{}, fmt.Errorf("failed to update role: %w", err)
+			}
+			u.Role = role
+		}
+	case err == sql.ErrNoRows:
+		username = strings.TrimSpace(username)
+		if username == "" {
+			return User{}, invalidf("username", "username is required")
+		}
+		u = User{Username: username, Role: role, CreatedAt: time.Now().UTC()}
+		// An empty hash never matches a password
+		result, err := tx.Exec(`
+			INSERT INTO users (username, password_hash, role, created_at) VALUES (?, '', ?, ?)
+		`, u.Username, u.Role, u.CreatedAt)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				return User{}, conflictf("user with name %s already exists", username)
+			}
+			return User{}, fmt.Errorf("failed to add user: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return User{}, fmt.Errorf("failed to get user ID: %w", err)
+		}
+		u.ID = int(id)
+
+		_, err = tx.Exec(`
+			INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)
+		`, issuer, subject, u.ID, u.CreatedAt)
+		if err != nil {
+			return User{}, fmt.Errorf("failed to link identity: %w", err)
+		}
+	default:
+		return User{}, fmt.Errorf("failed to get identity: %w", err)
+	}
+
+	if err := db.commit(tx); err != nil {
+		return User{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return u, nil
+}
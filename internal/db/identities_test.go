@@ -0,0 +1,32 @@
+package db
+
+import "testing"
+
+func TestLoginExternalUser(t *testing.T) {
+	database := newTestDB(t)
+	newTestUser(t, database, "bob")
+
+	u, err := database.LoginExternalUser("https://id.test", "42", "alice", RoleUser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next login finds the same account, even under a new name
+	again, err := database.LoginExternalUser("https://id.test", "42", "alice.smith", RoleAdmin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != u.ID || again.Username != "alice" || again.Role != RoleAdmin {
+		t.Errorf("unexpected account %+v for %+v", again, u)
+	}
+
+	// Provisioned accounts can't log in with a password
+	if _, err := database.Authenticate("alice", ""); err == nil {
+		t.Errorf("external account accepted an empty password")
+	}
+
+	// An identity never takes over a local account of the same name
+	if _, err := database.LoginExternalUser("https://id.test", "43", "bob", RoleUser, false); err == nil {
+		t.Errorf("external identity was linked to a local account")
+	}
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Note is a Markdown comment attached to a document
+type Note struct {
+	ID         int
+	DocumentID int
+	AuthorID   *int   // nil once the author's account is deleted
+	Author     string // username of the author
+	Body       string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (db *DB) initNotes() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS notes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document_id INTEGER NOT NULL REFERENCES documents (id) ON DELETE CASCADE,
+			author_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+			body TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`)
+	db.db.Exec(`CREATE INDEX IF NOT EXISTS notes_document ON notes (document_id)`)
+
+	// Full-text index over the note bodies, kept in sync by triggers
+	db.db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(body, content='notes', content_rowid='id')`)
+	db.db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS notes_fts_insert AFTER INSERT ON notes BEGIN
+			INSERT INTO notes_fts (rowid, body) VALUES (new.id, new.body);
+		END
+	`)
+	db.db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS notes_fts_delete AFTER DELETE ON notes BEGIN
+			INSERT INTO notes_fts (notes_fts, rowid, body) VALUES ('delete', old.id, old.body);
+		END
+	`)
+	db.db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS notes_fts_update AFTER UPDATE OF body ON notes BEGIN
+			INSERT INTO notes_fts (notes_fts, rowid, body) VALUES ('delete', old.id, old.body);
+			INSERT INTO notes_fts (rowid, body) VALUES (new.id, new.body);
+		END
+	`)
+}
+
+const noteColumns = `notes.id, notes.document_id, notes.author_id, COALESCE(users.username, ''),
+	notes.body, notes.created_at, notes.updated_at`
+
+func scanNote(row rowScanner) (Note, error) {
+	var (
+		n        Note
+		authorID sql.NullInt64
+	)
+	err := row.Scan(&n.ID, &n.DocumentID, &authorID, &n.Author, &n.Body, &n.CreatedAt, &n.UpdatedAt)
+	if err != nil {
+		return Note{}, err
+	}
+	if authorID.Valid {
+		id := int(authorID.Int64)
+		n.AuthorID = &id
+	}
+	return n, nil
+}
+
+func getNote(q querier, documentID, id int) (Note, error) {
+	n, err := scanNote(q.QueryRow(`
+		SELECT `+noteColumns+` FROM notes LEFT JOIN users ON users.id = notes.author_id
+		WHERE notes.id = ? AND notes.document_id = ?
+	`, id, documentID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Note{}, notFoundf("note with id %d not found", id)
+		}
+		return Note{}, fmt.Errorf("failed to get note: %w", err)
+	}
+	return n, nil
+}
+
+// NewNote attaches a note written by the user in ctx to a document. Anyone
+// who can see the document may add notes. A zero createdAt means now.
+func (db *DB) NewNote(ctx context.Context, documentID int, body string, createdAt time.Time) (Note, error) {
+	if strings.TrimSpace(body) == "" {
+		return Note{}, invalidf("body", "note body is required")
+	}
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, documentID, PermView); err != nil {
+		return Note{}, err
+	}
+
+	author := ownerID(ctx)
+	result, err := tx.Exec(`
+		INSERT INTO notes (document_id, author_id, body, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+	`, documentID, author, body, createdAt.UTC(), createdAt.UTC())
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to add note: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to get note ID: %w", err)
+	}
+
+	if err := recordEvent(ctx, tx, EntityDocument, documentID, ActionAddNote, Diff{"note": {New: body}}); err != nil {
+		return Note{}, err
+	}
+
+	n, err := getNote(tx, documentID, int(id))
+	if err != nil {
+		return Note{}, err
+	}
+	if err := db.commit(tx); err != nil {
+		return Note{}, fmt.Errorf("failed to commit note: %w", err)
+	}
+	return n, nil
+}
+
+// GetNotes returns the notes of a document the user in ctx may see, oldest
+// first
+func (db *DB) GetNotes(ctx context.Context, documentID int) ([]Note, error) {
+	if err := checkAccess(ctx, db.db, documentID, PermView); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.Query(`
+		SELECT `+noteColumns+` FROM notes LEFT JOIN users ON users.id = notes.author_id
+		WHERE notes.document_id = ? ORDER BY notes.created_at, notes.id
+	`, documentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notes: %w", err)
+	}
+	return scanNotes(rows)
+}
+
+func scanNotes(rows *sql.Rows) ([]Note, error) {
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		n, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note row: %w", err)
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// GetAllNotes returns the notes of every document visible to the user in
+// ctx, including documents in the trash
+func (db *DB) GetAllNotes(ctx context.Context) ([]Note, error) {
+	filter, args := accessFilter(ctx, PermView)
+	rows, err := db.db.Query(`
+		SELECT `+noteColumns+` FROM notes
+		JOIN documents ON documents.id = notes.document_id
+		LEFT JOIN users ON users.id = notes.author_id
+		WHERE `+filter+`
+		ORDER BY notes.document_id, notes.created_at, notes.id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notes: %w", err)
+	}
+	return scanNotes(rows)
+}
+
+// GetNote returns a note of a document the user in ctx may see
+func (db *DB) GetNote(ctx context.Context, documentID, id int) (Note, error) {
+	if err := checkAccess(ctx, db.db, documentID, PermView); err != nil {
+		return Note{}, err
+	}
+	return getNote(db.db, documentID, id)
+}
+
+// UpdateNote replaces the body of a note. Only its author may edit a note.
+func (db *DB) UpdateNote(ctx context.Context, documentID, id int, body string) (Note, error) {
+	if strings.TrimSpace(body) == "" {
+		return Note{}, invalidf("body", "note body is required")
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, documentID, PermView); err != nil {
+		return Note{}, err
+	}
+	old, err := getNote(tx, documentID, id)
+	if err != nil {
+		return Note{}, err
+	}
+	if user, _ := UserFromContext(ctx); old.AuthorID == nil || *old.AuthorID != user.ID {
+		return Note{}, forbiddenf("permission denied: only the author may edit note %d", id)
+	}
+
+	_, err = tx.Exec(`UPDATE notes SET body = ?, updated_at = ? WHERE id = ?`, body, time.Now().UTC(), id)
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to update note: %w", err)
+	}
+	if err := recordEvent(ctx, tx, EntityDocument, documentID, ActionEditNote, Diff{"note": {Old: old.Body, New: body}}); err != nil {
+		return Note{}, err
+	}
+
+	n, err := getNote(tx, documentID, id)
+	if err != nil {
+		return Note{}, err
+	}
+	if err := db.commit(tx); err != nil {
+		return Note{}, fmt.Errorf("failed to commit note: %w", err)
+	}
+	return n, nil
+}
+
+// RemoveNote deletes a note. Its author and the owner of the document may
+// delete a note.
+func (db *DB) RemoveNote(ctx context.Context, documentID, id int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, documentID, PermView); err != nil {
+		return err
+	}
+	old, err := getNote(tx, documentID, id)
+	if err != nil {
+		return err
+	}
+	if user, _ := UserFromContext(ctx); old.AuthorID == nil || *old.AuthorID != user.ID {
+		if err := checkAccess(ctx, tx, documentID, PermOwner); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM notes WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove note: %w", err)
+	}
+	if err := recordEvent(ctx, tx, EntityDocument, documentID, ActionDeleteNote, Diff{"note": {Old: old.Body}}); err != nil {
+		return err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit note removal: %w", err)
+	}
+	return nil
+}
+
+// ftsQuery turns free text into an FTS5 query matching every word as a
+// prefix, so user input can't inject query syntax
+func ftsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotes(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	bob := newTestUser(t, database, "bob")
+	asAlice := WithUser(context.Background(), alice)
+	asBob := WithUser(context.Background(), bob)
+
+	doc, err := database.NewDocument(asAlice, DocumentOptions{
+		Title: "payslip",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.NewNote(asBob, doc.ID, "hello", time.Time{}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found for bob, got %v", err)
+	}
+
+	// Bob may comment once he can see the document
+	if _, err := database.SetGrant(asAlice, doc.ID, &bob.ID, nil, PermView); err != nil {
+		t.Fatal(err)
+	}
+	note, err := database.NewNote(asBob, doc.ID, "Paid by **bank transfer**", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Author != "bob" || note.AuthorID == nil || *note.AuthorID != bob.ID {
+		t.Errorf("unexpected author: %+v", note)
+	}
+
+	if _, err := database.UpdateNote(asAlice, doc.ID, note.ID, "changed"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("alice edited bob's note: %v", err)
+	}
+	if _, err := database.UpdateNote(asBob, doc.ID, note.ID, "Paid in cash"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Search finds the document by its note, but only the current text
+	if docs, _ := database.GetDocumentsByTitle(asAlice, "cash"); len(docs) != 1 {
+		t.Errorf("expected search to find the note, got %d documents", len(docs))
+	}
+	if docs, _ := database.GetDocumentsByTitle(asAlice, "transfer"); len(docs) != 0 {
+		t.Errorf("search found an outdated note")
+	}
+	if docs, _ := database.GetDocumentsByTitle(asAlice, `"cash`); len(docs) != 1 {
+		t.Errorf("expected quotes to be escaped, got %d documents", len(docs))
+	}
+
+	// The document owner may delete notes of others
+	if err := database.RemoveNote(asAlice, doc.ID, note.ID); err != nil {
+		t.Fatal(err)
+	}
+	if notes, _ := database.GetNotes(asBob, doc.ID); len(notes) != 0 {
+		t.Errorf("expected no notes, got %d", len(notes))
+	}
+	if docs, _ := database.GetDocumentsByTitle(asAlice, "cash"); len(docs) != 0 {
+		t.Errorf("search found a deleted note")
+	}
+
+	events, err := database.GetDocumentHistory(asAlice, doc.ID, AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range events {
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions[:3], ","); got != "delete_note,edit_note,add_note" {
+		t.Errorf("unexpected history %s", got)
+	}
+}
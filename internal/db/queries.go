@@ -1 +1,191 @@
 package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// fieldOperators lists the operators of field filters, longest first so
+// that parsing prefers ">=" over ">"
+var fieldOperators = []string{">=", "<=", "!=", "=", ">", "<", "~"}
+
+// FieldFilter compares the value documents have for a custom field. Op is
+// one of =, !=, >, >=, <, <= and ~ (contains, for text fields). An empty Op
+// matches documents that have any value for the field.
+type FieldFilter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// ParseFieldFilter parses filter expressions like "amount>100", "paid=true"
+// or "due" (has a value)
+func ParseFieldFilter(expr string) (FieldFilter, error) {
+	i := strings.IndexAny(expr, "=!<>~")
+	if i < 0 {
+		return FieldFilter{Field: strings.TrimSpace(expr)}, nil
+	}
+	for _, op := range fieldOperators {
+		if strings.HasPrefix(expr[i:], op) {
+			return FieldFilter{
+				Field: strings.TrimSpace(expr[:i]),
+				Op:    op,
+				Value: strings.TrimSpace(expr[i+len(op):]),
+			}, nil
+		}
+	}
+	return FieldFilter{}, invalidf("field", "invalid field filter %q", expr)
+}
+
+// DocumentQuery selects and orders documents. Zero values don't filter.
+type DocumentQuery struct {
+	Search string        // matched against titles and notes
+	Fields []FieldFilter // all of them must match
+	// Only documents with each of these tags or one of its descendants
+	TagIDs []int
+	// Only documents with this correspondent or type, 0 for documents
+	// without one
+	CorrespondentID *int
+	DocumentTypeID  *int
+	// Sort is "id", "title", "created_at" or the name of a custom field,
+	// prefixed with "-" for descending order. Documents without a value for
+	// the sort field come last.
+	Sort string
+}
+
+// FindDocuments returns the documents visible to the user in ctx that match
+// the query
+func (db *DB) FindDocuments(ctx context.Context, q DocumentQuery) ([]Document, error) {
+	filter, args := accessFilter(ctx, PermView)
+	conds := []string{"documents.deleted_at IS NULL", filter}
+
+	if q.Search != "" {
+		match := "documents.title LIKE ?"
+		matchArgs := []any{"%" + q.Search + "%"}
+		if fts := ftsQuery(q.Search); fts != "" {
+			match = `(documents.title LIKE ? OR documents.id IN (
+				SELECT notes.document_id FROM notes_fts JOIN notes ON notes.id = notes_fts.rowid
+				WHERE notes_fts MATCH ?
+			))`
+			matchArgs = append(matchArgs, fts)
+		}
+		conds = append(conds, match)
+		args = append(args, matchArgs...)
+	}
+
+	if q.CorrespondentID != nil {
+		conds = append(conds, "documents.correspondent_id IS ?")
+		args = append(args, nullID(*q.CorrespondentID))
+	}
+	if q.DocumentTypeID != nil {
+		conds = append(conds, "documents.document_type_id IS ?")
+		args = append(args, nullID(*q.DocumentTypeID))
+	}
+
+	for _, tagID := range q.TagIDs {
+		conds = append(conds, `EXISTS (SELECT 1 FROM document_tags
+			WHERE document_tags.document_id = documents.id AND document_tags.tag_id IN (`+tagSubtree+`))`)
+		args = append(args, tagID)
+	}
+
+	for _, f := range q.Fields {
+		cond, condArgs, err := db.fieldCondition(f)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	order, orderArgs, err := db.documentOrder(q.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.Query(`
+		SELECT `+documentColumns+` FROM documents
+		WHERE `+strings.Join(conds, " AND ")+`
+		ORDER BY `+order,
+		append(args, orderArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get documents: %w", err)
+	}
+	docs, err := scanDocuments(rows)
+	if err != nil {
+		return nil, err
+	}
+	return db.withFields(docs)
+}
+
+// fieldCondition translates a field filter into an SQL condition on the
+// documents table
+func (db *DB) fieldCondition(f FieldFilter) (string, []any, error) {
+	field, err := getField(db.db, `custom_fields.name = ?`, f.Field)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return "", nil, invalidf("field", "unknown field %s", f.Field)
+		}
+		return "", nil, err
+	}
+
+	const exists = `EXISTS (SELECT 1 FROM document_fields df
+		WHERE df.document_id = documents.id AND df.field_id = ?`
+	if f.Op == "" {
+		return exists + `)`, []any{field.ID}, nil
+	}
+
+	switch {
+	case f.Op == "~" && field.Type != FieldString && field.Type != FieldURL && field.Type != FieldSelect:
+		return "", nil, invalidf("field", "invalid filter for field %s: ~ only applies to text fields", field.Name)
+	case field.Type == FieldBoolean && f.Op != "=" && f.Op != "!=":
+		return "", nil, invalidf("field", "invalid filter for field %s: use = or != on boolean fields", field.Name)
+	}
+
+	if f.Op == "~" {
+		return exists + ` AND instr(lower(df.value), lower(?)) > 0)`, []any{field.ID, f.Value}, nil
+	}
+
+	// Select fields compare against any text, not only their options
+	if field.Type == FieldSelect {
+		field.Type = FieldString
+	}
+	value, currency, err := field.parse(f.Value)
+	if err != nil {
+		return "", nil, err
+	}
+	cond := exists + ` AND df.value ` + f.Op + ` ?`
+	args := []any{field.ID, value}
+	if m := monetaryPattern.FindStringSubmatch(f.Value); field.Type == FieldMonetary && m[1] != "" {
+		cond += ` AND df.currency = ?`
+		args = append(args, currency)
+	}
+	return cond + `)`, args, nil
+}
+
+// documentOrder translates a sort key into an ORDER BY clause
+func (db *DB) documentOrder(sort string) (string, []any, error) {
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
+		sort = sort[1:]
+	}
+
+	switch sort {
+	case "", "id":
+		return "documents.id " + direction, nil, nil
+	case "title", "created_at":
+		return "documents." + sort + " " + direction + ", documents.id", nil, nil
+	}
+
+	field, err := getField(db.db, `custom_fields.name = ?`, sort)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return "", nil, invalidf("sort", "unknown sort key %s", sort)
+		}
+		return "", nil, err
+	}
+	const value = `(SELECT value FROM document_fields WHERE document_id = documents.id AND field_id = ?)`
+	return value + " IS NULL, " + value + " " + direction + ", documents.id", []any{field.ID, field.ID}, nil
+}
@@ -0,0 +1,350 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How a shared document is presented to the browser
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// Outcomes recorded in the share access log
+const (
+	ShareServed       = "served"
+	ShareBadPassword  = "bad_password"
+	ShareExpired      = "expired"
+	ShareLimitReached = "limit_reached"
+	ShareRevoked      = "revoked"
+)
+
+// Share is a public link to a single document. The token itself is only
+// known when the share is created.
+type Share struct {
+	ID            int
+	DocumentID    int
+	CreatedBy     int
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	HasPassword   bool
+	MaxDownloads  *int
+	DownloadCount int
+	Disposition   string
+	RevokedAt     *time.Time
+}
+
+// Active reports whether the share can still be used
+func (s Share) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt) &&
+		(s.MaxDownloads == nil || s.DownloadCount < *s.MaxDownloads)
+}
+
+// ShareOptions configures a new share
+type ShareOptions struct {
+	ExpiresAt    time.Time
+	Password     string // optional
+	MaxDownloads *int   // optional
+	Disposition  string
+}
+
+// ShareAccess is an entry of the share access log
+type ShareAccess struct {
+	ID         int
+	ShareID    int
+	AccessedAt time.Time
+	RemoteAddr string
+	UserAgent  string
+	Outcome    string
+}
+
+func (db *DB) initShares() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS shares (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document_id INTEGER NOT NULL REFERENCES documents (id) ON DELETE CASCADE,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_by INTEGER REFERENCES users (id) ON DELETE SET NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			password_hash TEXT,
+			max_downloads INTEGER,
+			download_count INTEGER NOT NULL DEFAULT 0,
+			disposition TEXT NOT NULL DEFAULT 'inline',
+			revoked_at DATETIME
+		)
+	`)
+
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS share_accesses (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			share_id INTEGER NOT NULL REFERENCES shares (id) ON DELETE CASCADE,
+			accessed_at DATETIME NOT NULL,
+			remote_addr TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			outcome TEXT NOT NULL
+		)
+	`)
+}
+
+const shareColumns = `shares.id, shares.document_id, shares.created_by, shares.created_at, shares.expires_at,
+	shares.password_hash IS NOT NULL, shares.max_downloads, shares.download_count, shares.disposition, shares.revoked_at`
+
+func scanShare(row rowScanner) (Share, error) {
+	var (
+		s            Share
+		createdBy    sql.NullInt64
+		maxDownloads sql.NullInt64
+		revokedAt    sql.NullTime
+	)
+	err := row.Scan(&s.ID, &s.DocumentID, &createdBy, &s.CreatedAt, &s.ExpiresAt,
+		&s.HasPassword, &maxDownloads, &s.DownloadCount, &s.Disposition, &revokedAt)
+	if err != nil {
+		return Share{}, err
+	}
+	s.CreatedBy = int(createdBy.Int64)
+	if maxDownloads.Valid {
+		n := int(maxDownloads.Int64)
+		s.MaxDownloads = &n
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return s, nil
+}
+
+// NewShare creates a public link to a document owned by the user in ctx and
+// returns it together with its secret token
+func (db *DB) NewShare(ctx context.Context, documentID int, opts ShareOptions) (Share, string, error) {
+	if opts.Disposition == "" {
+		opts.Disposition = DispositionInline
+	}
+	if opts.Disposition != DispositionInline && opts.Disposition != DispositionAttachment {
+		return Share{}, "", invalidf("disposition", "invalid disposition %s", opts.Disposition)
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Share{}, "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, documentID, PermOwner); err != nil {
+		return Share{}, "", err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return Share{}, "", err
+	}
+
+	var passwordHash sql.NullString
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return Share{}, "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		passwordHash = sql.NullString{String: string(hash), Valid: true}
+	}
+
+	s := Share{
+		DocumentID:   documentID,
+		CreatedBy:    int(ownerID(ctx).Int64),
+		CreatedAt:    time.Now().UTC(),
+		ExpiresAt:    opts.ExpiresAt.UTC(),
+		HasPassword:  passwordHash.Valid,
+		MaxDownloads: opts.MaxDownloads,
+		Disposition:  opts.Disposition,
+	}
+	result, err := tx.Exec(`
+		INSERT INTO shares (document_id, token_hash, created_by, created_at, expires_at, password_hash, max_downloads, disposition)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, s.DocumentID, hashToken(token), ownerID(ctx), s.CreatedAt, s.ExpiresAt, passwordHash, s.MaxDownloads, s.Disposition)
+	if err != nil {
+		return Share{}, "", fmt.Errorf("failed to add share: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Share{}, "", fmt.Errorf("failed to get share ID: %w", err)
+	}
+	s.ID = int(id)
+
+	if err := recordEvent(ctx, tx, EntityDocument, documentID, ActionShare, Diff{"share": {New: s}}); err != nil {
+		return Share{}, "", err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return Share{}, "", fmt.Errorf("failed to commit share: %w", err)
+	}
+	return s, token, nil
+}
+
+// GetShares returns the active shares of the documents owned by the user in
+// ctx, or of one document when documentID is not zero
+func (db *DB) GetShares(ctx context.Context, documentID int) ([]Share, error) {
+	filter, args := accessFilter(ctx, PermOwner)
+	query := `
+		SELECT ` + shareColumns + `
+		FROM shares JOIN documents ON documents.id = shares.document_id
+		WHERE shares.revoked_at IS NULL AND ` + filter
+	if documentID != 0 {
+		query += ` AND shares.document_id = ?`
+		args = append(args, documentID)
+	}
+	rows, err := db.db.Query(query+` ORDER BY shares.created_at DESC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shares: %w", err)
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		s, err := scanShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan share row: %w", err)
+		}
+		if s.Active() {
+			shares = append(shares, s)
+		}
+	}
+	return shares, rows.Err()
+}
+
+// RevokeShare disables a share of a document owned by the user in ctx
+func (db *DB) RevokeShare(ctx context.Context, id int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var documentID int
+	err = tx.QueryRow(`SELECT document_id FROM shares WHERE id = ?`, id).Scan(&documentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundf("share with id %d not found", id)
+		}
+		return fmt.Errorf("failed to get share: %w", err)
+	}
+	if err := checkAccess(ctx, tx, documentID, PermOwner); err != nil {
+		return notFoundf("share with id %d not found", id)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE shares SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke share: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	if err := recordEvent(ctx, tx, EntityDocument, documentID, ActionUnshare, Diff{"share": {Old: id}}); err != nil {
+		return err
+	}
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit share revocation: %w", err)
+	}
+	return nil
+}
+
+// GetShareAccesses returns the access log of a share of a document owned by
+// the user in ctx, newest first
+func (db *DB) GetShareAccesses(ctx context.Context, id int) ([]ShareAccess, error) {
+	var documentID int
+	err := db.db.QueryRow(`SELECT document_id FROM shares WHERE id = ?`, id).Scan(&documentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFoundf("share with id %d not found", id)
+		}
+		return nil, fmt.Errorf("failed to get share: %w", err)
+	}
+	if err := checkAccess(ctx, db.db, documentID, PermOwner); err != nil {
+		return nil, notFoundf("share with id %d not found", id)
+	}
+
+	rows, err := db.db.Query(`
+		SELECT id, share_id, accessed_at, remote_addr, user_agent, outcome
+		FROM share_accesses WHERE share_id = ? ORDER BY accessed_at DESC
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share accesses: %w", err)
+	}
+	defer rows.Close()
+
+	accesses := []ShareAccess{}
+	for rows.Next() {
+		var a ShareAccess
+		if err := rows.Scan(&a.ID, &a.ShareID, &a.AccessedAt, &a.RemoteAddr, &a.UserAgent, &a.Outcome); err != nil {
+			return nil, fmt.Errorf("failed to scan share access row: %w", err)
+		}
+		accesses = append(accesses, a)
+	}
+	return accesses, rows.Err()
+}
+
+// ResolveShare looks up the share belonging to a token together with its
+// document. It does not check whether the share may still be used.
+func (db *DB) ResolveShare(token string) (Share, Document, error) {
+	s, err := scanShare(db.db.QueryRow(`
+		SELECT `+shareColumns+` FROM shares WHERE token_hash = ?
+	`, hashToken(token)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Share{}, Document{}, notFoundf("share not found")
+		}
+		return Share{}, Document{}, fmt.Errorf("failed to get share: %w", err)
+	}
+
+	doc, err := db.GetDocumentByID(SystemContext(), s.DocumentID)
+	if err != nil {
+		return Share{}, Document{}, notFoundf("share not found")
+	}
+	return s, doc, nil
+}
+
+// CheckSharePassword reports whether password unlocks the share
+func (db *DB) CheckSharePassword(id int, password string) bool {
+	var hash sql.NullString
+	err := db.db.QueryRow(`SELECT password_hash FROM shares WHERE id = ?`, id).Scan(&hash)
+	if err != nil {
+		return false
+	}
+	if !hash.Valid {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(password)) == nil
+}
+
+// CountShareDownload records a download of the share. It fails when the
+// download limit has been reached meanwhile.
+func (db *DB) CountShareDownload(id int) error {
+	result, err := db.db.Exec(`
+		UPDATE shares SET download_count = download_count + 1
+		WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads)
+	`, id)
+	if err != nil {
+		return fmt.Errorf("failed to count download: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return conflictf("download limit reached")
+	}
+	return nil
+}
+
+// LogShareAccess appends an entry to the access log of a share
+func (db *DB) LogShareAccess(id int, remoteAddr, userAgent, outcome string) error {
+	_, err := db.db.Exec(`
+		INSERT INTO share_accesses (share_id, accessed_at, remote_addr, user_agent, outcome) VALUES (?, ?, ?, ?, ?)
+	`, id, time.Now().UTC(), remoteAddr, userAgent, outcome)
+	if err != nil {
+		return fmt.Errorf("failed to log share access: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShares(t *testing.T) {
+	database := newTestDB(t)
+	alice := newTestUser(t, database, "alice")
+	bob := newTestUser(t, database, "bob")
+	asAlice := WithUser(context.Background(), alice)
+	asBob := WithUser(context.Background(), bob)
+
+	doc, err := database.NewDocument(asAlice, DocumentOptions{
+		Title: "payslip",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limit := 1
+	opts := ShareOptions{ExpiresAt: time.Now().Add(time.Hour), Password: "secret", MaxDownloads: &limit}
+	if _, _, err := database.NewShare(asBob, doc.ID, opts); err == nil {
+		t.Errorf("bob shared a document he cannot see")
+	}
+	share, token, err := database.NewShare(asAlice, doc.ID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, resolvedDoc, err := database.ResolveShare(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.ID != share.ID || resolvedDoc.ID != doc.ID || !resolved.HasPassword {
+		t.Errorf("unexpected share %+v for document %d", resolved, resolvedDoc.ID)
+	}
+	if _, _, err := database.ResolveShare(token + "x"); err == nil {
+		t.Errorf("resolved an unknown token")
+	}
+	if database.CheckSharePassword(share.ID, "wrong") || !database.CheckSharePassword(share.ID, "secret") {
+		t.Errorf("password check failed")
+	}
+
+	// The download limit is enforced
+	if err := database.CountShareDownload(share.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CountShareDownload(share.ID); err == nil {
+		t.Errorf("download limit not enforced")
+	}
+	if shares, _ := database.GetShares(asAlice, doc.ID); len(shares) != 0 {
+		t.Errorf("exhausted share is still listed as active")
+	}
+
+	// Revoked shares are not listed
+	other, _, err := database.NewShare(asAlice, doc.ID, ShareOptions{ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shares, _ := database.GetShares(asAlice, 0); len(shares) != 1 {
+		t.Errorf("expected 1 active share, got %d", len(shares))
+	}
+	if err := database.RevokeShare(asBob, other.ID); err == nil {
+		t.Errorf("bob revoked alice's share")
+	}
+	if err := database.RevokeShare(asAlice, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if shares, _ := database.GetShares(asAlice, 0); len(shares) != 0 {
+		t.Errorf("revoked share is still listed")
+	}
+
+	if err := database.LogShareAccess(share.ID, "127.0.0.1:1234", "test", ShareServed); err != nil {
+		t.Fatal(err)
+	}
+	if accesses, _ := database.GetShareAccesses(asAlice, share.ID); len(accesses) != 1 {
+		t.Errorf("expected 1 logged access, got %d", len(accesses))
+	}
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// statsTTL is how long GetStats serves the same numbers to a user
+const statsTTL = 30 * time.Second
+
+// Stats summarizes the documents visible to a user, not counting the trash
+type Stats struct {
+	Documents      int
+	Untagged       int   // documents without any tag
+	Processing     int   // resumable uploads of the user still receiving data
+	StorageBytes   int64 // current files and earlier versions
+	Tags           []Count
+	Months         []Count // by month of creation, Name is like "2025-03"
+	Correspondents []Count
+	DocumentTypes  []Count
+}
+
+// Count is the number of documents in a group. ID is 0 for groups that are
+// not stored entities, like months.
+type Count struct {
+	ID        int
+	Name      string
+	Documents int
+}
+
+// statsCache holds recently computed stats per user and access
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[statsKey]cachedStats
+}
+
+// statsKey tells apart the views of an administrator with and without the
+// admin scope, see accessFilter
+type statsKey struct {
+	userID int
+	all    bool
+}
+
+type cachedStats struct {
+	stats Stats
+	at    time.Time
+}
+
+func (db *DB) initStats() {
+	db.db.Exec(`ALTER TABLE documents ADD COLUMN size INTEGER`)
+	db.db.Exec(`ALTER TABLE document_versions ADD COLUMN size INTEGER`)
+
+	db.fillSizes("documents")
+	db.fillSizes("document_versions")
+}
+
+// fillSizes records the file sizes of rows stored before sizes were tracked.
+// Rows whose file can't be read are retried on the next start.
+func (db *DB) fillSizes(table string) {
+	rows, err := db.db.Query(`SELECT id, path FROM ` + table + ` WHERE size IS NULL`)
+	if err != nil {
+		return
+	}
+	paths := make(map[int]string)
+	for rows.Next() {
+		var (
+			id   int
+			path string
+		)
+		if rows.Scan(&id, &path) == nil {
+			paths[id] = path
+		}
+	}
+	rows.Close()
+
+	for id, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		db.db.Exec(`UPDATE `+table+` SET size = ? WHERE id = ?`, info.Size(), id)
+	}
+}
+
+// GetStats returns the stats of the documents visible to the user in ctx.
+// The numbers are computed at most once every statsTTL per user and scope.
+func (db *DB) GetStats(ctx context.Context) (Stats, error) {
+	user, _ := UserFromContext(ctx)
+	key := statsKey{userID: user.ID, all: user.IsAdmin() && HasScope(ctx, ScopeAdmin)}
+
+	db.stats.mu.Lock()
+	defer db.stats.mu.Unlock()
+	if c, ok := db.stats.entries[key]; ok && time.Since(c.at) < statsTTL {
+		return c.stats, nil
+	}
+
+	stats, err := db.computeStats(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	if db.stats.entries == nil {
+		db.stats.entries = make(map[statsKey]cachedStats)
+	}
+	db.stats.entries[key] = cachedStats{stats: stats, at: time.Now()}
+	return stats, nil
+}
+
+func (db *DB) computeStats(ctx context.Context) (Stats, error) {
+	filter, args := accessFilter(ctx, PermView)
+	visible := `documents.deleted_at IS NULL AND ` + filter
+
+	var stats Stats
+	err := db.db.QueryRow(`
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(NOT EXISTS (SELECT 1 FROM document_tags WHERE document_tags.document_id = documents.id)), 0),
+			(SELECT COUNT(*) FROM uploads WHERE user_id IS ? AND expires_at > ?),
+			COALESCE(SUM(documents.size), 0) + COALESCE((
+				SELECT SUM(document_versions.size) FROM document_versions
+				JOIN documents ON documents.id = document_versions.document_id
+				WHERE `+visible+`
+			), 0)
+		FROM documents WHERE `+visible,
+		append(append([]any{ownerID(ctx), time.Now().UTC()}, args...), args...)...,
+	).Scan(&stats.Documents, &stats.Untagged, &stats.Processing, &stats.StorageBytes)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to count documents: %w", err)
+	}
+
+	if stats.Tags, err = db.countTags(ctx); err != nil {
+		return Stats{}, err
+	}
+
+	stats.Months, err = scanCounts(db.db.Query(`
+		SELECT 0, substr(documents.created_at, 1, 7) AS month, COUNT(*) FROM documents
+		WHERE `+visible+` GROUP BY month ORDER BY month
+	`, args...))
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to count documents by month: %w", err)
+	}
+
+	for _, c := range []struct {
+		classifier
+		counts *[]Count
+	}{
+		{correspondents, &stats.Correspondents},
+		{documentTypes, &stats.DocumentTypes},
+	} {
+		*c.counts, err = scanCounts(db.db.Query(`
+			SELECT `+c.table+`.id, `+c.table+`.name, COUNT(documents.id) FROM `+c.table+`
+			LEFT JOIN documents ON documents.`+c.column+` = `+c.table+`.id AND `+visible+`
+			GROUP BY `+c.table+`.id ORDER BY `+c.table+`.name
+		`, args...))
+		if err != nil {
+			return Stats{}, fmt.Errorf("failed to count documents by %s: %w", c.noun, err)
+		}
+	}
+
+	return stats, nil
+}
+
+// GetTagCounts returns the number of documents visible to the user in ctx
+// per tag ID. Only direct assignments count, not those of descendants.
+func (db *DB) GetTagCounts(ctx context.Context) (map[int]int, error) {
+	counts, err := db.countTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]int, len(counts))
+	for _, c := range counts {
+		byID[c.ID] = c.Documents
+	}
+	return byID, nil
+}
+
+func (db *DB) countTags(ctx context.Context) ([]Count, error) {
+	filter, args := accessFilter(ctx, PermView)
+	counts, err := scanCounts(db.db.Query(`
+		SELECT tags.id, tags.name, COUNT(documents.id) FROM tags
+		LEFT JOIN document_tags ON document_tags.tag_id = tags.id
+		LEFT JOIN documents ON documents.id = document_tags.document_id
+			AND documents.deleted_at IS NULL AND `+filter+`
+		GROUP BY tags.id ORDER BY tags.name
+	`, args...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count documents by tag: %w", err)
+	}
+	return counts, nil
+}
+
+// scanCounts reads rows of ID, name and count
+func scanCounts(rows *sql.Rows, err error) ([]Count, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []Count{}
+	for rows.Next() {
+		var c Count
+		if err := rows.Scan(&c.ID, &c.Name, &c.Documents); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
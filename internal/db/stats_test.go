@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	database := newTestDB(t)
+	alice := WithUser(context.Background(), newTestUser(t, database, "alice"))
+	bob := WithUser(context.Background(), newTestUser(t, database, "bob"))
+
+	info, err := os.Stat("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := database.NewTag(alice, "invoice", "#ff0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := database.NewCorrespondent(alice, "ACME", MatchRule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	march, err := database.NewDocument(alice, DocumentOptions{
+		Title:           "March",
+		Path:            "../pdf/testdata/test1.pdf",
+		Hash:            "1",
+		Tags:            []string{"invoice"},
+		CorrespondentID: acme.ID,
+		CreatedAt:       time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if march.Size != info.Size() {
+		t.Errorf("unexpected size: %+v", march)
+	}
+	if _, err := database.NewDocument(alice, DocumentOptions{
+		Title:     "April",
+		Path:      "../pdf/testdata/test1.pdf",
+		Hash:      "2",
+		CreatedAt: time.Date(2025, 4, 2, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := database.GetStats(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 2 || stats.Untagged != 1 || stats.Processing != 0 || stats.StorageBytes != 2*info.Size() {
+		t.Errorf("unexpected totals %+v", stats)
+	}
+	if len(stats.Tags) != 1 || stats.Tags[0] != (Count{ID: tag.ID, Name: "invoice", Documents: 1}) {
+		t.Errorf("unexpected tag counts %+v", stats.Tags)
+	}
+	if len(stats.Months) != 2 || stats.Months[0] != (Count{Name: "2025-03", Documents: 1}) {
+		t.Errorf("unexpected month counts %+v", stats.Months)
+	}
+	if len(stats.Correspondents) != 1 || stats.Correspondents[0].Documents != 1 || len(stats.DocumentTypes) != 0 {
+		t.Errorf("unexpected classifier counts %+v %+v", stats.Correspondents, stats.DocumentTypes)
+	}
+
+	// Other users only count their own documents and uploads
+	if _, err := database.NewUpload(bob, Upload{Filename: "scan.pdf", Length: 10, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = database.GetStats(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 0 || stats.StorageBytes != 0 || stats.Tags[0].Documents != 0 || stats.Processing != 1 {
+		t.Errorf("unexpected stats for bob %+v", stats)
+	}
+
+	// Stats are cached briefly, tag counts are not
+	if _, err := database.NewDocument(alice, DocumentOptions{
+		Title: "May",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "3",
+		Tags:  []string{"invoice"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = database.GetStats(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 2 {
+		t.Errorf("expected cached stats, got %+v", stats)
+	}
+	counts, err := database.GetTagCounts(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[tag.ID] != 2 {
+		t.Errorf("expected 2 documents tagged invoice, got %v", counts)
+	}
+}
+
+func TestStatsFollowAdminScope(t *testing.T) {
+	database := newTestDB(t)
+	alice := WithUser(context.Background(), newTestUser(t, database, "alice"))
+	admin, err := database.NewUser("admin", "password", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := WithUser(context.Background(), admin)
+	token := WithScopes(session, []string{ScopeWrite})
+
+	if _, err := database.NewDocument(alice, DocumentOptions{
+		Title: "March",
+		Path:  "../pdf/testdata/test1.pdf",
+		Hash:  "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Either view is computed on its own, whichever comes first
+	for _, order := range [][]context.Context{{session, token}, {token, session}} {
+		database.stats.entries = nil
+		for _, ctx := range order {
+			stats, err := database.GetStats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 1
+			if ctx == token {
+				want = 0
+			}
+			if stats.Documents != want {
+				t.Errorf("expected %d documents, got %d", want, stats.Documents)
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// TagNode is a tag together with its children, see GetTagTree
+type TagNode struct {
+	Tag
+	Children []TagNode
+}
+
+func (db *DB) initTagTree() {
+	db.db.Exec(`ALTER TABLE tags ADD COLUMN parent_id INTEGER REFERENCES tags (id)`)
+	db.db.Exec(`CREATE INDEX IF NOT EXISTS tags_parent ON tags (parent_id)`)
+}
+
+// tagColumns lists the columns read by scanTag, in order
+const tagColumns = `id, name, color, COALESCE(parent_id, 0)`
+
+func scanTag(row rowScanner) (Tag, error) {
+	var tag Tag
+	err := row.Scan(&tag.ID, &tag.Name, &tag.Color, &tag.ParentID)
+	return tag, err
+}
+
+func getTag(q querier, id int) (Tag, error) {
+	tag, err := scanTag(q.QueryRow(`SELECT `+tagColumns+` FROM tags WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Tag{}, notFoundf("tag with id %d not found", id)
+		}
+		return Tag{}, fmt.Errorf("failed to get tag: %w", err)
+	}
+	return tag, nil
+}
+
+// checkParentTag fails with a validation error unless the tag exists
+func checkParentTag(q querier, id int) error {
+	if _, err := getTag(q, id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return invalidf("parent_id", "parent tag with id %d not found", id)
+		}
+		return err
+	}
+	return nil
+}
+
+// tagSubtree is an SQL query for the IDs of a tag and all its descendants.
+// It takes the ID of the tag as its only argument.
+const tagSubtree = `
+	WITH RECURSIVE subtree (id) AS (
+		SELECT ?
+		UNION
+		SELECT tags.id FROM tags JOIN subtree ON tags.parent_id = subtree.id
+	)
+	SELECT id FROM subtree`
+
+// GetDocumentTags returns the tags of a document visible to the user in
+// ctx, ordered by name
+func (db *DB) GetDocumentTags(ctx context.Context, id int) ([]Tag, error) {
+	if err := checkAccess(ctx, db.db, id, PermView); err != nil {
+		return nil, err
+	}
+	rows, err := db.db.Query(`
+		SELECT `+tagColumns+` FROM tags JOIN document_tags ON document_tags.tag_id = tags.id
+		WHERE document_tags.document_id = ? ORDER BY name
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get document tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		tag, err := scanTag(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan tag row: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// SetTagParent moves a tag below another one, or to the top level when
+// parentID is 0. A tag can't be moved below itself or its descendants.
+func (db *DB) SetTagParent(ctx context.Context, id, parentID int) (Tag, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Tag{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	tag, err := getTag(tx, id)
+	if err != nil {
+		return Tag{}, err
+	}
+	if tag.ParentID == parentID {
+		return tag, nil
+	}
+
+	if parentID != 0 {
+		if err := checkParentTag(tx, parentID); err != nil {
+			return Tag{}, err
+		}
+		var cycle bool
+		err := tx.QueryRow(`SELECT ? IN (`+tagSubtree+`)`, parentID, id).Scan(&cycle)
+		if err != nil {
+			return Tag{}, fmt.Errorf("failed to check tag hierarchy: %w", err)
+		}
+		if cycle {
+			return Tag{}, invalidf("parent_id", "invalid parent: tag %d is tag %d or one of its descendants", parentID, id)
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE tags SET parent_id = ? WHERE id = ?`, nullID(parentID), id); err != nil {
+		return Tag{}, fmt.Errorf("failed to update tag: %w", err)
+	}
+	diff := Diff{"parent_id": {Old: nilIfZero(tag.ParentID), New: nilIfZero(parentID)}}
+	if err := recordEvent(ctx, tx, EntityTag, id, ActionUpdate, diff); err != nil {
+		return Tag{}, err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return Tag{}, fmt.Errorf("failed to commit tag: %w", err)
+	}
+	tag.ParentID = parentID
+	return tag, nil
+}
+
+// RemoveTagCascade removes a tag together with all its descendants
+func (db *DB) RemoveTagCascade(ctx context.Context, id int) error {
+	return db.removeTag(ctx, id, true)
+}
+
+func (db *DB) removeTag(ctx context.Context, id int, cascade bool) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	tag, err := getTag(tx, id)
+	if err != nil {
+		return err
+	}
+
+	remove := []Tag{tag}
+	if cascade {
+		// Parents come before their children
+		rows, err := tx.Query(`
+			WITH RECURSIVE subtree (id, depth) AS (
+				SELECT ?, 0
+				UNION ALL
+				SELECT tags.id, subtree.depth + 1 FROM tags JOIN subtree ON tags.parent_id = subtree.id
+			)
+			SELECT `+tagColumns+` FROM tags JOIN subtree USING (id) WHERE depth > 0 ORDER BY depth
+		`, id)
+		if err != nil {
+			return fmt.Errorf("failed to get descendants: %w", err)
+		}
+		for rows.Next() {
+			t, err := scanTag(rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan tag row: %w", err)
+			}
+			remove = append(remove, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to get descendants: %w", err)
+		}
+	} else {
+		// Children move up to the parent of the removed tag
+		rows, err := tx.Query(`SELECT id FROM tags WHERE parent_id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("failed to get children: %w", err)
+		}
+		var children []int
+		for rows.Next() {
+			var child int
+			if err := rows.Scan(&child); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan tag row: %w", err)
+			}
+			children = append(children, child)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to get children: %w", err)
+		}
+
+		if _, err := tx.Exec(`UPDATE tags SET parent_id = ? WHERE parent_id = ?`, nullID(tag.ParentID), id); err != nil {
+			return fmt.Errorf("failed to reparent children: %w", err)
+		}
+		for _, child := range children {
+			diff := Diff{"parent_id": {Old: id, New: nilIfZero(tag.ParentID)}}
+			if err := recordEvent(ctx, tx, EntityTag, child, ActionUpdate, diff); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Delete children before their parents to satisfy the foreign key
+	for i := len(remove) - 1; i >= 0; i-- {
+		t := remove[i]
+		if _, err := tx.Exec(`DELETE FROM document_tags WHERE tag_id = ?`, t.ID); err != nil {
+			return fmt.Errorf("failed to remove tag assignments: %w", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM tags WHERE id = ?`, t.ID); err != nil {
+			return fmt.Errorf("failed to remove tag from database: %w", err)
+		}
+
+		diff := Diff{
+			"name":  {Old: t.Name},
+			"color": {Old: t.Color},
+		}
+		if t.ParentID != 0 {
+			diff["parent_id"] = Change{Old: t.ParentID}
+		}
+		if err := recordEvent(ctx, tx, EntityTag, t.ID, ActionDelete, diff); err != nil {
+			return err
+		}
+	}
+
+	if err := db.commit(tx); err != nil {
+		return fmt.Errorf("failed to commit tag removal: %w", err)
+	}
+	return nil
+}
+
+// GetTagTree returns all tags nested below their parents, each level
+// ordered by name
+func (db *DB) GetTagTree() ([]TagNode, error) {
+	tags, err := db.GetTags()
+	if err != nil {
+		return nil, err
+	}
+	return BuildTagTree(tags), nil
+}
+
+// BuildTagTree nests tags below their parents. Tags whose parent is not in
+// the list end up at the top level.
+func BuildTagTree(tags []Tag) []TagNode {
+	known := make(map[int]bool, len(tags))
+	for _, t := range tags {
+		known[t.ID] = true
+	}
+	children := make(map[int][]Tag) // parent ID -> children, 0 for roots
+	for _, t := range tags {
+		parent := t.ParentID
+		if !known[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], t)
+	}
+
+	var build func(parent int) []TagNode
+	build = func(parent int) []TagNode {
+		level := children[parent]
+		sort.Slice(level, func(i, j int) bool { return level[i].Name < level[j].Name })
+		nodes := make([]TagNode, 0, len(level))
+		for _, t := range level {
+			nodes = append(nodes, TagNode{Tag: t, Children: build(t.ID)})
+		}
+		return nodes
+	}
+	return build(0)
+}
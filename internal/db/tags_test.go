@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTagTree(t *testing.T) {
+	database := newTestDB(t)
+	ctx := WithUser(context.Background(), newTestUser(t, database, "alice"))
+
+	finance, err := database.NewTag(ctx, "finance", "#000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bills, err := database.NewChildTag(ctx, finance.ID, "bills", "#000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	power, err := database.NewChildTag(ctx, bills.ID, "power", "#000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.NewChildTag(ctx, 999, "orphan", "#000000"); err == nil {
+		t.Errorf("expected unknown parent to fail")
+	}
+
+	// A tag can't be moved below itself or its descendants
+	if _, err := database.SetTagParent(ctx, finance.ID, power.ID); err == nil {
+		t.Errorf("expected cycle to be rejected")
+	}
+	if _, err := database.SetTagParent(ctx, bills.ID, bills.ID); err == nil {
+		t.Errorf("expected self parent to be rejected")
+	}
+
+	tree, err := database.GetTagTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 1 || len(tree[0].Children) != 1 || len(tree[0].Children[0].Children) != 1 ||
+		tree[0].Children[0].Children[0].ID != power.ID {
+		t.Errorf("unexpected tree %+v", tree)
+	}
+
+	// Filtering by a tag includes documents tagged with its descendants
+	doc, err := database.NewDocument(ctx, DocumentOptions{Title: "March", Path: "../pdf/testdata/test1.pdf", Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AddDocumentTag(ctx, doc.ID, power.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{finance.ID, bills.ID, power.ID} {
+		docs, err := database.FindDocuments(ctx, DocumentQuery{TagIDs: []int{id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) != 1 || docs[0].ID != doc.ID {
+			t.Errorf("tag %d: expected document %d, got %+v", id, doc.ID, docs)
+		}
+	}
+
+	// Removing a tag moves its children up
+	if err := database.RemoveTag(ctx, bills.ID); err != nil {
+		t.Fatal(err)
+	}
+	power, err = database.GetTagByID(power.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if power.ParentID != finance.ID {
+		t.Errorf("expected power below finance, got parent %d", power.ParentID)
+	}
+
+	// Cascading removes the whole subtree and its assignments
+	if err := database.RemoveTagCascade(ctx, finance.ID); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := database.GetTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("expected no tags left, got %+v", tags)
+	}
+}
+
+func TestBuildTagTree(t *testing.T) {
+	tree := BuildTagTree([]Tag{
+		{ID: 1, Name: "b"},
+		{ID: 2, Name: "a"},
+		{ID: 3, Name: "c", ParentID: 1},
+		{ID: 4, Name: "d", ParentID: 42}, // parent not listed
+	})
+	var names []string
+	for _, n := range tree {
+		names = append(names, n.Name)
+	}
+	if len(tree) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "d" {
+		t.Errorf("unexpected roots %v", names)
+	}
+	if len(tree[1].Children) != 1 || tree[1].Children[0].ID != 3 {
+		t.Errorf("unexpected children %+v", tree[1].Children)
+	}
+}
@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes an API token can be granted. Each scope includes the ones before
+// it: write tokens can also read, admin tokens can also write.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+var scopeLevels = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+
+// tokenPrefix marks API tokens so they are easy to recognize in scripts and
+// secret scanners
+const tokenPrefix = "cel_"
+
+// APIToken is a personal access token. The secret itself is only known when
+// the token is created.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// ValidScope reports whether s is a known scope
+func ValidScope(s string) bool {
+	_, ok := scopeLevels[s]
+	return ok
+}
+
+type scopesKey struct{}
+
+// WithScopes returns a copy of ctx limiting the request to the given scopes.
+// Requests without scopes in their context are authenticated by session and
+// may do everything the user's role allows.
+func WithScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesKey{}, scopes)
+}
+
+// HasScope reports whether the request in ctx may act with the given scope
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value(scopesKey{}).([]string)
+	if !ok {
+		return true
+	}
+	for _, s := range scopes {
+		if scopeLevels[s] >= scopeLevels[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) initTokens() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL, -- comma separated list of scopes
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME,
+			last_used_at DATETIME
+		)
+	`)
+}
+
+// NewAPIToken creates a token for the user and returns it together with the
+// secret to hand to the client
+func (db *DB) NewAPIToken(userID int, name string, scopes []string, expiresAt *time.Time) (APIToken, string, error) {
+	if len(scopes) == 0 {
+		return APIToken{}, "", invalidf("scopes", "at least one scope is required")
+	}
+	for _, s := range scopes {
+		if !ValidScope(s) {
+			return APIToken{}, "", invalidf("scopes", "invalid scope %s", s)
+		}
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	secret = tokenPrefix + secret
+
+	t := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	result, err := db.db.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, t.UserID, t.Name, hashToken(secret), strings.Join(t.Scopes, ","), t.CreatedAt, nullTime(expiresAt))
+	if err != nil {
+		return APIToken{}, "", fmt.Errorf("failed to add token: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return APIToken{}, "", fmt.Errorf("failed to get token ID: %w", err)
+	}
+	t.ID = int(id)
+	return t, secret, nil
+}
+
+// GetAPITokens returns the tokens of a user
+func (db *DB) GetAPITokens(userID int) ([]APIToken, error) {
+	rows, err := db.db.Query(`
+		SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens WHERE user_id = ? ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var (
+			t                   APIToken
+			scopes              string
+			expiresAt, lastUsed sql.NullTime
+		)
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.CreatedAt, &expiresAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan token row: %w", err)
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		if expiresAt.Valid {
+			t.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RemoveAPIToken revokes a token of the given user
+func (db *DB) RemoveAPIToken(userID, id int) error {
+	result, err := db.db.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove token: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundf("token with id %d not found", id)
+	}
+	return nil
+}
+
+// GetAPITokenUser resolves a token secret to its user and scopes and records
+// that the token was used
+func (db *DB) GetAPITokenUser(secret string) (User, []string, error) {
+	var (
+		u         User
+		id        int
+		scopes    string
+		expiresAt sql.NullTime
+	)
+	err := db.db.QueryRow(`
+		SELECT users.id, users.username, users.role, users.created_at, api_tokens.id, api_tokens.scopes, api_tokens.expires_at
+		FROM api_tokens JOIN users ON users.id = api_tokens.user_id
+		WHERE api_tokens.token_hash = ?
+	`, hashToken(secret)).Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt, &id, &scopes, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, nil, notFoundf("token not found")
+		}
+		return User{}, nil, fmt.Errorf("failed to get token: %w", err)
+	}
+	now := time.Now().UTC()
+	if expiresAt.Valid && now.After(expiresAt.Time) {
+		return User{}, nil, notFoundf("token not found")
+	}
+
+	// Only write the timestamp once a minute to keep busy scripts from
+	// turning every request into a database write
+	db.db.Exec(`
+		UPDATE api_tokens SET last_used_at = ?
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)
+	`, now, id, now.Add(-time.Minute))
+
+	list := strings.Split(scopes, ",")
+	// A token never grants more than its owner's role allows
+	if !u.IsAdmin() {
+		list = slices.DeleteFunc(list, func(s string) bool { return s == ScopeAdmin })
+	}
+	return u, list, nil
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
@@ -0,0 +1,215 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TrashDocument moves a document to the trash. Its file is moved into the
+// trash directory and the database row is marked as deleted. Both happen
+// together: if the file cannot be moved the row is left untouched. Only the
+// owner of a document may trash it.
+func (db *DB) TrashDocument(ctx context.Context, id int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	undo, err := db.trashDocument(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if err := db.commit(tx); err != nil {
+		undo()
+		return fmt.Errorf("failed to commit trash: %w", err)
+	}
+
+	return nil
+}
+
+// trashDocument marks the document as deleted and moves its file to the
+// trash directory. undo moves the file back, for when tx is rolled back.
+func (db *DB) trashDocument(ctx context.Context, tx *sql.Tx, id int) (undo func(), err error) {
+	if err := checkAccess(ctx, tx, id, PermOwner); err != nil {
+		return nil, err
+	}
+
+	var path string
+	err = tx.QueryRow(`
+		SELECT path FROM documents WHERE id = ? AND deleted_at IS NULL
+	`, id).Scan(&path)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFoundf("document with id %d not found", id)
+		}
+		return nil, fmt.Errorf("failed to get document path: %w", err)
+	}
+
+	if err := os.MkdirAll(db.trashDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	trashPath := db.TrashPath(id, path)
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE documents SET deleted_at = ?, original_path = path, path = ? WHERE id = ?
+	`, now, trashPath, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to trash document: %w", err)
+	}
+
+	err = recordEvent(ctx, tx, EntityDocument, id, ActionTrash, Diff{
+		"path":       {Old: path, New: trashPath},
+		"deleted_at": {New: now},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path, trashPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to move document to trash: %w", err)
+	}
+	return func() { os.Rename(trashPath, path) }, nil
+}
+
+// RestoreDocument takes a document out of the trash and moves its file back
+// to where it was. If that location is taken meanwhile, a free name next to
+// it is used instead.
+func (db *DB) RestoreDocument(ctx context.Context, id int) (Document, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, id, PermOwner); err != nil {
+		return Document{}, err
+	}
+
+	var (
+		trashPath    string
+		originalPath sql.NullString
+		deletedAt    time.Time
+	)
+	err = tx.QueryRow(`
+		SELECT path, original_path, deleted_at FROM documents WHERE id = ? AND deleted_at IS NOT NULL
+	`, id).Scan(&trashPath, &originalPath, &deletedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Document{}, notFoundf("document with id %d not found in trash", id)
+		}
+		return Document{}, fmt.Errorf("failed to get document path: %w", err)
+	}
+
+	path := originalPath.String
+	if path == "" {
+		path = filepath.Base(trashPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return Document{}, fmt.Errorf("failed to create documents directory: %w", err)
+	}
+	path = freePath(path)
+
+	_, err = tx.Exec(`
+		UPDATE documents SET deleted_at = NULL, original_path = NULL, path = ? WHERE id = ?
+	`, path, id)
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to restore document: %w", err)
+	}
+
+	err = recordEvent(ctx, tx, EntityDocument, id, ActionRestore, Diff{
+		"path":       {Old: trashPath, New: path},
+		"deleted_at": {Old: deletedAt},
+	})
+	if err != nil {
+		return Document{}, err
+	}
+
+	if err := os.Rename(trashPath, path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Document{}, fmt.Errorf("failed to move document out of trash: %w", err)
+	}
+
+	if err := db.commit(tx); err != nil {
+		os.Rename(path, trashPath)
+		return Document{}, fmt.Errorf("failed to commit restore: %w", err)
+	}
+
+	return db.GetDocumentByID(ctx, id)
+}
+
+// GetTrashedDocuments returns the documents in the trash owned by the user
+// in ctx, most recently deleted first
+func (db *DB) GetTrashedDocuments(ctx context.Context) ([]Document, error) {
+	filter, args := accessFilter(ctx, PermOwner)
+	rows, err := db.db.Query(`
+		SELECT `+documentColumns+` FROM documents
+		WHERE deleted_at IS NOT NULL AND `+filter+`
+		ORDER BY deleted_at DESC
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed documents: %w", err)
+	}
+	return scanDocuments(rows)
+}
+
+// PurgeDocument permanently deletes a document that is in the trash
+func (db *DB) PurgeDocument(ctx context.Context, id int) error {
+	now := time.Now()
+	return db.removeDocument(ctx, id, &now)
+}
+
+// PurgeTrash permanently deletes every document that was moved to the trash
+// before the given time and is owned by the user in ctx. It returns the
+// number of purged documents.
+func (db *DB) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	trashed, err := db.GetTrashedDocuments(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int
+	var errs []error
+	for _, doc := range trashed {
+		if doc.DeletedAt.After(before) {
+			continue
+		}
+		// The document may have been restored since the list was read
+		if err := db.removeDocument(ctx, doc.ID, &before); err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+// freePath returns path if nothing exists there, otherwise the first
+// "name (n).ext" variant that is free
+func freePath(path string) string {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Stat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+	}
+}
+
+// TrashPath returns where the file at path of the document id is moved when
+// the document is trashed
+func (db *DB) TrashPath(id int, path string) string {
+	return filepath.Join(db.trashDir, fmt.Sprintf("%d-%s", id, filepath.Base(path)))
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPurgeOnlyRemovesTrashedDocuments(t *testing.T) {
+	database := newTestDB(t)
+	alice := WithUser(context.Background(), newTestUser(t, database, "alice"))
+
+	data, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test1.pdf")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.NewDocument(alice, DocumentOptions{Title: "test", Path: path, Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.TrashDocument(alice, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.RestoreDocument(alice, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PurgeDocument(alice, doc.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a restored document not to be purged, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the file of the restored document to stay: %v", err)
+	}
+
+	if err := database.TrashDocument(alice, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Documents trashed after the cutoff stay, also when asked for directly
+	if err := database.removeDocument(alice, doc.ID, &time.Time{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a recently trashed document not to be purged, got %v", err)
+	}
+	if n, err := database.PurgeTrash(alice, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("expected nothing to be purged, got %d, %v", n, err)
+	}
+	if n, err := database.PurgeTrash(alice, time.Now()); err != nil || n != 1 {
+		t.Errorf("expected the document to be purged, got %d, %v", n, err)
+	}
+	if _, err := database.GetDocumentByHash(alice, "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the document to be gone, got %v", err)
+	}
+}
+
+func TestPurgeKeepsFileWhenCommitFails(t *testing.T) {
+	database := newTestDB(t)
+	alice := WithUser(context.Background(), newTestUser(t, database, "alice"))
+
+	data, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test1.pdf")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.NewDocument(alice, DocumentOptions{Title: "test", Path: path, Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.TrashDocument(alice, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := database.GetTrashedDocuments(alice)
+	if err != nil || len(trashed) != 1 {
+		t.Fatalf("expected the document in the trash, got %v, %v", trashed, err)
+	}
+
+	// A deferred foreign key violation makes the commit fail
+	for _, stmt := range []string{
+		`CREATE TABLE broken (document_id INTEGER REFERENCES documents (id) DEFERRABLE INITIALLY DEFERRED)`,
+		`CREATE TRIGGER break_delete AFTER DELETE ON documents BEGIN INSERT INTO broken VALUES (OLD.id); END`,
+	} {
+		if _, err := database.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := database.PurgeDocument(alice, doc.ID); err == nil {
+		t.Fatal("expected the purge to fail")
+	}
+	if _, err := os.Stat(trashed[0].Opts.Path); err != nil {
+		t.Errorf("expected the file to stay with its document: %v", err)
+	}
+}
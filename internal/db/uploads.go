@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Upload is a resumable upload that is still receiving data. The data
+// itself is kept by the ingest pipeline, the row tracks how much arrived.
+type Upload struct {
+	ID        string
+	UserID    int // 0 for uploads of the system user
+	Filename  string
+	Title     string
+	Content   string
+	Length    int64 // total size in bytes
+	Offset    int64 // bytes received so far
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (db *DB) initUploads() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+			filename TEXT NOT NULL,
+			title TEXT NOT NULL,
+			content TEXT NOT NULL,
+			length INTEGER NOT NULL,
+			received INTEGER NOT NULL DEFAULT 0, -- bytes stored so far
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`)
+}
+
+// NewUpload records an upload of the user in ctx. ID, UserID, Offset and
+// CreatedAt are filled in.
+func (db *DB) NewUpload(ctx context.Context, u Upload) (Upload, error) {
+	id, err := randomToken()
+	if err != nil {
+		return Upload{}, err
+	}
+	owner := ownerID(ctx)
+	u.ID = id[:32]
+	u.UserID = int(owner.Int64)
+	u.Offset = 0
+	u.CreatedAt = time.Now().UTC()
+
+	_, err = db.db.Exec(`
+		INSERT INTO uploads (id, user_id, filename, title, content, length, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, u.ID, owner, u.Filename, u.Title, u.Content, u.Length, u.CreatedAt, u.ExpiresAt.UTC())
+	if err != nil {
+		return Upload{}, fmt.Errorf("failed to add upload: %w", err)
+	}
+	return u, nil
+}
+
+// GetUpload returns an upload of the user in ctx that has not expired
+func (db *DB) GetUpload(ctx context.Context, id string) (Upload, error) {
+	var (
+		u      Upload
+		userID sql.NullInt64
+	)
+	err := db.db.QueryRow(`
+		SELECT id, user_id, filename, title, content, length, received, created_at, expires_at
+		FROM uploads WHERE id = ? AND user_id IS ? AND expires_at > ?
+	`, id, ownerID(ctx), time.Now().UTC()).Scan(
+		&u.ID, &userID, &u.Filename, &u.Title, &u.Content, &u.Length, &u.Offset, &u.CreatedAt, &u.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Upload{}, notFoundf("upload %s not found", id)
+		}
+		return Upload{}, fmt.Errorf("failed to get upload: %w", err)
+	}
+	u.UserID = int(userID.Int64)
+	return u, nil
+}
+
+// SetUploadOffset records that the data up to offset arrived and extends
+// the life of the upload until expiresAt
+func (db *DB) SetUploadOffset(id string, offset int64, expiresAt time.Time) error {
+	_, err := db.db.Exec(`
+		UPDATE uploads SET received = ?, expires_at = ? WHERE id = ?
+	`, offset, expiresAt.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update upload: %w", err)
+	}
+	return nil
+}
+
+// RemoveUpload forgets an upload
+func (db *DB) RemoveUpload(id string) error {
+	if _, err := db.db.Exec(`DELETE FROM uploads WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove upload: %w", err)
+	}
+	return nil
+}
+
+// RemoveExpiredUpload forgets an upload if it expired before now and
+// reports whether it did
+func (db *DB) RemoveExpiredUpload(id string, now time.Time) (bool, error) {
+	result, err := db.db.Exec(`DELETE FROM uploads WHERE id = ? AND expires_at <= ?`, id, now.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to remove upload: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// ExpiredUploads returns the IDs of the uploads that expired before now
+func (db *DB) ExpiredUploads(now time.Time) ([]string, error) {
+	rows, err := db.db.Query(`SELECT id FROM uploads WHERE expires_at <= ?`, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired uploads: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan upload row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
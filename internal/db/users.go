@@ -0,0 +1,320 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles a user can have
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// ErrInvalidCredentials is returned by Authenticate for unknown users and
+// wrong passwords alike
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// SessionDuration is how long a session stays valid after login
+const SessionDuration = 30 * 24 * time.Hour
+
+// User represents an account in the database
+type User struct {
+	ID        int
+	Username  string
+	Role      string
+	CreatedAt time.Time
+}
+
+// IsAdmin reports whether the user has administrative rights
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of ctx carrying the authenticated user
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// UserFromContext returns the authenticated user stored in ctx
+func UserFromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(userKey{}).(User)
+	return u, ok
+}
+
+func (db *DB) initUsers() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
+			created_at DATETIME NOT NULL
+		)
+	`)
+
+	// Sessions are looked up by the SHA-256 of the cookie value, so a leaked
+	// database does not reveal usable session tokens.
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`)
+
+	db.initTokens()
+	db.initIdentities()
+}
+
+// NewUser creates a user with the given password
+func (db *DB) NewUser(username, password, role string) (User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return User{}, invalidf("username", "username is required")
+	}
+	if role != RoleAdmin && role != RoleUser {
+		return User{}, invalidf("role", "invalid role %s", role)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	u := User{Username: username, Role: role, CreatedAt: time.Now().UTC()}
+	result, err := db.db.Exec(`
+		INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)
+	`, u.Username, string(hash), u.Role, u.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return User{}, conflictf("user with name %s already exists", username)
+		}
+		return User{}, fmt.Errorf("failed to add user: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, fmt.Errorf("failed to get user ID: %w", err)
+	}
+	u.ID = int(id)
+	return u, nil
+}
+
+// BootstrapAdmin creates the first account as administrator. It fails once
+// any account exists, so it can only succeed on a fresh instance.
+func (db *DB) BootstrapAdmin(username, password string) (User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return User{}, invalidf("username", "username is required")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	u := User{Username: username, Role: RoleAdmin, CreatedAt: time.Now().UTC()}
+	result, err := db.db.Exec(`
+		INSERT INTO users (username, password_hash, role, created_at)
+		SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM users)
+	`, u.Username, string(hash), u.Role, u.CreatedAt)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to add user: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return User{}, conflictf("instance is already set up")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, fmt.Errorf("failed to get user ID: %w", err)
+	}
+	u.ID = int(id)
+	return u, nil
+}
+
+// CountUsers returns the number of accounts
+func (db *DB) CountUsers() (int, error) {
+	var n int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return n, nil
+}
+
+// GetUsers returns all accounts
+func (db *DB) GetUsers() ([]User, error) {
+	rows, err := db.db.Query(`
+		SELECT id, username, role, created_at FROM users ORDER BY username
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user row: %w", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetUserByID retrieves a user from the database by its ID
+func (db *DB) GetUserByID(id int) (User, error) {
+	var u User
+	err := db.db.QueryRow(`
+		SELECT id, username, role, created_at FROM users WHERE id = ?
+	`, id).Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, notFoundf("user with id %d not found", id)
+		}
+		return User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	return u, nil
+}
+
+// Authenticate checks a username and password and returns the matching user
+func (db *DB) Authenticate(username, password string) (User, error) {
+	var (
+		u    User
+		hash string
+	)
+	err := db.db.QueryRow(`
+		SELECT id, username, role, created_at, password_hash FROM users WHERE username = ?
+	`, username).Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	if err == sql.ErrNoRows {
+		// Compare against a dummy hash so that unknown users take as long
+		// as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("cellulose"), bcrypt.DefaultCost)
+	return hash
+})
+
+// SetPassword replaces the password of a user
+func (db *DB) SetPassword(id int, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	result, err := db.db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, string(hash), id)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundf("user with id %d not found", id)
+	}
+	return nil
+}
+
+// RemoveUser removes a user and all of its sessions
+func (db *DB) RemoveUser(id int) error {
+	result, err := db.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove user: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundf("user with id %d not found", id)
+	}
+	return nil
+}
+
+// NewSession starts a session for the user and returns the secret token to
+// hand to the client
+func (db *DB) NewSession(userID int) (token string, expiresAt time.Time, err error) {
+	token, err = randomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now().UTC()
+	expiresAt = now.Add(SessionDuration)
+	_, err = db.db.Exec(`
+		INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)
+	`, hashToken(token), userID, now, expiresAt)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	// Opportunistically drop expired sessions
+	db.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now)
+
+	return token, expiresAt, nil
+}
+
+// GetSessionUser returns the user owning a valid session token
+func (db *DB) GetSessionUser(token string) (User, error) {
+	var (
+		u         User
+		expiresAt time.Time
+	)
+	err := db.db.QueryRow(`
+		SELECT users.id, users.username, users.role, users.created_at, sessions.expires_at
+		FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE sessions.token_hash = ?
+	`, hashToken(token)).Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, notFoundf("session not found")
+		}
+		return User{}, fmt.Errorf("failed to get session: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return User{}, notFoundf("session not found")
+	}
+	return u, nil
+}
+
+// RemoveSession ends a session
+func (db *DB) RemoveSession(token string) error {
+	_, err := db.db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashToken(token))
+	if err != nil {
+		return fmt.Errorf("failed to remove session: %w", err)
+	}
+	return nil
+}
+
+// randomToken returns 32 random bytes encoded as hex
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the value stored in the database for a secret token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,299 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version is an earlier file of a document. The current file is stored on
+// the document itself; metadata and tags belong to the document and are not
+// versioned.
+type Version struct {
+	ID         int
+	DocumentID int
+	Number     int // the document's version number while this file was current
+	Path       string
+	Hash       string
+	Content    string
+	Size       int64 // size of the file in bytes
+	ReplacedAt time.Time
+}
+
+func (db *DB) initVersions() {
+	db.db.Exec(`ALTER TABLE documents ADD COLUMN version INTEGER NOT NULL DEFAULT 1`)
+
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS document_versions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document_id INTEGER NOT NULL REFERENCES documents (id) ON DELETE CASCADE,
+			number INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			content TEXT NOT NULL,
+			replaced_at DATETIME NOT NULL,
+			UNIQUE (document_id, number)
+		)
+	`)
+	db.db.Exec(`CREATE INDEX IF NOT EXISTS document_versions_hash ON document_versions (hash)`)
+}
+
+// checkHash returns ErrDuplicate or ErrInTrash if a document or one of its
+// versions already has the given hash
+func checkHash(q querier, hash string) error {
+	var trashed bool
+	err := q.QueryRow(`
+		SELECT deleted_at IS NOT NULL AS trashed FROM documents WHERE hash = ?
+		UNION ALL
+		SELECT documents.deleted_at IS NOT NULL FROM document_versions
+		JOIN documents ON documents.id = document_versions.document_id
+		WHERE document_versions.hash = ?
+		ORDER BY trashed LIMIT 1
+	`, hash, hash).Scan(&trashed)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to check document existence: %w", err)
+	case trashed:
+		return ErrInTrash
+	default:
+		return ErrDuplicate
+	}
+}
+
+// StoreVersion replaces the file of a document with the file at tmpPath,
+// which is moved into dir under the given name. The previous file, hash and
+// content are kept as a version. Like StoreDocument it rejects files whose
+// hash is already known and leaves the file at tmpPath on error.
+func (db *DB) StoreVersion(ctx context.Context, id int, tmpPath, dir, name, hash, content string) (Document, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, id, PermEdit); err != nil {
+		return Document{}, err
+	}
+	doc, err := scanDocument(tx.QueryRow(`
+		SELECT `+documentColumns+` FROM documents WHERE id = ? AND deleted_at IS NULL
+	`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Document{}, notFoundf("document with id %d not found", id)
+		}
+		return Document{}, fmt.Errorf("failed to get document: %w", err)
+	}
+	if err := checkHash(tx, hash); err != nil {
+		return Document{}, err
+	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to get file size: %w", err)
+	}
+
+	if err := pushVersion(tx, doc); err != nil {
+		return Document{}, err
+	}
+
+	path := freePath(filepath.Join(dir, filepath.Base(name)))
+	_, err = tx.Exec(`
+		UPDATE documents SET path = ?, hash = ?, content = ?, size = ?, version = version + 1 WHERE id = ?
+	`, path, hash, content, info.Size(), id)
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to update document: %w", err)
+	}
+
+	err = recordEvent(ctx, tx, EntityDocument, id, ActionVersion, Diff{
+		"version": {Old: doc.Version, New: doc.Version + 1},
+		"path":    {Old: doc.Opts.Path, New: path},
+		"hash":    {Old: doc.Opts.Hash, New: hash},
+	})
+	if err != nil {
+		return Document{}, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return Document{}, fmt.Errorf("failed to move file into place: %w", err)
+	}
+	if err := db.commit(tx); err != nil {
+		os.Rename(path, tmpPath)
+		return Document{}, fmt.Errorf("failed to commit version: %w", err)
+	}
+
+	return db.GetDocumentByID(ctx, id)
+}
+
+// RestoreVersion makes an earlier file of a document current again. The
+// file it replaces is kept as a version, so nothing is lost.
+func (db *DB) RestoreVersion(ctx context.Context, id, number int) (Document, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAccess(ctx, tx, id, PermEdit); err != nil {
+		return Document{}, err
+	}
+	doc, err := scanDocument(tx.QueryRow(`
+		SELECT `+documentColumns+` FROM documents WHERE id = ? AND deleted_at IS NULL
+	`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Document{}, notFoundf("document with id %d not found", id)
+		}
+		return Document{}, fmt.Errorf("failed to get document: %w", err)
+	}
+	v, err := getVersion(tx, id, number)
+	if err != nil {
+		return Document{}, err
+	}
+
+	if err := pushVersion(tx, doc); err != nil {
+		return Document{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM document_versions WHERE id = ?`, v.ID); err != nil {
+		return Document{}, fmt.Errorf("failed to remove version: %w", err)
+	}
+	_, err = tx.Exec(`
+		UPDATE documents SET path = ?, hash = ?, content = ?, size = ?, version = version + 1 WHERE id = ?
+	`, v.Path, v.Hash, v.Content, v.Size, id)
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to update document: %w", err)
+	}
+
+	err = recordEvent(ctx, tx, EntityDocument, id, ActionRestoreVersion, Diff{
+		"version": {Old: doc.Version, New: doc.Version + 1},
+		"path":    {Old: doc.Opts.Path, New: v.Path},
+		"hash":    {Old: doc.Opts.Hash, New: v.Hash},
+	})
+	if err != nil {
+		return Document{}, err
+	}
+
+	if err := db.commit(tx); err != nil {
+		return Document{}, fmt.Errorf("failed to commit restore: %w", err)
+	}
+	return db.GetDocumentByID(ctx, id)
+}
+
+// pushVersion keeps the current file of doc as a version
+func pushVersion(tx *sql.Tx, doc Document) error {
+	_, err := tx.Exec(`
+		INSERT INTO document_versions (document_id, number, path, hash, content, size, replaced_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, doc.ID, doc.Version, doc.Opts.Path, doc.Opts.Hash, doc.Opts.Content, doc.Size, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to keep version: %w", err)
+	}
+	return nil
+}
+
+const versionColumns = `document_versions.id, document_versions.document_id, document_versions.number,
+	document_versions.path, document_versions.hash, document_versions.content, COALESCE(document_versions.size, 0),
+	document_versions.replaced_at`
+
+func scanVersion(row rowScanner) (Version, error) {
+	var v Version
+	err := row.Scan(&v.ID, &v.DocumentID, &v.Number, &v.Path, &v.Hash, &v.Content, &v.Size, &v.ReplacedAt)
+	return v, err
+}
+
+func getVersion(q querier, id, number int) (Version, error) {
+	v, err := scanVersion(q.QueryRow(`
+		SELECT `+versionColumns+` FROM document_versions WHERE document_id = ? AND number = ?
+	`, id, number))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Version{}, notFoundf("version %d of document %d not found", number, id)
+		}
+		return Version{}, fmt.Errorf("failed to get version: %w", err)
+	}
+	return v, nil
+}
+
+// GetVersion returns an earlier file of a document the user in ctx may see
+func (db *DB) GetVersion(ctx context.Context, id, number int) (Version, error) {
+	if err := checkAccess(ctx, db.db, id, PermView); err != nil {
+		return Version{}, err
+	}
+	return getVersion(db.db, id, number)
+}
+
+// GetVersions returns the earlier files of a document the user in ctx may
+// see, newest first
+func (db *DB) GetVersions(ctx context.Context, id int) ([]Version, error) {
+	if err := checkAccess(ctx, db.db, id, PermView); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.Query(`
+		SELECT `+versionColumns+` FROM document_versions WHERE document_id = ? ORDER BY number DESC
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versions: %w", err)
+	}
+	return scanVersions(rows)
+}
+
+// GetAllVersions returns the earlier files of every document visible to the
+// user in ctx, including documents in the trash
+func (db *DB) GetAllVersions(ctx context.Context) ([]Version, error) {
+	filter, args := accessFilter(ctx, PermView)
+	rows, err := db.db.Query(`
+		SELECT `+versionColumns+` FROM document_versions
+		JOIN documents ON documents.id = document_versions.document_id
+		WHERE `+filter+`
+		ORDER BY document_versions.document_id, document_versions.number
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versions: %w", err)
+	}
+	return scanVersions(rows)
+}
+
+func scanVersions(rows *sql.Rows) ([]Version, error) {
+	defer rows.Close()
+
+	versions := []Version{}
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan version row: %w", err)
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// removeVersions deletes the rows of all versions of a document and returns
+// the paths of their files, which the caller removes once tx is committed
+func removeVersions(tx *sql.Tx, id int) ([]string, error) {
+	rows, err := tx.Query(`SELECT path FROM document_versions WHERE document_id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versions: %w", err)
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan version row: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get versions: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM document_versions WHERE document_id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to remove versions: %w", err)
+	}
+	return paths, nil
+}
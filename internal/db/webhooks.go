@@ -0,0 +1,338 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Statuses of a webhook delivery
+const (
+	DeliveryPending   = "pending"   // waiting for its first or next attempt
+	DeliverySucceeded = "succeeded" // the receiver answered with 2xx
+	DeliveryFailed    = "failed"    // all attempts failed
+)
+
+// Webhook notifies a URL about events. The secret signing the deliveries is
+// only known when the webhook is created.
+type Webhook struct {
+	ID        int
+	URL       string
+	Events    []string // event types like "document.create", "document.*" or "*"
+	CreatedBy int
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is one event sent, or still to be sent, to a webhook
+type WebhookDelivery struct {
+	ID            int
+	WebhookID     int
+	Event         string
+	Payload       json.RawMessage
+	Status        string
+	Attempts      int
+	NextAttemptAt *time.Time // nil unless pending
+	ResponseCode  int        // of the last attempt, 0 when there was no response
+	Error         string     // of the last attempt
+	CreatedAt     time.Time
+	DeliveredAt   *time.Time
+}
+
+// PendingDelivery is a delivery that is due, with what is needed to send it
+type PendingDelivery struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+}
+
+// eventFilter matches the entries of Webhook.Events
+var eventFilter = regexp.MustCompile(`^(\*|[a-z_]+\.(\*|[a-z_]+))$`)
+
+func (db *DB) initWebhooks() {
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			events TEXT NOT NULL, -- comma separated list of event types
+			secret TEXT NOT NULL,
+			created_by INTEGER REFERENCES users (id) ON DELETE SET NULL,
+			created_at DATETIME NOT NULL
+		)
+	`)
+	db.db.Exec(`
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME,
+			response_code INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			delivered_at DATETIME
+		)
+	`)
+	db.db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`)
+}
+
+// NewWebhook subscribes rawURL to the given event types. A secret is
+// generated when none is given. It is returned together with the webhook.
+func (db *DB) NewWebhook(ctx context.Context, rawURL string, events []string, secret string) (Webhook, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, "", invalidf("url", "url must be an absolute http or https URL")
+	}
+	if len(events) == 0 {
+		return Webhook{}, "", invalidf("events", "at least one event is required")
+	}
+	for _, e := range events {
+		if !eventFilter.MatchString(e) {
+			return Webhook{}, "", invalidf("events", "invalid event %q", e)
+		}
+	}
+	if secret == "" {
+		if secret, err = randomToken(); err != nil {
+			return Webhook{}, "", err
+		}
+	}
+
+	h := Webhook{URL: rawURL, Events: events, CreatedAt: time.Now().UTC()}
+	owner := ownerID(ctx)
+	h.CreatedBy = int(owner.Int64)
+	result, err := db.db.Exec(`
+		INSERT INTO webhooks (url, events, secret, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+	`, h.URL, strings.Join(h.Events, ","), secret, owner, h.CreatedAt)
+	if err != nil {
+		return Webhook{}, "", fmt.Errorf("failed to add webhook: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Webhook{}, "", fmt.Errorf("failed to get webhook ID: %w", err)
+	}
+	h.ID = int(id)
+	return h, secret, nil
+}
+
+// GetWebhooks returns all webhooks
+func (db *DB) GetWebhooks() ([]Webhook, error) {
+	rows, err := db.db.Query(`
+		SELECT id, url, events, COALESCE(created_by, 0), created_at FROM webhooks ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var (
+			h      Webhook
+			events string
+		)
+		if err := rows.Scan(&h.ID, &h.URL, &events, &h.CreatedBy, &h.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook row: %w", err)
+		}
+		h.Events = strings.Split(events, ",")
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// RemoveWebhook deletes a webhook together with its deliveries
+func (db *DB) RemoveWebhook(id int) error {
+	result, err := db.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove webhook: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFoundf("webhook with id %d not found", id)
+	}
+	return nil
+}
+
+// QueueWebhookDeliveries records a pending delivery of payload to every
+// webhook subscribed to the event type and returns how many there are
+func (db *DB) QueueWebhookDeliveries(event string, payload []byte) (int, error) {
+	hooks, err := db.GetWebhooks()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	n := 0
+	for _, h := range hooks {
+		if !subscribed(h.Events, event) {
+			continue
+		}
+		_, err := db.db.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, h.ID, event, string(payload), DeliveryPending, now, now)
+		if err != nil {
+			return n, fmt.Errorf("failed to queue webhook delivery: %w", err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// subscribed reports whether any of the filters matches the event type
+func subscribed(filters []string, event string) bool {
+	for _, f := range filters {
+		if f == "*" || f == event || (strings.HasSuffix(f, ".*") && strings.HasPrefix(event, strings.TrimSuffix(f, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries whose next
+// attempt is due at now, oldest first
+func (db *DB) DueWebhookDeliveries(now time.Time, limit int) ([]PendingDelivery, error) {
+	rows, err := db.db.Query(`
+		SELECT `+deliveryColumns+`, webhooks.url, webhooks.secret
+		FROM webhook_deliveries d JOIN webhooks ON webhooks.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.id LIMIT ?
+	`, DeliveryPending, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var due []PendingDelivery
+	for rows.Next() {
+		var p PendingDelivery
+		if err := scanDelivery(rows, &p.WebhookDelivery, &p.URL, &p.Secret); err != nil {
+			return nil, err
+		}
+		due = append(due, p)
+	}
+	return due, rows.Err()
+}
+
+// RecordWebhookAttempt stores the outcome of sending a delivery. An empty
+// errMsg means it was received. Otherwise it is tried again at retryAt, or
+// given up when retryAt is nil.
+func (db *DB) RecordWebhookAttempt(id, responseCode int, errMsg string, retryAt *time.Time) error {
+	status := DeliveryPending
+	var deliveredAt *time.Time
+	switch {
+	case errMsg == "":
+		status, retryAt = DeliverySucceeded, nil
+		now := time.Now().UTC()
+		deliveredAt = &now
+	case retryAt == nil:
+		status = DeliveryFailed
+	}
+
+	_, err := db.db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = attempts + 1, next_attempt_at = ?, response_code = ?, error = ?, delivered_at = ?
+		WHERE id = ?
+	`, status, nullTime(retryAt), responseCode, errMsg, nullTime(deliveredAt), id)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook attempt: %w", err)
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns the deliveries of a webhook, newest first
+func (db *DB) GetWebhookDeliveries(webhookID int) ([]WebhookDelivery, error) {
+	var exists bool
+	if err := db.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = ?)`, webhookID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to get webhook: %w", err)
+	}
+	if !exists {
+		return nil, notFoundf("webhook with id %d not found", webhookID)
+	}
+
+	rows, err := db.db.Query(`
+		SELECT `+deliveryColumns+` FROM webhook_deliveries d WHERE d.webhook_id = ? ORDER BY d.id DESC LIMIT 100
+	`, webhookID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RedeliverWebhook queues the payload of an earlier delivery again as a new
+// delivery, which is returned
+func (db *DB) RedeliverWebhook(webhookID, deliveryID int) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := scanDelivery(db.db.QueryRow(`
+		SELECT `+deliveryColumns+` FROM webhook_deliveries d WHERE d.id = ? AND d.webhook_id = ?
+	`, deliveryID, webhookID), &d)
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, notFoundf("delivery with id %d not found", deliveryID)
+	}
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	now := time.Now().UTC()
+	result, err := db.db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, webhookID, d.Event, string(d.Payload), DeliveryPending, now, now)
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("failed to queue webhook delivery: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("failed to get delivery ID: %w", err)
+	}
+	return WebhookDelivery{
+		ID:            int(id),
+		WebhookID:     webhookID,
+		Event:         d.Event,
+		Payload:       d.Payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+	}, nil
+}
+
+const deliveryColumns = `d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at,
+	d.response_code, d.error, d.created_at, d.delivered_at`
+
+// scanDelivery reads the deliveryColumns into d, followed by extra columns
+func scanDelivery(row rowScanner, d *WebhookDelivery, extra ...any) error {
+	var (
+		payload                string
+		nextAttempt, delivered sql.NullTime
+	)
+	dest := append([]any{&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &nextAttempt,
+		&d.ResponseCode, &d.Error, &d.CreatedAt, &delivered}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+		return fmt.Errorf("failed to scan delivery row: %w", err)
+	}
+	d.Payload = json.RawMessage(payload)
+	if nextAttempt.Valid {
+		d.NextAttemptAt = &nextAttempt.Time
+	}
+	if delivered.Valid {
+		d.DeliveredAt = &delivered.Time
+	}
+	return nil
+}
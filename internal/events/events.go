@@ -0,0 +1,116 @@
+// Package events passes changes to the library on to the clients listening
+// for them, like the browser tabs following /api/events
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a change published on the bus. Events without UserID and
+// DocumentID are meant for everyone.
+type Event struct {
+	ID   int64
+	Type string // like "document.create" or "job.done"
+	// UserID limits the event to one user
+	UserID int
+	// DocumentID limits the event to the users who may see the document
+	DocumentID int
+	Data       any
+}
+
+// buffer is how many events a subscriber may fall behind before it is
+// dropped. It can resume from the last event it received.
+const buffer = 64
+
+// Bus hands published events to all subscribers and keeps the most recent
+// ones, so that subscribers can resume after a reconnect
+type Bus struct {
+	mu      sync.Mutex
+	next    int64
+	size    int
+	history []Event // oldest first
+	subs    map[*Subscription]struct{}
+}
+
+// New creates a bus remembering the last size events. IDs start at the
+// current time in milliseconds, so that IDs handed out before a restart
+// are never reused.
+func New(size int) *Bus {
+	return &Bus{
+		next: time.Now().UnixMilli(),
+		size: size,
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the event an ID and sends it to all subscribers.
+// Subscribers that can't keep up are dropped instead of blocking.
+func (b *Bus) Publish(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.next++
+	e.ID = b.next
+	b.history = append(b.history, e)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub.c <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.c)
+		}
+	}
+	return e
+}
+
+// Subscription receives the events published after it was created
+type Subscription struct {
+	// C is closed when the subscription is closed or fell behind
+	C   <-chan Event
+	c   chan Event
+	bus *Bus
+}
+
+// Subscribe starts receiving events. With a lastID other than 0 the events
+// published after it are returned as missed. complete is false when some of
+// them are no longer known, and the subscriber has to start over.
+func (b *Bus) Subscribe(lastID int64) (sub *Subscription, missed []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan Event, buffer)
+	sub = &Subscription{C: c, c: c, bus: b}
+	b.subs[sub] = struct{}{}
+
+	if lastID == 0 {
+		return sub, nil, true
+	}
+	oldest := b.next + 1
+	if len(b.history) > 0 {
+		oldest = b.history[0].ID
+	}
+	if lastID < oldest-1 || lastID > b.next {
+		return sub, nil, false
+	}
+	for _, e := range b.history {
+		if e.ID > lastID {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed, true
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
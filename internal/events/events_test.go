@@ -0,0 +1,58 @@
+package events
+
+import "testing"
+
+func TestBus(t *testing.T) {
+	bus := New(3)
+	sub, missed, complete := bus.Subscribe(0)
+	if len(missed) != 0 || !complete {
+		t.Fatalf("unexpected missed events %v", missed)
+	}
+
+	first := bus.Publish(Event{Type: "tag.create"})
+	if e := <-sub.C; e.ID != first.ID || e.Type != "tag.create" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	for i := 0; i < 3; i++ {
+		bus.Publish(Event{Type: "document.create"})
+	}
+	sub.Close()
+	if _, ok := <-sub.C; !ok {
+		t.Error("expected buffered events to stay readable")
+	}
+
+	// Resuming from an event still in the history replays what came after
+	sub, missed, complete = bus.Subscribe(first.ID + 1)
+	if !complete || len(missed) != 2 || missed[0].ID != first.ID+2 {
+		t.Errorf("unexpected resume %v %v", complete, missed)
+	}
+	sub.Close()
+
+	// The first event fell out of the history
+	_, missed, complete = bus.Subscribe(first.ID - 1)
+	if complete || missed != nil {
+		t.Errorf("expected incomplete resume, got %v", missed)
+	}
+	// IDs of an earlier run are unknown too
+	_, _, complete = bus.Subscribe(first.ID + 100)
+	if complete {
+		t.Error("expected incomplete resume for unknown ID")
+	}
+}
+
+func TestBusDropsSlowSubscribers(t *testing.T) {
+	bus := New(10)
+	sub, _, _ := bus.Subscribe(0)
+	for i := 0; i < buffer+1; i++ {
+		bus.Publish(Event{Type: "document.create"})
+	}
+
+	n := 0
+	for range sub.C {
+		n++
+	}
+	if n != buffer {
+		t.Errorf("expected %d events before the channel was closed, got %d", buffer, n)
+	}
+	sub.Close() // closing twice is fine
+}
@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+// ErrNotPDF is returned for files in zip archives that aren't named like
+// PDF documents
+var ErrNotPDF error = &db.Error{Kind: db.ErrValidation, Code: "not_pdf", Message: "not a PDF file"}
+
+// Result is the outcome of ingesting one file of a batch. Document is the
+// created document, or for ErrDuplicate and ErrInTrash the one already
+// holding the file if the user may see it.
+type Result struct {
+	Name     string
+	Document db.Document
+	Err      error
+}
+
+// IsZip reports whether r starts like a zip archive
+func IsZip(r io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("PK\x03\x04")) || bytes.Equal(magic, []byte("PK\x05\x06"))
+}
+
+// IngestZip ingests every PDF inside the zip archive r of the given size
+// and calls fn with the outcome for each file. Files are titled after their
+// names, like by IngestFile, and files other than .pdf ones are rejected
+// with ErrNotPDF. Directories, hidden files and the resource forks macOS
+// adds are skipped. An error is only returned when the archive itself
+// can't be read.
+func (p *Pipeline) IngestZip(ctx context.Context, r io.ReaderAt, size int64, fn func(Result)) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return &db.Error{Kind: db.ErrValidation, Code: "invalid_zip", Message: "invalid zip archive: " + err.Error()}
+	}
+
+	for _, f := range archive.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		res := Result{Name: f.Name}
+		if !strings.EqualFold(path.Ext(name), ".pdf") {
+			res.Err = ErrNotPDF
+			fn(res)
+			continue
+		}
+		if f.UncompressedSize64 > MaxUploadSize {
+			res.Err = &db.Error{Kind: db.ErrValidation, Code: "too_large",
+				Message: fmt.Sprintf("file is larger than %d bytes", MaxUploadSize)}
+			fn(res)
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			res.Err = &db.Error{Kind: db.ErrValidation, Code: "invalid_zip", Message: "can't be extracted: " + err.Error()}
+			fn(res)
+			continue
+		}
+		title := name[:len(name)-len(path.Ext(name))]
+		res.Document, res.Err = p.Ingest(ctx, name, rc, Options{Title: title})
+		rc.Close()
+		fn(res)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+func TestIngestZip(t *testing.T) {
+	p := newPipeline(t)
+	first, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.ReadFile("../pdf/testdata/test2.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"march/", nil},
+		{"march/invoice.pdf", first},
+		{"march/receipt.pdf", second},
+		{"copy.pdf", first},
+		{"notes.txt", []byte("not a PDF")},
+		{"march/.DS_Store", []byte("junk")},
+		{"__MACOSX/march/._invoice.pdf", []byte("junk")},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := bytes.NewReader(buf.Bytes())
+	if !IsZip(archive) || IsZip(bytes.NewReader(first)) {
+		t.Fatal("expected only the archive to be detected as zip")
+	}
+	var results []Result
+	if err := p.IngestZip(ctx, archive, archive.Size(), func(r Result) { results = append(results, r) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %+v", results)
+	}
+	invoice, receipt, copied, notes := results[0], results[1], results[2], results[3]
+	if invoice.Err != nil || invoice.Document.Opts.Title != "invoice" {
+		t.Errorf("unexpected result for the invoice %+v", invoice)
+	}
+	if receipt.Err != nil || receipt.Name != "march/receipt.pdf" {
+		t.Errorf("unexpected result for the receipt %+v", receipt)
+	}
+	if !errors.Is(copied.Err, ErrDuplicate) || copied.Document.ID != invoice.Document.ID {
+		t.Errorf("expected the copy to be a duplicate of %d, got %+v", invoice.Document.ID, copied)
+	}
+	if !errors.Is(notes.Err, ErrNotPDF) {
+		t.Errorf("expected the text file to be rejected, got %+v", notes)
+	}
+
+	if err := p.IngestZip(ctx, bytes.NewReader(first), int64(len(first)), func(Result) {}); !errors.Is(err, db.ErrValidation) {
+		t.Errorf("expected a validation error for a broken archive, got %v", err)
+	}
+}
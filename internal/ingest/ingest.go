@@ -0,0 +1,201 @@
+package ingest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+// DefaultDir is the directory holding the original documents
+const DefaultDir = "documents"
+
+var (
+	// ErrDuplicate is returned when a file with the same hash is already stored
+	ErrDuplicate = db.ErrDuplicate
+	// ErrInTrash is returned when a file with the same hash is in the trash
+	ErrInTrash = db.ErrInTrash
+)
+
+// tmpDirName is the directory inside the documents directory that holds
+// files while they are being received
+const tmpDirName = ".tmp"
+
+// Pipeline stores incoming files on disk and records them in the database.
+// It is shared by the HTTP upload handler and the command line importer.
+type Pipeline struct {
+	DB  *db.DB
+	Dir string // directory holding the original files
+}
+
+// New creates a pipeline storing files inside dir
+func New(database *db.DB, dir string) *Pipeline {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Pipeline{DB: database, Dir: dir}
+}
+
+// Options describes the metadata supplied together with a file
+type Options struct {
+	Title     string
+	Content   string
+	Tags      []string  // names of existing tags to assign
+	CreatedAt time.Time // extracted from the file when zero
+}
+
+// Ingest saves the contents of r under the given file name and adds the
+// resulting document to the database. The data is first written to a
+// temporary file; only once it is complete, hashed and recorded in the
+// database is it moved to its final name. A failure at any step leaves
+// neither a database row nor a file behind. The user in ctx becomes the
+// owner of the document. With ErrDuplicate and ErrInTrash the document
+// already holding the file is returned, if the user in ctx may see it.
+func (p *Pipeline) Ingest(ctx context.Context, name string, r io.Reader, opts Options) (db.Document, error) {
+	tmpPath, hashValue, err := p.receive(r)
+	if err != nil {
+		return db.Document{}, err
+	}
+	// Once stored the file has been renamed and this is a no-op
+	defer os.Remove(tmpPath)
+
+	// Add document to database and move it into place
+	log.Printf("Attempting to add document to database: %s\n", name)
+	doc, err := p.DB.StoreDocument(ctx, tmpPath, p.Dir, name, db.DocumentOptions{
+		Title:     opts.Title,
+		Content:   opts.Content,
+		Hash:      hashValue,
+		Tags:      opts.Tags,
+		CreatedAt: opts.CreatedAt,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrDuplicate) || errors.Is(err, db.ErrInTrash) {
+			existing, _ := p.DB.GetDocumentByHash(ctx, hashValue)
+			return existing, err
+		}
+		return db.Document{}, fmt.Errorf("failed to add document to database: %w", err)
+	}
+
+	return doc, nil
+}
+
+// IngestVersion saves the contents of r as the new file of an existing
+// document. The previous file is kept as a version. Like Ingest it leaves
+// nothing behind on failure.
+func (p *Pipeline) IngestVersion(ctx context.Context, id int, name string, r io.Reader, content string) (db.Document, error) {
+	tmpPath, hashValue, err := p.receive(r)
+	if err != nil {
+		return db.Document{}, err
+	}
+	defer os.Remove(tmpPath)
+
+	log.Printf("Attempting to add a version of document %d: %s\n", id, name)
+	return p.DB.StoreVersion(ctx, id, tmpPath, p.Dir, name, hashValue, content)
+}
+
+// receive writes the contents of r to a temporary file inside the documents
+// directory and returns its path and hex encoded SHA-256. The caller removes
+// the file.
+func (p *Pipeline) receive(r io.Reader) (string, string, error) {
+	// Create documents directory if it doesn't exist
+	tmpDir := filepath.Join(p.Dir, tmpDirName)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create documents directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create file: %w", err)
+	}
+
+	// Save file to disk and compute hash
+	hash := sha256.New()
+	writer := io.MultiWriter(tmp, hash)
+
+	if _, err = io.Copy(writer, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("failed to save file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("failed to save file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("failed to save file: %w", err)
+	}
+
+	return tmp.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Sweep removes temporary files left behind by uploads that never finished,
+// for example because the process crashed. Files modified within olderThan
+// are kept, since they may belong to an upload that is still running.
+func (p *Pipeline) Sweep(olderThan time.Duration) (int, error) {
+	tmpDir := filepath.Join(p.Dir, tmpDirName)
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read temporary directory: %w", err)
+	}
+
+	var removed int
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		if err := os.Remove(filepath.Join(tmpDir, e.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", e.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// WorkDirs returns the directories inside the documents directory that
+// hold files still being received rather than documents
+func (p *Pipeline) WorkDirs() []string {
+	return []string{filepath.Join(p.Dir, tmpDirName), filepath.Join(p.Dir, uploadsDirName)}
+}
+
+// IngestFile opens the file at path and runs it through the pipeline. The
+// file name is used as title.
+func (p *Pipeline) IngestFile(ctx context.Context, path string) (db.Document, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return db.Document{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	name := filepath.Base(path)
+	title := name[:len(name)-len(filepath.Ext(name))]
+	return p.Ingest(ctx, name, f, Options{Title: title})
+}
+
+// HashFile computes the hex encoded SHA-256 of the file at path
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
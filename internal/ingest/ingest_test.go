@@ -0,0 +1,185 @@
+package ingest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+var ctx = db.SystemContext()
+
+func newPipeline(t *testing.T) *Pipeline {
+	dir := t.TempDir()
+	database, err := db.Open(db.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	return New(database, filepath.Join(dir, "documents"))
+}
+
+// files lists the regular files below dir, relative to it
+func files(t *testing.T, dir string) []string {
+	var names []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			names = append(names, rel)
+		}
+		return nil
+	})
+	return names
+}
+
+func TestIngestDuplicateLeavesNothingBehind(t *testing.T) {
+	p := newPipeline(t)
+	original, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Ingest(ctx, "scan.pdf", strings.NewReader(string(original)), Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Ingest(ctx, "scan.pdf", strings.NewReader(string(original)), Options{})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+
+	got := files(t, p.Dir)
+	if len(got) != 1 || got[0] != "scan.pdf" {
+		t.Errorf("expected only scan.pdf on disk, got %v", got)
+	}
+	stored, _ := os.ReadFile(filepath.Join(p.Dir, "scan.pdf"))
+	if string(stored) != string(original) {
+		t.Errorf("stored file was modified by the duplicate upload")
+	}
+}
+
+func TestIngestDoesNotOverwriteSameName(t *testing.T) {
+	p := newPipeline(t)
+	for _, f := range []string{"test1.pdf", "test2.pdf"} {
+		in, err := os.Open(filepath.Join("../pdf/testdata", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.Ingest(ctx, "scan.pdf", in, Options{})
+		in.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := files(t, p.Dir)
+	if len(got) != 2 {
+		t.Errorf("expected two files on disk, got %v", got)
+	}
+}
+
+func TestIngestFailureCleansUp(t *testing.T) {
+	p := newPipeline(t)
+
+	// Not a PDF, so the creation date cannot be extracted
+	_, err := p.Ingest(ctx, "notes.txt", strings.NewReader("hello"), Options{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := files(t, p.Dir); len(got) != 0 {
+		t.Errorf("expected no files on disk, got %v", got)
+	}
+	if docs, _ := p.DB.GetDocuments(ctx); len(docs) != 0 {
+		t.Errorf("expected no documents, got %d", len(docs))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	p := newPipeline(t)
+	tmpDir := filepath.Join(p.Dir, tmpDirName)
+	os.MkdirAll(tmpDir, 0755)
+
+	stale := filepath.Join(tmpDir, "upload-stale")
+	fresh := filepath.Join(tmpDir, "upload-fresh")
+	os.WriteFile(stale, []byte("x"), 0644)
+	os.WriteFile(fresh, []byte("x"), 0644)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(stale, old, old)
+
+	n, err := p.Sweep(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 file removed, got %d", n)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh file was removed")
+	}
+}
+
+func TestIngestVersion(t *testing.T) {
+	p := newPipeline(t)
+	doc, err := p.IngestFile(ctx, "../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Open("../pdf/testdata/test2.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	updated, err := p.IngestVersion(ctx, doc.ID, "test1.pdf", second, "signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != 2 || updated.Opts.Hash == doc.Opts.Hash || updated.Opts.Title != doc.Opts.Title {
+		t.Errorf("unexpected document after new version: %+v", updated)
+	}
+
+	// The old file is kept and still counts as known
+	versions, err := p.DB.GetVersions(ctx, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Number != 1 || versions[0].Hash != doc.Opts.Hash {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	if _, err := os.Stat(versions[0].Path); err != nil {
+		t.Errorf("old file is gone: %v", err)
+	}
+	if exists, _, _ := p.DB.DocumentExistsByHash(doc.Opts.Hash); !exists {
+		t.Errorf("version hash is not considered known")
+	}
+	if _, err := p.IngestFile(ctx, "../pdf/testdata/test1.pdf"); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("expected ErrDuplicate for a version's file, got %v", err)
+	}
+
+	restored, err := p.DB.RestoreVersion(ctx, doc.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Version != 3 || restored.Opts.Hash != doc.Opts.Hash || restored.Opts.Path != doc.Opts.Path {
+		t.Errorf("unexpected document after restore: %+v", restored)
+	}
+	versions, _ = p.DB.GetVersions(ctx, doc.ID)
+	if len(versions) != 1 || versions[0].Number != 2 || versions[0].Hash != updated.Opts.Hash {
+		t.Errorf("unexpected versions after restore %+v", versions)
+	}
+
+	// Removing the document removes every file
+	if err := p.DB.RemoveDocument(ctx, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := files(t, p.Dir); len(got) != 0 {
+		t.Errorf("files left behind: %v", got)
+	}
+}
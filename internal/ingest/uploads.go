@@ -0,0 +1,214 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+// uploadsDirName is the directory inside the documents directory that holds
+// the data of resumable uploads until they are complete
+const uploadsDirName = ".uploads"
+
+// UploadExpiry is how long an upload is kept after data last arrived
+const UploadExpiry = 24 * time.Hour
+
+// MaxUploadSize limits the length of resumable uploads
+const MaxUploadSize = 1 << 30
+
+// busyUploads keeps requests from working on the same upload at once
+var busyUploads = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// CreateUpload starts a resumable upload of length bytes for the user in
+// ctx. Once all data arrived the file is ingested under the given name.
+func (p *Pipeline) CreateUpload(ctx context.Context, name string, length int64, opts Options) (db.Upload, error) {
+	if length <= 0 || length > MaxUploadSize {
+		return db.Upload{}, &db.Error{Kind: db.ErrValidation, Field: "Upload-Length",
+			Message: fmt.Sprintf("Upload-Length must be between 1 and %d", MaxUploadSize)}
+	}
+	if err := os.MkdirAll(filepath.Join(p.Dir, uploadsDirName), 0755); err != nil {
+		return db.Upload{}, fmt.Errorf("failed to create uploads directory: %w", err)
+	}
+
+	u, err := p.DB.NewUpload(ctx, db.Upload{
+		Filename:  name,
+		Title:     opts.Title,
+		Content:   opts.Content,
+		Length:    length,
+		ExpiresAt: time.Now().Add(UploadExpiry),
+	})
+	if err != nil {
+		return db.Upload{}, err
+	}
+	f, err := os.Create(p.uploadPath(u.ID))
+	if err != nil {
+		p.DB.RemoveUpload(u.ID)
+		return db.Upload{}, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	f.Close()
+	return u, nil
+}
+
+// WriteUpload appends the data read from r to an upload of the user in ctx.
+// offset is where the client thinks the upload stands and has to match.
+// Everything stored before r fails counts, so that the client can resume
+// from there. The upload is returned with its new offset.
+func (p *Pipeline) WriteUpload(ctx context.Context, id string, offset int64, r io.Reader) (db.Upload, error) {
+	unlock, err := lockUpload(id)
+	if err != nil {
+		return db.Upload{}, err
+	}
+	defer unlock()
+
+	u, err := p.DB.GetUpload(ctx, id)
+	if err != nil {
+		return db.Upload{}, err
+	}
+	if offset != u.Offset {
+		return u, &db.Error{Kind: db.ErrConflict, Code: "offset_mismatch",
+			Message: fmt.Sprintf("upload is at offset %d, not %d", u.Offset, offset)}
+	}
+
+	f, err := os.OpenFile(p.uploadPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		return u, fmt.Errorf("failed to open upload file: %w", err)
+	}
+	defer f.Close()
+	// Drop data written after the offset was last recorded, e.g. before a crash
+	if err := f.Truncate(u.Offset); err != nil {
+		return u, fmt.Errorf("failed to truncate upload file: %w", err)
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return u, fmt.Errorf("failed to seek upload file: %w", err)
+	}
+
+	n, copyErr := io.Copy(f, io.LimitReader(r, u.Length-u.Offset))
+	if err := f.Sync(); err != nil {
+		return u, fmt.Errorf("failed to save upload: %w", err)
+	}
+	u.Offset += n
+	u.ExpiresAt = time.Now().Add(UploadExpiry).UTC()
+	if err := p.DB.SetUploadOffset(id, u.Offset, u.ExpiresAt); err != nil {
+		return u, err
+	}
+	if copyErr != nil {
+		return u, fmt.Errorf("failed to receive upload: %w", copyErr)
+	}
+	return u, nil
+}
+
+// FinishUpload ingests a complete upload of the user in ctx and removes it.
+// Uploads that turn out to be duplicates are removed as well.
+func (p *Pipeline) FinishUpload(ctx context.Context, id string) (db.Document, error) {
+	unlock, err := lockUpload(id)
+	if err != nil {
+		return db.Document{}, err
+	}
+	defer unlock()
+
+	u, err := p.DB.GetUpload(ctx, id)
+	if err != nil {
+		return db.Document{}, err
+	}
+	if u.Offset != u.Length {
+		return db.Document{}, &db.Error{Kind: db.ErrConflict, Code: "upload_incomplete",
+			Message: fmt.Sprintf("upload has %d of %d bytes", u.Offset, u.Length)}
+	}
+
+	f, err := os.Open(p.uploadPath(id))
+	if err != nil {
+		return db.Document{}, fmt.Errorf("failed to open upload file: %w", err)
+	}
+	doc, err := p.Ingest(ctx, u.Filename, f, Options{Title: u.Title, Content: u.Content})
+	f.Close()
+	if err != nil && !errors.Is(err, ErrDuplicate) && !errors.Is(err, ErrInTrash) {
+		// Keep the data, finishing can be retried
+		return db.Document{}, err
+	}
+	if err := p.removeUpload(id); err != nil {
+		return doc, err
+	}
+	return doc, err
+}
+
+// RemoveUpload cancels an upload of the user in ctx
+func (p *Pipeline) RemoveUpload(ctx context.Context, id string) error {
+	unlock, err := lockUpload(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := p.DB.GetUpload(ctx, id); err != nil {
+		return err
+	}
+	return p.removeUpload(id)
+}
+
+// ExpireUploads removes the uploads that expired before now and returns how
+// many there were. Uploads busy with a request are left for the next time.
+func (p *Pipeline) ExpireUploads(now time.Time) (int, error) {
+	ids, err := p.DB.ExpiredUploads(now)
+	if err != nil {
+		return 0, err
+	}
+
+	var expired int
+	for _, id := range ids {
+		unlock, err := lockUpload(id)
+		if err != nil {
+			continue
+		}
+		// Data may have arrived since the list was read
+		removed, err := p.DB.RemoveExpiredUpload(id, now)
+		if err == nil && removed {
+			err = os.Remove(p.uploadPath(id))
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+			expired++
+		}
+		unlock()
+		if err != nil {
+			return expired, fmt.Errorf("failed to expire upload: %w", err)
+		}
+	}
+	return expired, nil
+}
+
+func (p *Pipeline) removeUpload(id string) error {
+	if err := os.Remove(p.uploadPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove upload file: %w", err)
+	}
+	return p.DB.RemoveUpload(id)
+}
+
+func (p *Pipeline) uploadPath(id string) string {
+	return filepath.Join(p.Dir, uploadsDirName, id)
+}
+
+// lockUpload marks an upload as busy, failing when another request is
+// working on it
+func lockUpload(id string) (unlock func(), err error) {
+	busyUploads.Lock()
+	defer busyUploads.Unlock()
+	if busyUploads.ids[id] {
+		return nil, &db.Error{Kind: db.ErrConflict, Code: "upload_locked", Message: "upload is busy with another request"}
+	}
+	busyUploads.ids[id] = true
+	return func() {
+		busyUploads.Lock()
+		delete(busyUploads.ids, id)
+		busyUploads.Unlock()
+	}, nil
+}
@@ -0,0 +1,161 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+// failingReader returns its data and then an error, like a dropped
+// connection
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestResumableUpload(t *testing.T) {
+	p := newPipeline(t)
+	original, err := os.ReadFile("../pdf/testdata/test1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := int64(len(original))
+
+	u, err := p.CreateUpload(ctx, "scan.pdf", length, Options{Title: "March"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection drops after the first third
+	third := length / 3
+	u, err = p.WriteUpload(ctx, u.ID, 0, &failingReader{data: original[:third]})
+	if err == nil {
+		t.Fatal("expected the interrupted write to fail")
+	}
+	if u.Offset != third {
+		t.Fatalf("expected the received data to count, offset is %d", u.Offset)
+	}
+
+	// Resuming from the wrong offset is refused
+	_, err = p.WriteUpload(ctx, u.ID, 0, bytes.NewReader(original))
+	var dbErr *db.Error
+	if !errors.As(err, &dbErr) || dbErr.Code != "offset_mismatch" {
+		t.Fatalf("expected an offset mismatch, got %v", err)
+	}
+	if _, err := p.FinishUpload(ctx, u.ID); !errors.Is(err, db.ErrConflict) {
+		t.Fatalf("expected an incomplete upload not to finish, got %v", err)
+	}
+
+	u, err = p.WriteUpload(ctx, u.ID, third, bytes.NewReader(original[third:2*third]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data beyond Upload-Length is ignored
+	u, err = p.WriteUpload(ctx, u.ID, 2*third, io.MultiReader(bytes.NewReader(original[2*third:]), bytes.NewReader([]byte("junk"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Offset != length {
+		t.Fatalf("expected the upload to be complete, offset is %d of %d", u.Offset, length)
+	}
+
+	doc, err := p.FinishUpload(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Opts.Title != "March" {
+		t.Errorf("expected the title of the upload, got %q", doc.Opts.Title)
+	}
+	stored, _ := os.ReadFile(doc.Opts.Path)
+	if !bytes.Equal(stored, original) {
+		t.Error("stored file differs from the uploaded one")
+	}
+	if _, err := p.DB.GetUpload(ctx, u.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("expected the finished upload to be removed, got %v", err)
+	}
+	if got := files(t, p.Dir); len(got) != 1 {
+		t.Errorf("expected only the document on disk, got %v", got)
+	}
+}
+
+func TestUploadBelongsToUser(t *testing.T) {
+	p := newPipeline(t)
+	alice, err := p.DB.NewUser("alice", "password", db.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := p.CreateUpload(ctx, "scan.pdf", 10, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceCtx := db.WithUser(ctx, alice)
+	if _, err := p.WriteUpload(aliceCtx, u.ID, 0, bytes.NewReader([]byte("0123456789"))); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("expected another user's upload not to be found, got %v", err)
+	}
+	if err := p.RemoveUpload(aliceCtx, u.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("expected another user's upload not to be found, got %v", err)
+	}
+	if err := p.RemoveUpload(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := files(t, p.Dir); len(got) != 0 {
+		t.Errorf("expected the data to be removed, got %v", got)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	p := newPipeline(t)
+	if _, err := p.CreateUpload(ctx, "scan.pdf", 0, Options{}); err == nil {
+		t.Error("expected an error for an empty upload")
+	}
+
+	u, err := p.CreateUpload(ctx, "scan.pdf", 10, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.WriteUpload(ctx, u.ID, 0, bytes.NewReader([]byte("01234"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := p.ExpireUploads(time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to expire yet, got %d, %v", n, err)
+	}
+	// An upload busy with a request is not expired under its feet
+	unlock, err := lockUpload(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := p.ExpireUploads(time.Now().Add(UploadExpiry + time.Minute)); err != nil || n != 0 {
+		t.Fatalf("expected a busy upload not to expire, got %d, %v", n, err)
+	}
+	unlock()
+
+	n, err := p.ExpireUploads(time.Now().Add(UploadExpiry + time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("expected the upload to expire, got %d, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(p.Dir, uploadsDirName, u.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the data to be removed, got %v", err)
+	}
+	if _, err := p.DB.GetUpload(ctx, u.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("expected the upload to be gone, got %v", err)
+	}
+	if len(busyUploads.ids) != 0 {
+		t.Errorf("expected no upload to be marked busy, got %v", busyUploads.ids)
+	}
+}
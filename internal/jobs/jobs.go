@@ -0,0 +1,132 @@
+// Package jobs runs bulk actions on documents in the background and keeps
+// their progress for clients to poll or follow on the event bus
+package jobs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/events"
+)
+
+// Job statuses
+const (
+	StatusRunning = "running"
+	StatusDone    = "done"
+)
+
+// retention is how long finished jobs can still be looked up
+const retention = time.Hour
+
+// Job is a bulk action applied to one document after the other, each in
+// its own transaction, so that failures don't affect the other documents
+type Job struct {
+	ID         int
+	UserID     int
+	Action     string
+	Status     string
+	Total      int // number of documents
+	Results    []db.BulkResult
+	CreatedAt  time.Time
+	FinishedAt *time.Time
+}
+
+// Registry holds the jobs of the running server
+type Registry struct {
+	db   *db.DB
+	mu   sync.Mutex
+	next int
+	jobs map[int]*Job
+}
+
+// New creates an empty registry
+func New(database *db.DB) *Registry {
+	return &Registry{db: database, jobs: make(map[int]*Job)}
+}
+
+// Start applies action to the documents in the background, as the user in
+// ctx. The action has to be valid, see db.ValidateBulk.
+func (r *Registry) Start(ctx context.Context, ids []int, action db.BulkAction) Job {
+	user, _ := db.UserFromContext(ctx)
+	// The job outlives the request it was started by
+	ctx = context.WithoutCancel(ctx)
+
+	r.mu.Lock()
+	r.prune()
+	r.next++
+	job := &Job{
+		ID:        r.next,
+		UserID:    user.ID,
+		Action:    action.Action,
+		Status:    StatusRunning,
+		Total:     len(ids),
+		CreatedAt: time.Now().UTC(),
+	}
+	r.jobs[job.ID] = job
+	snapshot := job.snapshot()
+	r.mu.Unlock()
+
+	go func() {
+		for _, id := range ids {
+			result := db.BulkResult{DocumentID: id}
+			results, err := r.db.ApplyBulk(ctx, []int{id}, action)
+			if err != nil {
+				result.Err = err
+			} else {
+				result = results[0]
+			}
+			if result.Err != nil {
+				log.Printf("Job %d: %s failed for document %d: %v\n", job.ID, action.Action, id, result.Err)
+			}
+
+			r.mu.Lock()
+			job.Results = append(job.Results, result)
+			snapshot := job.snapshot()
+			r.mu.Unlock()
+			r.publish("job.progress", snapshot)
+		}
+
+		r.mu.Lock()
+		now := time.Now().UTC()
+		job.Status, job.FinishedAt = StatusDone, &now
+		snapshot := job.snapshot()
+		r.mu.Unlock()
+		r.publish("job.done", snapshot)
+	}()
+	return snapshot
+}
+
+// Get returns the current state of a job
+func (r *Registry) Get(id int) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// publish tells the user who started the job about its progress
+func (r *Registry) publish(typ string, job Job) {
+	r.db.Events().Publish(events.Event{Type: typ, UserID: job.UserID, Data: job})
+}
+
+// prune forgets jobs that finished more than retention ago
+func (r *Registry) prune() {
+	for id, job := range r.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > retention {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// snapshot copies the job, so that it can be read without holding the lock
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Results = append([]db.BulkResult(nil), j.Results...)
+	return c
+}
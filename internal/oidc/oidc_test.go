@@ -0,0 +1,233 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider is a minimal in-process OpenID Connect provider
+type fakeProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	groups []string
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorization request
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeProvider{key: key, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "PKCE required", http.StatusBadRequest)
+			return
+		}
+		code, _ := RandomString()
+		f.mu.Lock()
+		f.codes[code] = q
+		f.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "cellulose" || secret != "s3cret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		auth, ok := f.codes[r.PostFormValue("code")]
+		delete(f.codes, r.PostFormValue("code"))
+		f.mu.Unlock()
+		if !ok || challenge(r.PostFormValue("code_verifier")) != auth.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "unused",
+			"token_type":   "Bearer",
+			"id_token": f.sign(t, map[string]any{
+				"iss":                f.URL,
+				"sub":                "42",
+				"aud":                "cellulose",
+				"exp":                time.Now().Add(time.Hour).Unix(),
+				"iat":                time.Now().Unix(),
+				"nonce":              auth.Get("nonce"),
+				"preferred_username": "alice",
+				"groups":             f.groups,
+			}),
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// sign returns a RS256 identity token with the given claims
+func (f *fakeProvider) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestProvider(t *testing.T, f *fakeProvider) *Provider {
+	p, err := New(context.Background(), Config{
+		Issuer:       f.URL,
+		ClientID:     "cellulose",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://cellulose.test/api/auth/oidc/callback",
+		AdminGroups:  []string{"paperwork-admins"},
+	}, f.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// authorize follows the login redirect and returns the code the provider
+// hands back to the client
+func authorize(t *testing.T, f *fakeProvider, authURL, state string) string {
+	client := f.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected authorization response %s", resp.Status)
+	}
+	if loc.Query().Get("state") != state {
+		t.Fatalf("state not returned")
+	}
+	return loc.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	f := newFakeProvider(t)
+	f.groups = []string{"staff", "paperwork-admins"}
+	p := newTestProvider(t, f)
+	ctx := context.Background()
+
+	state, _ := RandomString()
+	nonce, _ := RandomString()
+	verifier, _ := RandomString()
+	code := authorize(t, f, p.AuthCodeURL(state, nonce, verifier), state)
+
+	claims, err := p.Exchange(ctx, code, verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" || claims.Username() != "alice" || claims.Issuer != f.URL {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if !p.IsAdmin(claims) {
+		t.Errorf("admin group not mapped")
+	}
+
+	// Codes are single use
+	if _, err := p.Exchange(ctx, code, verifier, nonce); err == nil {
+		t.Errorf("code redeemed twice")
+	}
+}
+
+func TestLoginRejectsWrongVerifier(t *testing.T) {
+	f := newFakeProvider(t)
+	p := newTestProvider(t, f)
+
+	state, _ := RandomString()
+	verifier, _ := RandomString()
+	code := authorize(t, f, p.AuthCodeURL(state, "n", verifier), state)
+	if _, err := p.Exchange(context.Background(), code, verifier+"x", "n"); err == nil {
+		t.Fatal("expected the token endpoint to reject the verifier")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f := newFakeProvider(t)
+	p := newTestProvider(t, f)
+	ctx := context.Background()
+
+	claims := func() map[string]any {
+		return map[string]any{
+			"iss":   f.URL,
+			"sub":   "42",
+			"aud":   []string{"cellulose"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "n",
+		}
+	}
+	if _, err := p.Verify(ctx, f.sign(t, claims()), "n"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	tests := map[string]func(c map[string]any){
+		"wrong issuer":   func(c map[string]any) { c["iss"] = "https://evil.test" },
+		"wrong audience": func(c map[string]any) { c["aud"] = "someone-else" },
+		"expired":        func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"wrong nonce":    func(c map[string]any) { c["nonce"] = "other" },
+	}
+	for name, modify := range tests {
+		c := claims()
+		modify(c)
+		if _, err := p.Verify(ctx, f.sign(t, c), "n"); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	// Tampered payload and unsigned tokens
+	token := f.sign(t, claims())
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]any{"iss": f.URL, "sub": "1", "aud": "cellulose", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n"})
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := p.Verify(ctx, strings.Join(parts, "."), "n"); err == nil {
+		t.Errorf("tampered token accepted")
+	}
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test"}`))
+	if _, err := p.Verify(ctx, none+"."+parts[1]+".", "n"); err == nil {
+		t.Errorf("unsigned token accepted")
+	}
+}
@@ -0,0 +1,111 @@
+// Package openapi holds the OpenAPI description of the HTTP API and checks
+// requests against it
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var document []byte
+
+// JSON returns the specification as served to clients
+func JSON() []byte {
+	return document
+}
+
+// Spec is the part of the specification needed to validate requests
+type Spec struct {
+	Paths      map[string]map[string]*Operation
+	Components struct {
+		Schemas map[string]*Schema
+	}
+}
+
+// Operation is a method of a path
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	Parameters  []Parameter  `json:"parameters"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+// Parameter is a path or query parameter of an operation
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody lists the schemas of the accepted media types
+type RequestBody struct {
+	Required bool `json:"required"`
+	Content  map[string]struct {
+		Schema *Schema `json:"schema"`
+	} `json:"content"`
+}
+
+// Load parses the embedded specification
+func Load() (*Spec, error) {
+	var spec Spec
+	if err := json.Unmarshal(document, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse API specification: %w", err)
+	}
+	return &spec, nil
+}
+
+// Operations lists the operations of the specification like "GET /api/tags"
+func (s *Spec) Operations() []string {
+	var ops []string
+	for path, methods := range s.Paths {
+		for method := range methods {
+			ops = append(ops, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// Find returns the operation matching the method and path of a request
+// together with the values of its path parameters. Literal path segments
+// take precedence over parameters, like they do in http.ServeMux.
+func (s *Spec) Find(method, path string) (*Operation, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	var (
+		found    *Operation
+		params   map[string]string
+		literals = -1
+	)
+	for template, methods := range s.Paths {
+		op, ok := methods[strings.ToLower(method)]
+		if !ok {
+			continue
+		}
+		parts := strings.Split(strings.Trim(template, "/"), "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+
+		values := make(map[string]string)
+		n := 0
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				values[part[1:len(part)-1]] = segments[i]
+			} else if part == segments[i] {
+				n++
+			} else {
+				values = nil
+				break
+			}
+		}
+		if values != nil && n > literals {
+			found, params, literals = op, values, n
+		}
+	}
+	return found, params
+}
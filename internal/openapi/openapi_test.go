@@ -0,0 +1,138 @@
+package openapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSpecIsConsistent(t *testing.T) {
+	spec, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]string)
+	for path, methods := range spec.Paths {
+		for method, op := range methods {
+			if other, ok := ids[op.OperationID]; ok || op.OperationID == "" {
+				t.Errorf("%s %s: operation ID %q not unique, also used by %s", method, path, op.OperationID, other)
+			}
+			ids[op.OperationID] = method + " " + path
+		}
+	}
+
+	// Every reference has to point to a schema
+	var doc any
+	if err := json.Unmarshal(JSON(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	var check func(v any)
+	check = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok && !strings.HasPrefix(ref, "#/components/responses/") {
+				name := strings.TrimPrefix(ref, "#/components/schemas/")
+				if _, ok := spec.Components.Schemas[name]; !ok {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, child := range v {
+				check(child)
+			}
+		case []any:
+			for _, child := range v {
+				check(child)
+			}
+		}
+	}
+	check(doc)
+}
+
+func TestFind(t *testing.T) {
+	spec, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op, params := spec.Find("POST", "/api/documents/7/versions/2/restore")
+	if op == nil || op.OperationID != "restoreDocumentVersion" || params["id"] != "7" || params["version"] != "2" {
+		t.Errorf("unexpected match %+v %v", op, params)
+	}
+	if op, _ := spec.Find("GET", "/"); op == nil || op.OperationID != "indexPage" {
+		t.Errorf("expected the index page, got %+v", op)
+	}
+	if op, _ := spec.Find("PUT", "/api/tags"); op != nil {
+		t.Errorf("expected no match, got %+v", op)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	spec, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+		fields               []string
+	}{
+		{"POST", "/api/tags", `{"name": "bills", "color": "#ff0000"}`, nil},
+		{"POST", "/api/tags", `{"color": "red", "parent_id": "1"}`, []string{"name", "color", "parent_id"}},
+		{"POST", "/api/tags", `[]`, []string{"body"}},
+		{"POST", "/api/tags", `{`, []string{"body"}},
+		{"POST", "/api/tags", ``, []string{"body"}},
+		{"PATCH", "/api/tags/1", `{"parent_id": null}`, nil},
+		{"PATCH", "/api/tags/x", `{"parent_id": 1.5}`, []string{"id", "parent_id"}},
+		{"POST", "/api/correspondents", `{"name": "ACME", "match": {"algorithm": "fuzzy"}}`, []string{"match.algorithm"}},
+		{"POST", "/api/tokens", `{"name": "ci", "scopes": ["read", "root"], "expires_at": "tomorrow"}`, []string{"expires_at", "scopes[1]"}},
+		{"POST", "/api/tokens", `{"name": "ci", "scopes": []}`, []string{"scopes"}},
+		{"GET", "/api/documents?tag=1&tag=2&correspondent=none", ``, nil},
+		{"GET", "/api/documents?tag=1&tag=x&correspondent=acme", ``, []string{"correspondent", "tag[1]"}},
+		{"GET", "/api/audit?limit=10&since=2025-01-01T00:00:00Z", ``, nil},
+		{"DELETE", "/api/tags/1?children=orphan", ``, []string{"children"}},
+		{"POST", "/api/auth/login", `username=admin`, nil},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		if strings.HasPrefix(tc.body, "username") {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		op, params := spec.Find(r.Method, r.URL.Path)
+		if op == nil {
+			t.Fatalf("%s %s: no operation", tc.method, tc.target)
+		}
+
+		var fields []string
+		for _, e := range spec.Validate(r, op, params) {
+			fields = append(fields, e.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tc.fields, ",") {
+			t.Errorf("%s %s %s: expected errors for %v, got %v", tc.method, tc.target, tc.body, tc.fields, fields)
+		}
+
+		// The handler still gets the whole body
+		if body, _ := io.ReadAll(r.Body); string(body) != tc.body {
+			t.Errorf("%s %s: body changed to %q", tc.method, tc.target, body)
+		}
+	}
+}
+
+func TestValidateLimitsBody(t *testing.T) {
+	spec, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"name": "` + strings.Repeat("a", MaxBodySize) + `"}`
+	r := httptest.NewRequest("POST", "/api/tags", strings.NewReader(body))
+	op, params := spec.Find(r.Method, r.URL.Path)
+	if op == nil {
+		t.Fatal("no operation")
+	}
+	errs := spec.Validate(r, op, params)
+	if len(errs) != 1 || errs[0].Field != "body" || !strings.Contains(errs[0].Message, "larger") {
+		t.Errorf("expected the body to be rejected as too large, got %v", errs)
+	}
+}
@@ -0,0 +1,319 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// Schema is the subset of JSON Schema used to describe requests. Keywords
+// not listed here are accepted and ignored.
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       Types              `json:"type"`
+	Properties map[string]*Schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *Schema            `json:"items"`
+	AllOf      []*Schema          `json:"allOf"`
+	Enum       []any              `json:"enum"`
+	Format     string             `json:"format"`
+	Pattern    string             `json:"pattern"`
+	MinLength  *int               `json:"minLength"`
+	MinItems   *int               `json:"minItems"`
+	Minimum    *float64           `json:"minimum"`
+
+	once    sync.Once
+	pattern *regexp.Regexp
+}
+
+// Types are the allowed JSON types of a value. The specification may give
+// a single type or a list of them.
+type Types []string
+
+func (t *Types) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+func (t Types) allows(typ string) bool {
+	for _, allowed := range t {
+		if allowed == typ || (allowed == "number" && typ == "integer") {
+			return true
+		}
+	}
+	return len(t) == 0
+}
+
+func (t Types) has(typ string) bool {
+	for _, listed := range t {
+		if listed == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxBodySize limits the JSON bodies read for validation, like the handlers
+// limit uploads
+const MaxBodySize = 25 << 20
+
+// Validate checks the parameters and the JSON body of a request for op
+// against the specification. The body is read and put back, so that the
+// handler can still decode it. Bodies larger than MaxBodySize are rejected.
+func (s *Spec) Validate(r *http.Request, op *Operation, pathParams map[string]string) []problem.FieldError {
+	var errs []problem.FieldError
+
+	query := r.URL.Query()
+	for _, p := range op.Parameters {
+		var values []string
+		switch p.In {
+		case "path":
+			values = []string{pathParams[p.Name]}
+		case "query":
+			values = query[p.Name]
+		default:
+			continue
+		}
+		if len(values) == 0 {
+			if p.Required {
+				errs = append(errs, fieldError(p.Name, "is required"))
+			}
+			continue
+		}
+
+		schema := s.resolve(p.Schema)
+		var value any
+		if schema != nil && schema.Type.has("array") {
+			items := make([]any, len(values))
+			for i, v := range values {
+				items[i] = parseParam(v, s.resolve(schema.Items))
+			}
+			value = items
+		} else {
+			value = parseParam(values[0], schema)
+		}
+		s.validate(value, schema, p.Name, &errs)
+	}
+
+	if op.RequestBody != nil && s.isJSON(r, op.RequestBody) {
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, MaxBodySize))
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return append(errs, fieldError("body", fmt.Sprintf("must not be larger than %d bytes", MaxBodySize)))
+		}
+		if err != nil {
+			return append(errs, fieldError("body", "could not be read"))
+		}
+
+		if len(bytes.TrimSpace(body)) == 0 {
+			if op.RequestBody.Required {
+				errs = append(errs, fieldError("body", "is required"))
+			}
+			return errs
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			return append(errs, fieldError("body", "is not valid JSON"))
+		}
+		s.validate(value, op.RequestBody.Content["application/json"].Schema, "", &errs)
+	}
+	return errs
+}
+
+// isJSON reports whether the body of r is to be validated as JSON. Bodies
+// of media types the operation doesn't accept are decoded as JSON by the
+// handlers, so they are checked too.
+func (s *Spec) isJSON(r *http.Request, body *RequestBody) bool {
+	if _, ok := body.Content["application/json"]; !ok {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	_, declared := body.Content[mediaType]
+	return mediaType == "application/json" || !declared
+}
+
+// parseParam converts a parameter to the JSON type its schema asks for.
+// Values that don't convert stay strings and fail validation.
+func parseParam(value string, schema *Schema) any {
+	if schema == nil {
+		return value
+	}
+	switch {
+	case schema.Type.has("integer"):
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return json.Number(value)
+		}
+	case schema.Type.has("number"):
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case schema.Type.has("boolean"):
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// resolve follows a reference to the components of the specification
+func (s *Spec) resolve(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+func (s *Spec) validate(value any, schema *Schema, field string, errs *[]problem.FieldError) {
+	schema = s.resolve(schema)
+	if schema == nil {
+		return
+	}
+	for _, sub := range schema.AllOf {
+		s.validate(value, sub, field, errs)
+	}
+
+	typ := jsonType(value)
+	if !schema.Type.allows(typ) {
+		*errs = append(*errs, fieldError(field, "must be "+article(strings.Join(schema.Type, " or "))))
+		return
+	}
+	if len(schema.Enum) > 0 && !inEnum(value, schema.Enum) {
+		allowed := make([]string, 0, len(schema.Enum))
+		for _, e := range schema.Enum {
+			if e != "" {
+				allowed = append(allowed, fmt.Sprint(e))
+			}
+		}
+		*errs = append(*errs, fieldError(field, "must be one of "+strings.Join(allowed, ", ")))
+		return
+	}
+
+	switch v := value.(type) {
+	case string:
+		if schema.MinLength != nil && utf8.RuneCountInString(v) < *schema.MinLength {
+			if *schema.MinLength == 1 {
+				*errs = append(*errs, fieldError(field, "must not be empty"))
+			} else {
+				*errs = append(*errs, fieldError(field, fmt.Sprintf("must be at least %d characters long", *schema.MinLength)))
+			}
+		}
+		if schema.Pattern != "" && !schema.compiled().MatchString(v) {
+			*errs = append(*errs, fieldError(field, "must match "+schema.Pattern))
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				*errs = append(*errs, fieldError(field, "must be an RFC 3339 timestamp"))
+			}
+		}
+	case json.Number:
+		if schema.Minimum != nil {
+			if f, _ := v.Float64(); f < *schema.Minimum {
+				*errs = append(*errs, fieldError(field, fmt.Sprintf("must be at least %v", *schema.Minimum)))
+			}
+		}
+	case []any:
+		if schema.MinItems != nil && len(v) < *schema.MinItems {
+			*errs = append(*errs, fieldError(field, fmt.Sprintf("must have at least %d items", *schema.MinItems)))
+		}
+		for i, item := range v {
+			s.validate(item, schema.Items, fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, fieldError(join(field, name), "is required"))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := schema.Properties[name]; ok {
+				s.validate(v[name], prop, join(field, name), errs)
+			}
+		}
+	}
+}
+
+func (s *Schema) compiled() *regexp.Regexp {
+	s.once.Do(func() { s.pattern = regexp.MustCompile(s.Pattern) })
+	return s.pattern
+}
+
+// jsonType names the JSON type of a decoded value
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func inEnum(value any, enum []any) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// article prefixes a type name with "a" or "an"
+func article(typ string) string {
+	if typ == "null" {
+		return typ
+	}
+	if strings.ContainsRune("aeiou", rune(typ[0])) {
+		return "an " + typ
+	}
+	return "a " + typ
+}
+
+func join(field, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func fieldError(field, message string) problem.FieldError {
+	if field == "" {
+		field = "body"
+	}
+	return problem.FieldError{Field: field, Message: field + " " + message}
+}
@@ -0,0 +1,128 @@
+// Package problem writes error responses as RFC 7807 problem details, so
+// that API clients can tell what went wrong from the code instead of
+// parsing messages
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+// ContentType is the media type of problem details
+const ContentType = "application/problem+json"
+
+// CodeInternal is the code of errors of no known kind
+const CodeInternal = "internal_server_error"
+
+// Details is the body of an error response. Code is machine readable and
+// stable, Detail is meant for humans.
+type Details struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes an invalid input of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Write responds with d, filling in the type, title and code from the
+// status where they are empty
+func Write(w http.ResponseWriter, d Details) {
+	if d.Type == "" {
+		d.Type = "about:blank"
+	}
+	if d.Title == "" {
+		d.Title = http.StatusText(d.Status)
+	}
+	if d.Code == "" {
+		d.Code = statusCode(d.Status)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(d.Status)
+	json.NewEncoder(w).Encode(d)
+}
+
+// Error is the problem details counterpart of http.Error
+func Error(w http.ResponseWriter, detail string, status int) {
+	Write(w, Details{Status: status, Detail: detail})
+}
+
+// Invalid responds that an input of the request is invalid
+func Invalid(w http.ResponseWriter, field, message string) {
+	Write(w, Details{
+		Status: http.StatusBadRequest,
+		Detail: message,
+		Code:   "validation_failed",
+		Errors: []FieldError{{Field: field, Message: message}},
+	})
+}
+
+// FromError responds according to the kind of err, see db.Error. Errors of
+// no known kind are logged and reported as internal errors with message as
+// detail, so that internals don't leak to clients.
+func FromError(w http.ResponseWriter, err error, message string) {
+	status, code := classify(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("%s: %v\n", message, err)
+		Error(w, message, status)
+		return
+	}
+
+	d := Details{Status: status, Detail: err.Error(), Code: code}
+	var dbErr *db.Error
+	if errors.As(err, &dbErr) && dbErr.Kind == db.ErrValidation && dbErr.Field != "" {
+		d.Errors = []FieldError{{Field: dbErr.Field, Message: dbErr.Message}}
+	}
+	Write(w, d)
+}
+
+// Code returns the code FromError would respond with for err
+func Code(err error) string {
+	_, code := classify(err)
+	return code
+}
+
+func classify(err error) (int, string) {
+	var status int
+	var code string
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		status, code = http.StatusNotFound, "not_found"
+	case errors.Is(err, db.ErrConflict):
+		status, code = http.StatusConflict, "conflict"
+	case errors.Is(err, db.ErrValidation):
+		status, code = http.StatusBadRequest, "validation_failed"
+	case errors.Is(err, db.ErrForbidden):
+		status, code = http.StatusForbidden, "forbidden"
+	default:
+		return http.StatusInternalServerError, CodeInternal
+	}
+
+	var dbErr *db.Error
+	if errors.As(err, &dbErr) && dbErr.Code != "" {
+		code = dbErr.Code
+	}
+	return status, code
+}
+
+// statusCode derives a code from the status, like "not_found" for 404
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.ReplaceAll(text, " ", "_"))
+}
@@ -0,0 +1,217 @@
+// Package webhooks sends the events of the library to the URLs subscribed
+// to them. Every event is first stored as a delivery, so that deliveries
+// survive restarts and failed ones can be retried.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/events"
+)
+
+// Headers sent with every delivery. The signature is the hex encoded
+// HMAC-SHA256 of the body, keyed with the secret of the webhook and
+// prefixed with "sha256=".
+const (
+	HeaderEvent     = "X-Cellulose-Event"
+	HeaderDelivery  = "X-Cellulose-Delivery"
+	HeaderSignature = "X-Cellulose-Signature"
+)
+
+// Config configures retries
+type Config struct {
+	Backoff     time.Duration // delay before the first retry, doubled for every further one
+	MaxAttempts int           // attempts before a delivery is given up
+	Poll        time.Duration // how often due retries are looked for
+	Timeout     time.Duration // for a single attempt
+}
+
+// DefaultConfig retries for about two hours before giving up
+var DefaultConfig = Config{
+	Backoff:     time.Minute,
+	MaxAttempts: 8,
+	Poll:        10 * time.Second,
+	Timeout:     10 * time.Second,
+}
+
+// batchSize is how many due deliveries are sent at a time
+const batchSize = 50
+
+// Payload is the body of a delivery
+type Payload struct {
+	Event     string        `json:"event"`
+	CreatedAt time.Time     `json:"created_at"`
+	Data      db.AuditEvent `json:"data"`
+}
+
+// Dispatcher queues a delivery for every library event and sends them
+type Dispatcher struct {
+	db     *db.DB
+	cfg    Config
+	client *http.Client
+	wake   chan struct{}
+	sub    *events.Subscription
+}
+
+// New creates a dispatcher for the webhooks stored in database. It listens
+// for events right away, Run queues them.
+func New(database *db.DB, cfg Config) *Dispatcher {
+	sub, _, _ := database.Events().Subscribe(0)
+	return &Dispatcher{
+		db:     database,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		wake:   make(chan struct{}, 1),
+		sub:    sub,
+	}
+}
+
+// Sign returns the signature of body sent in HeaderSignature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify makes the dispatcher look for due deliveries right away, like
+// ones queued for redelivery
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run queues and sends deliveries until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	go d.queue(ctx)
+
+	ticker := time.NewTicker(d.cfg.Poll)
+	defer ticker.Stop()
+	for {
+		d.deliver(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// queue stores a delivery for every library event published on the bus
+func (d *Dispatcher) queue(ctx context.Context) {
+	sub := d.sub
+	defer func() { sub.Close() }()
+
+	var lastID int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				// Fell behind, pick up where we left off
+				var complete bool
+				sub, _, complete = d.db.Events().Subscribe(lastID)
+				if !complete {
+					log.Println("Webhook events were lost")
+				}
+				continue
+			}
+			lastID = e.ID
+			audit, ok := e.Data.(db.AuditEvent)
+			if !ok {
+				continue
+			}
+			body, err := json.Marshal(Payload{Event: e.Type, CreatedAt: audit.CreatedAt, Data: audit})
+			if err != nil {
+				log.Printf("Failed to encode webhook payload: %v\n", err)
+				continue
+			}
+			n, err := d.db.QueueWebhookDeliveries(e.Type, body)
+			if err != nil {
+				log.Printf("Failed to queue webhook deliveries: %v\n", err)
+			}
+			if n > 0 {
+				d.Notify()
+			}
+		}
+	}
+}
+
+// deliver sends all deliveries that are due
+func (d *Dispatcher) deliver(ctx context.Context) {
+	for ctx.Err() == nil {
+		due, err := d.db.DueWebhookDeliveries(time.Now(), batchSize)
+		if err != nil {
+			log.Printf("Failed to get webhook deliveries: %v\n", err)
+			return
+		}
+		for _, p := range due {
+			d.attempt(ctx, p)
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// attempt sends a delivery once and records the outcome
+func (d *Dispatcher) attempt(ctx context.Context, p db.PendingDelivery) {
+	code, err := d.send(ctx, p)
+	if err == nil {
+		if err := d.db.RecordWebhookAttempt(p.ID, code, "", nil); err != nil {
+			log.Printf("Failed to record webhook delivery %d: %v\n", p.ID, err)
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	if attempts := p.Attempts + 1; attempts < d.cfg.MaxAttempts {
+		t := time.Now().UTC().Add(d.cfg.Backoff << (attempts - 1))
+		retryAt = &t
+	}
+	log.Printf("Webhook delivery %d to %s failed: %v\n", p.ID, p.URL, err)
+	if err := d.db.RecordWebhookAttempt(p.ID, code, err.Error(), retryAt); err != nil {
+		log.Printf("Failed to record webhook delivery %d: %v\n", p.ID, err)
+	}
+}
+
+// send posts the payload and returns the status code of the response
+func (d *Dispatcher) send(ctx context.Context, p db.PendingDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(p.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Cellulose-Webhook")
+	req.Header.Set(HeaderEvent, p.Event)
+	req.Header.Set(HeaderDelivery, strconv.Itoa(p.ID))
+	req.Header.Set(HeaderSignature, Sign(p.Secret, p.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,188 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+)
+
+var testConfig = Config{
+	Backoff:     10 * time.Millisecond,
+	MaxAttempts: 3,
+	Poll:        5 * time.Millisecond,
+	Timeout:     time.Second,
+}
+
+// receiver records the deliveries it gets and answers with the given
+// status codes, the last one repeatedly
+type receiver struct {
+	mu       sync.Mutex
+	codes    []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	code := rc.codes[min(len(rc.requests), len(rc.codes))-1]
+	w.WriteHeader(code)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.requests)
+}
+
+func newTestDB(t *testing.T) *db.DB {
+	dir := t.TempDir()
+	database, err := db.Open(db.Config{
+		DatabasePath: filepath.Join(dir, "cellulose.db"),
+		TrashDir:     filepath.Join(dir, "trash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	return database
+}
+
+// waitFor polls cond until it holds or five seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	database := newTestDB(t)
+	admin, err := database.NewUser("admin", "password", db.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := db.WithUser(context.Background(), admin)
+
+	// The first attempt fails, the retry succeeds
+	rc := &receiver{codes: []int{http.StatusInternalServerError, http.StatusOK}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	hook, secret, err := database.NewWebhook(ctx, server.URL, []string{"document.*"}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "s3cret" {
+		t.Errorf("expected the given secret, got %q", secret)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go New(database, testConfig).Run(runCtx)
+
+	// Tags are not subscribed to
+	if _, err := database.NewTag(ctx, "invoice", "#ff0000"); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := database.NewDocument(ctx, db.DocumentOptions{Title: "March", Path: "../pdf/testdata/test1.pdf", Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deliveries []db.WebhookDelivery
+	waitFor(t, "the retry", func() bool {
+		deliveries, err = database.GetWebhookDeliveries(hook.ID)
+		return err == nil && len(deliveries) == 1 && deliveries[0].Status == db.DeliverySucceeded
+	})
+	if d := deliveries[0]; d.Attempts != 2 || d.ResponseCode != http.StatusOK || d.Event != "document.create" {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+
+	rc.mu.Lock()
+	req, body := rc.requests[1], rc.bodies[1]
+	rc.mu.Unlock()
+	if got := req.Header.Get(HeaderSignature); got != Sign("s3cret", body) {
+		t.Errorf("signature %q doesn't match the body", got)
+	}
+	if req.Header.Get(HeaderEvent) != "document.create" || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "document.create" || payload.Data.EntityID != doc.ID {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	// A redelivery is a new delivery of the same payload
+	again, err := database.RedeliverWebhook(hook.ID, deliveries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the redelivery", func() bool { return rc.count() == 3 })
+	rc.mu.Lock()
+	redelivered := string(rc.bodies[2])
+	rc.mu.Unlock()
+	if redelivered != string(body) || again.ID == deliveries[0].ID {
+		t.Errorf("unexpected redelivery %+v of %s", again, redelivered)
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	database := newTestDB(t)
+	rc := &receiver{codes: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	hook, _, err := database.NewWebhook(db.SystemContext(), server.URL, []string{"*"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.NewTag(db.SystemContext(), "invoice", "#ff0000"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Deliveries queued while the dispatcher was down are sent on start
+	if _, err := database.QueueWebhookDeliveries("tag.create", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	go New(database, testConfig).Run(ctx)
+
+	waitFor(t, "the delivery to fail", func() bool {
+		deliveries, err := database.GetWebhookDeliveries(hook.ID)
+		return err == nil && len(deliveries) == 1 && deliveries[0].Status == db.DeliveryFailed
+	})
+	deliveries, _ := database.GetWebhookDeliveries(hook.ID)
+	if d := deliveries[0]; d.Attempts != testConfig.MaxAttempts || d.ResponseCode != http.StatusServiceUnavailable || d.NextAttemptAt != nil {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+	if rc.count() != testConfig.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d", testConfig.MaxAttempts, rc.count())
+	}
+
+	if _, _, err := database.NewWebhook(db.SystemContext(), "ftp://example.com", []string{"*"}, ""); err == nil {
+		t.Error("expected an error for a non-HTTP URL")
+	}
+	if _, _, err := database.NewWebhook(db.SystemContext(), server.URL, []string{"document"}, ""); err == nil {
+		t.Error("expected an error for an invalid event")
+	}
+}
@@ -1,39 +1,208 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/Ardelean-Calin/cellulose/handlers"
+	"github.com/Ardelean-Calin/cellulose/internal/backup"
 	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/ingest"
+	"github.com/Ardelean-Calin/cellulose/internal/oidc"
+	"github.com/Ardelean-Calin/cellulose/internal/openapi"
+	"github.com/Ardelean-Calin/cellulose/internal/webhooks"
 	"github.com/Ardelean-Calin/cellulose/middleware"
 )
 
+const usage = `Usage: cellulose <command> [arguments]
+
+Commands:
+  serve          start the HTTP server (default)
+  import <dir>   restore an archive, or add every file inside dir
+  export <dir>   write the library as an archive into dir
+  reprocess      re-read dates and sizes and re-run matching for all documents
+  check          verify stored files against the database
+  adduser <name> create an account (-admin for an administrator)
+`
+
 func main() {
-	database, err := db.InitDB()
+	cmd := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "import":
+		err = importCmd(args)
+	case "export":
+		err = exportCmd(args)
+	case "reprocess":
+		err = reprocessCmd(args)
+	case "check":
+		err = checkCmd(args)
+	case "adduser":
+		err = addUserCmd(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	backupDir := fs.String("backup-dir", "", "directory for scheduled backups (disabled when empty)")
+	backupInterval := fs.Duration("backup-interval", 24*time.Hour, "time between scheduled backups")
+	keepDaily := fs.Int("backup-keep-daily", 7, "number of daily backups to keep")
+	keepWeekly := fs.Int("backup-keep-weekly", 4, "number of weekly backups to keep")
+	trashDays := fs.Int("trash-days", 30, "days after which trashed documents are purged (0 keeps them forever)")
+	oidcIssuer := fs.String("oidc-issuer", "", "OpenID Connect issuer URL (single sign-on is disabled when empty)")
+	oidcClientID := fs.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcRedirectURL := fs.String("oidc-redirect-url", "", "public URL of /api/auth/oidc/callback")
+	oidcScopes := fs.String("oidc-scopes", "profile,email", "comma separated scopes to request besides openid")
+	oidcGroupsClaim := fs.String("oidc-groups-claim", "groups", "identity token claim listing the user's groups")
+	oidcAdminGroups := fs.String("oidc-admin-groups", "", "comma separated groups whose members become administrators")
+	fs.Parse(args)
+
+	database, err := db.InitDB()
+	if err != nil {
+		return err
+	}
 	defer database.Close()
 
+	// Remove leftovers of uploads that were interrupted by a crash
+	if n, err := ingest.New(database, ingest.DefaultDir).Sweep(15 * time.Minute); err != nil {
+		log.Printf("Failed to sweep temporary files: %v\n", err)
+	} else if n > 0 {
+		log.Printf("Removed %d orphaned temporary files\n", n)
+	}
+
 	// Create app with dependencies
 	app := handlers.NewApp(database)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("POST /api/documents", app.UploadDocument)
-	mux.HandleFunc("GET /api/documents", app.GetDocuments)
-	// mux.HandleFunc("PUT /api/documents/{id}", handler.UpdateByID)
-	mux.HandleFunc("GET /api/documents/{id}", app.GetDocumentByID)
-	mux.HandleFunc("DELETE /api/documents/{id}", app.DeleteDocumentByID)
-
-	mux.HandleFunc("POST /api/tags", app.CreateTag)
-	mux.HandleFunc("GET /api/tags", app.GetTags)
-	mux.HandleFunc("GET /api/tags/{id}", app.GetTagByID)
-	mux.HandleFunc("DELETE /api/tags/{id}", app.DeleteTagByID)
-
-	fmt.Println("Server is running on port 8080")
-	if err := http.ListenAndServe(":8080", middleware.Logging(mux)); err != nil {
-		log.Panic(err)
+	if *backupDir != "" {
+		backups := backup.New(database, backup.Config{
+			Dir:        *backupDir,
+			Interval:   *backupInterval,
+			KeepDaily:  *keepDaily,
+			KeepWeekly: *keepWeekly,
+		})
+		app.SetBackupManager(backups)
+		go backups.Run(context.Background())
+	}
+
+	if *oidcIssuer != "" {
+		// The client secret is read from the environment to keep it out of
+		// the process list
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		provider, err := oidc.New(ctx, oidc.Config{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: os.Getenv("CELLULOSE_OIDC_CLIENT_SECRET"),
+			RedirectURL:  *oidcRedirectURL,
+			Scopes:       splitList(*oidcScopes),
+			GroupsClaim:  *oidcGroupsClaim,
+			AdminGroups:  splitList(*oidcAdminGroups),
+		}, nil)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to set up single sign-on: %w", err)
+		}
+		app.SetOIDCProvider(provider)
+	}
+
+	hooks := webhooks.New(database, webhooks.DefaultConfig)
+	app.SetWebhookDispatcher(hooks)
+	go hooks.Run(context.Background())
+
+	go expireUploads(context.Background(), ingest.New(database, ingest.DefaultDir))
+
+	if *trashDays > 0 {
+		go purgeTrash(context.Background(), database, time.Duration(*trashDays)*24*time.Hour)
+	}
+
+	if n, err := database.CountUsers(); err == nil && n == 0 {
+		log.Println("No accounts exist yet: create the first admin with POST /api/auth/setup or `cellulose adduser -admin <name>`")
+	}
+
+	spec, err := openapi.Load()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Server is running on %s\n", *addr)
+	auth := middleware.Auth(database, "/api/auth/setup", "/api/auth/login", "/api/auth/oidc/", "/s/", middleware.LoginPage,
+		"/api/openapi.json", "/api/docs", "/static/")
+	validate := middleware.Validate(spec)
+	return http.ListenAndServe(*addr, middleware.Logging(auth(validate(routes(app)))))
+}
+
+// splitList splits a comma separated flag value
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// expireUploads periodically removes resumable uploads that stopped
+// receiving data
+func expireUploads(ctx context.Context, pipeline *ingest.Pipeline) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		expired, err := pipeline.ExpireUploads(time.Now())
+		if err != nil {
+			log.Printf("Failed to expire uploads: %v\n", err)
+		}
+		if expired > 0 {
+			log.Printf("Removed %d expired uploads\n", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrash periodically deletes documents that have been in the trash for
+// longer than retention
+func purgeTrash(ctx context.Context, database *db.DB, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		purged, err := database.PurgeTrash(db.SystemContext(), time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Failed to purge trash: %v\n", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d documents from the trash\n", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
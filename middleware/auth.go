@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Ardelean-Calin/cellulose/internal/db"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// SessionCookie is the name of the cookie carrying the session token
+const SessionCookie = "cellulose_session"
+
+// LoginPage is where browsers are sent when they need to log in
+const LoginPage = "/login"
+
+// Auth resolves the API token or session cookie of every request and stores
+// the user in the request context. API tokens are sent as
+// "Authorization: Bearer <token>" and limit the request to their scopes.
+// Requests without valid credentials are rejected, except for the given
+// public paths. A public path ending in "/" matches every path below it.
+// Browsers asking for a page are redirected to LoginPage instead, and HTMX
+// requests are told to go there.
+func Auth(database *db.DB, public ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if secret, ok := bearerToken(r); ok {
+				user, scopes, err := database.GetAPITokenUser(secret)
+				if err != nil {
+					problem.Error(w, "Invalid API token", http.StatusUnauthorized)
+					return
+				}
+				ctx := db.WithScopes(db.WithUser(r.Context(), user), scopes)
+				if !db.HasScope(ctx, methodScope(r.Method)) {
+					problem.Error(w, "API token lacks the required scope", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			if cookie, err := r.Cookie(SessionCookie); err == nil {
+				if user, err := database.GetSessionUser(cookie.Value); err == nil {
+					r = r.WithContext(db.WithUser(r.Context(), user))
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if isPublic(r.URL.Path, public) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Redirect", LoginPage)
+			} else if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") &&
+				strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, LoginPage, http.StatusSeeOther)
+				return
+			}
+			problem.Error(w, "Authentication required", http.StatusUnauthorized)
+		})
+	}
+}
+
+// AdminOnly rejects requests whose user is not an administrator
+func AdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := db.UserFromContext(r.Context())
+		if !ok {
+			problem.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !user.IsAdmin() || !db.HasScope(r.Context(), db.ScopeAdmin) {
+			problem.Error(w, "Administrator rights required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bearerToken extracts the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// methodScope returns the scope an API token needs for a request method
+func methodScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return db.ScopeRead
+	default:
+		return db.ScopeWrite
+	}
+}
+
+func isPublic(path string, public []string) bool {
+	for _, p := range public {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Ardelean-Calin/cellulose/internal/openapi"
+	"github.com/Ardelean-Calin/cellulose/internal/problem"
+)
+
+// Validate rejects requests whose parameters or JSON body don't match the
+// API specification, listing every invalid input. Requests the
+// specification doesn't describe are passed on unchecked.
+func Validate(spec *openapi.Spec) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			op, params := spec.Find(r.Method, r.URL.Path)
+			if op == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if errs := spec.Validate(r, op, params); len(errs) > 0 {
+				messages := make([]string, len(errs))
+				for i, e := range errs {
+					messages[i] = e.Message
+				}
+				problem.Write(w, problem.Details{
+					Status: http.StatusBadRequest,
+					Detail: strings.Join(messages, ", "),
+					Code:   "validation_failed",
+					Errors: errs,
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
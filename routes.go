@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Ardelean-Calin/cellulose/handlers"
+	"github.com/Ardelean-Calin/cellulose/middleware"
+)
+
+// router is a ServeMux remembering its patterns, so that tests can compare
+// them with the API specification
+type router struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (r *router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	r.ServeMux.HandleFunc(pattern, handler)
+	r.patterns = append(r.patterns, pattern)
+}
+
+// routes registers the handlers of app. Every route has to be described in
+// internal/openapi/openapi.json.
+func routes(app *handlers.App) *router {
+	mux := &router{ServeMux: http.NewServeMux()}
+	mux.HandleFunc("GET /api/auth/setup", app.GetSetupStatus)
+	mux.HandleFunc("POST /api/auth/setup", app.Setup)
+	mux.HandleFunc("POST /api/auth/login", app.Login)
+	mux.HandleFunc("POST /api/auth/logout", app.Logout)
+	mux.HandleFunc("GET /api/auth/me", app.GetCurrentUser)
+	mux.HandleFunc("GET /api/auth/oidc/login", app.OIDCLogin)
+	mux.HandleFunc("GET /api/auth/oidc/callback", app.OIDCCallback)
+
+	mux.HandleFunc("GET /api/tokens", app.GetAPITokens)
+	mux.HandleFunc("POST /api/tokens", app.CreateAPIToken)
+	mux.HandleFunc("DELETE /api/tokens/{id}", app.DeleteAPITokenByID)
+
+	mux.HandleFunc("GET /api/users", middleware.AdminOnly(app.GetUsers))
+	mux.HandleFunc("POST /api/users", middleware.AdminOnly(app.CreateUser))
+	mux.HandleFunc("DELETE /api/users/{id}", middleware.AdminOnly(app.DeleteUserByID))
+
+	mux.HandleFunc("GET /api/groups", middleware.AdminOnly(app.GetGroups))
+	mux.HandleFunc("POST /api/groups", middleware.AdminOnly(app.CreateGroup))
+	mux.HandleFunc("DELETE /api/groups/{id}", middleware.AdminOnly(app.DeleteGroupByID))
+	mux.HandleFunc("POST /api/groups/{id}/members", middleware.AdminOnly(app.AddGroupMember))
+	mux.HandleFunc("DELETE /api/groups/{id}/members/{user}", middleware.AdminOnly(app.RemoveGroupMember))
+
+	mux.HandleFunc("POST /api/documents", app.UploadDocument)
+	mux.HandleFunc("GET /api/documents", app.GetDocuments)
+	mux.HandleFunc("POST /api/documents/bulk", app.BulkUpdateDocuments)
+	mux.HandleFunc("PATCH /api/documents/{id}", app.UpdateDocumentByID)
+	mux.HandleFunc("GET /api/documents/{id}", app.GetDocumentByID)
+	mux.HandleFunc("DELETE /api/documents/{id}", app.DeleteDocumentByID)
+	mux.HandleFunc("GET /api/documents/{id}/history", app.GetDocumentHistory)
+
+	mux.HandleFunc("OPTIONS /api/uploads", app.GetUploadOptions)
+	mux.HandleFunc("POST /api/uploads", app.CreateUpload)
+	mux.HandleFunc("HEAD /api/uploads/{id}", app.GetUploadOffset)
+	mux.HandleFunc("PATCH /api/uploads/{id}", app.WriteUpload)
+	mux.HandleFunc("DELETE /api/uploads/{id}", app.DeleteUpload)
+
+	mux.HandleFunc("GET /api/documents/{id}/versions", app.GetDocumentVersions)
+	mux.HandleFunc("POST /api/documents/{id}/versions", app.CreateDocumentVersion)
+	mux.HandleFunc("GET /api/documents/{id}/versions/{version}", app.DownloadDocumentVersion)
+	mux.HandleFunc("POST /api/documents/{id}/versions/{version}/restore", app.RestoreDocumentVersion)
+
+	mux.HandleFunc("GET /api/documents/{id}/notes", app.GetDocumentNotes)
+	mux.HandleFunc("POST /api/documents/{id}/notes", app.CreateDocumentNote)
+	mux.HandleFunc("GET /api/documents/{id}/notes/{note}", app.GetDocumentNote)
+	mux.HandleFunc("PUT /api/documents/{id}/notes/{note}", app.UpdateDocumentNote)
+	mux.HandleFunc("DELETE /api/documents/{id}/notes/{note}", app.DeleteDocumentNote)
+
+	mux.HandleFunc("GET /api/documents/{id}/grants", app.GetDocumentGrants)
+	mux.HandleFunc("POST /api/documents/{id}/grants", app.CreateDocumentGrant)
+	mux.HandleFunc("DELETE /api/documents/{id}/grants/{grant}", app.DeleteDocumentGrant)
+
+	mux.HandleFunc("GET /api/documents/{id}/shares", app.GetShares)
+	mux.HandleFunc("POST /api/documents/{id}/shares", app.CreateShare)
+	mux.HandleFunc("GET /api/shares", app.GetShares)
+	mux.HandleFunc("DELETE /api/shares/{id}", app.DeleteShareByID)
+	mux.HandleFunc("GET /api/shares/{id}/accesses", app.GetShareAccesses)
+	mux.HandleFunc("GET /s/{token}", app.ServeShare)
+	mux.HandleFunc("POST /s/{token}", app.ServeShare)
+
+	mux.HandleFunc("GET /api/trash", app.GetTrash)
+	mux.HandleFunc("POST /api/trash/{id}/restore", app.RestoreDocumentByID)
+	mux.HandleFunc("DELETE /api/trash/{id}", app.PurgeDocumentByID)
+
+	mux.HandleFunc("GET /api/correspondents", app.GetCorrespondents)
+	mux.HandleFunc("POST /api/correspondents", app.CreateCorrespondent)
+	mux.HandleFunc("GET /api/correspondents/{id}", app.GetCorrespondentByID)
+	mux.HandleFunc("PUT /api/correspondents/{id}", app.UpdateCorrespondentByID)
+	mux.HandleFunc("DELETE /api/correspondents/{id}", app.DeleteCorrespondentByID)
+
+	mux.HandleFunc("GET /api/document_types", app.GetDocumentTypes)
+	mux.HandleFunc("POST /api/document_types", app.CreateDocumentType)
+	mux.HandleFunc("GET /api/document_types/{id}", app.GetDocumentTypeByID)
+	mux.HandleFunc("PUT /api/document_types/{id}", app.UpdateDocumentTypeByID)
+	mux.HandleFunc("DELETE /api/document_types/{id}", app.DeleteDocumentTypeByID)
+
+	mux.HandleFunc("GET /api/fields", app.GetCustomFields)
+	mux.HandleFunc("POST /api/fields", app.CreateCustomField)
+	mux.HandleFunc("GET /api/fields/{id}", app.GetCustomFieldByID)
+	mux.HandleFunc("DELETE /api/fields/{id}", middleware.AdminOnly(app.DeleteCustomFieldByID))
+
+	mux.HandleFunc("POST /api/tags", app.CreateTag)
+	mux.HandleFunc("GET /api/tags", app.GetTags)
+	mux.HandleFunc("GET /api/tags/{id}", app.GetTagByID)
+	mux.HandleFunc("PATCH /api/tags/{id}", app.UpdateTagByID)
+	mux.HandleFunc("DELETE /api/tags/{id}", app.DeleteTagByID)
+
+	mux.HandleFunc("GET /api/stats", app.GetStats)
+	mux.HandleFunc("GET /api/jobs/{id}", app.GetJobByID)
+	mux.HandleFunc("GET /api/events", app.GetEvents)
+
+	mux.HandleFunc("GET /api/openapi.json", app.GetOpenAPISpec)
+	mux.HandleFunc("GET /api/docs", app.APIDocs)
+
+	mux.HandleFunc("GET /{$}", app.Index)
+	mux.HandleFunc("GET /documents/{id}", app.DocumentPage)
+	mux.HandleFunc("GET "+middleware.LoginPage, app.LoginPage)
+	mux.HandleFunc("GET /static/{name}", app.Static)
+
+	mux.HandleFunc("POST /api/admin/backup", middleware.AdminOnly(app.CreateBackup))
+	mux.HandleFunc("GET /api/audit", middleware.AdminOnly(app.GetAuditEvents))
+
+	mux.HandleFunc("GET /api/webhooks", middleware.AdminOnly(app.GetWebhooks))
+	mux.HandleFunc("POST /api/webhooks", middleware.AdminOnly(app.CreateWebhook))
+	mux.HandleFunc("DELETE /api/webhooks/{id}", middleware.AdminOnly(app.DeleteWebhookByID))
+	mux.HandleFunc("GET /api/webhooks/{id}/deliveries", middleware.AdminOnly(app.GetWebhookDeliveries))
+	mux.HandleFunc("POST /api/webhooks/{id}/deliveries/{delivery}/redeliver", middleware.AdminOnly(app.RedeliverWebhook))
+
+	return mux
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Ardelean-Calin/cellulose/handlers"
+	"github.com/Ardelean-Calin/cellulose/internal/openapi"
+)
+
+// TestSpecMatchesRoutes makes sure that the API specification describes
+// exactly the registered routes
+func TestSpecMatchesRoutes(t *testing.T) {
+	spec, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	described := make(map[string]bool)
+	for _, op := range spec.Operations() {
+		described[op] = true
+	}
+
+	registered := make(map[string]bool)
+	for _, pattern := range routes(&handlers.App{}).patterns {
+		// The specification has no notion of an exact match of "/"
+		registered[strings.Replace(pattern, "{$}", "", 1)] = true
+	}
+
+	var missing, stale []string
+	for op := range registered {
+		if !described[op] {
+			missing = append(missing, op)
+		}
+	}
+	for op := range described {
+		if !registered[op] {
+			stale = append(stale, op)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+	if len(missing) > 0 {
+		t.Errorf("routes missing from the specification:\n%s", strings.Join(missing, "\n"))
+	}
+	if len(stale) > 0 {
+		t.Errorf("specified operations without a route:\n%s", strings.Join(stale, "\n"))
+	}
+}